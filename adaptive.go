@@ -0,0 +1,242 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAdaptiveRoutes limits the number of learned routes. New routes are
+// not learned if it is reached, until expired ones are cleaned up.
+const maxAdaptiveRoutes = 65536
+
+// adaptiveRoute queries the local and the remote upstream at once and
+// uses the first valid response. The local response has already been
+// checked by local ip, so a vetoed local response is never valid.
+// The winner is remembered per domain for ttl. Later queries of the
+// domain only go to the winner, and race again if the winner failed.
+type adaptiveRoute struct {
+	local  handler.ExecutableChainNode
+	remote handler.ExecutableChainNode
+	ttl    time.Duration
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	routes map[string]adaptiveEntry
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+type adaptiveEntry struct {
+	route  string
+	expire time.Time
+}
+
+func newAdaptiveRoute(local, remote handler.ExecutableChainNode, ttl time.Duration, logger *zap.Logger) *adaptiveRoute {
+	a := &adaptiveRoute{
+		local:     local,
+		remote:    remote,
+		ttl:       ttl,
+		logger:    logger,
+		routes:    make(map[string]adaptiveEntry),
+		closeChan: make(chan struct{}),
+	}
+	go a.cleanupLoop()
+	return a
+}
+
+type adaptiveResult struct {
+	route string
+	qCtx  *handler.Context
+	err   error
+}
+
+// valid reports whether res can be used as the response. A server
+// failure is not valid, because the other upstream may do better.
+func (res *adaptiveResult) valid() bool {
+	if res.err != nil {
+		return false
+	}
+	r := res.qCtx.R()
+	return r != nil && r.Rcode != dns.RcodeServerFailure && r.Rcode != dns.RcodeRefused
+}
+
+func (a *adaptiveRoute) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if err := a.exec(ctx, qCtx); err != nil {
+		return err
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+func (a *adaptiveRoute) exec(ctx context.Context, qCtx *handler.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return a.race(ctx, qCtx, "")
+	}
+	name := strings.ToLower(q.Question[0].Name)
+
+	if route := a.routeOf(name); len(route) > 0 {
+		node := a.local
+		if route == "remote" {
+			node = a.remote
+		}
+		res := &adaptiveResult{route: route, qCtx: qCtx.Copy()}
+		res.err = handler.ExecChainNode(ctx, res.qCtx, node)
+		if res.valid() {
+			qCtx.SetResponse(res.qCtx.R(), res.qCtx.Status())
+			return nil
+		}
+		a.logger.Debug("learned route failed, racing again", qCtx.InfoField(), zap.String("route", route), zap.Error(res.err))
+		a.forget(name)
+	}
+	return a.race(ctx, qCtx, name)
+}
+
+// race queries both upstreams and learns the winner for name, if name
+// is not empty. If neither response is valid, the remote result is used.
+func (a *adaptiveRoute) race(ctx context.Context, qCtx *handler.Context, name string) error {
+	rCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := make(chan *adaptiveResult, 2)
+	for _, b := range [...]struct {
+		route string
+		node  handler.ExecutableChainNode
+	}{{"local", a.local}, {"remote", a.remote}} {
+		res := &adaptiveResult{route: b.route, qCtx: qCtx.Copy()}
+		node := b.node
+		go func() {
+			res.err = handler.ExecChainNode(rCtx, res.qCtx, node)
+			c <- res
+		}()
+	}
+
+	var remote *adaptiveResult
+	for i := 0; i < 2; i++ {
+		var res *adaptiveResult
+		select {
+		case res = <-c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.valid() {
+			qCtx.SetResponse(res.qCtx.R(), res.qCtx.Status())
+			if len(name) > 0 {
+				a.learn(name, res.route)
+				a.logger.Debug("route learned", qCtx.InfoField(), zap.String("route", res.route))
+			}
+			return nil
+		}
+		if res.route == "remote" {
+			remote = res
+		}
+	}
+	qCtx.SetResponse(remote.qCtx.R(), remote.qCtx.Status())
+	return remote.err
+}
+
+// routeOf returns the learned route of name, or "" if there is none.
+func (a *adaptiveRoute) routeOf(name string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.routes[name]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(e.expire) {
+		delete(a.routes, name)
+		return ""
+	}
+	return e.route
+}
+
+func (a *adaptiveRoute) learn(name, route string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.routes[name]; !ok && len(a.routes) >= maxAdaptiveRoutes {
+		return
+	}
+	a.routes[name] = adaptiveEntry{route: route, expire: time.Now().Add(a.ttl)}
+}
+
+func (a *adaptiveRoute) forget(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.routes, name)
+}
+
+// flush forgets all learned routes.
+func (a *adaptiveRoute) flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.routes = make(map[string]adaptiveEntry)
+}
+
+type adaptiveRouteStatus struct {
+	Domain    string `json:"domain"`
+	Route     string `json:"route"`
+	ExpiresIn int64  `json:"expires_in"` // seconds
+}
+
+// status returns the unexpired learned routes, sorted by domain.
+func (a *adaptiveRoute) status() []adaptiveRouteStatus {
+	now := time.Now()
+	a.mu.Lock()
+	s := make([]adaptiveRouteStatus, 0, len(a.routes))
+	for name, e := range a.routes {
+		if now.After(e.expire) {
+			continue
+		}
+		s = append(s, adaptiveRouteStatus{Domain: name, Route: e.route, ExpiresIn: int64(e.expire.Sub(now) / time.Second)})
+	}
+	a.mu.Unlock()
+	sort.Slice(s, func(i, j int) bool { return s[i].Domain < s[j].Domain })
+	return s
+}
+
+func (a *adaptiveRoute) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.closeChan:
+			return
+		case now := <-ticker.C:
+			a.mu.Lock()
+			for name, e := range a.routes {
+				if now.After(e.expire) {
+					delete(a.routes, name)
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+func (a *adaptiveRoute) Close() error {
+	a.closeOnce.Do(func() { close(a.closeChan) })
+	return nil
+}
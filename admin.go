@@ -0,0 +1,195 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// adminAPI serves the admin http api. Caches and forwarders are
+// registered by initEntry.
+var adminAPI = new(adminHandler)
+
+type adminHandler struct {
+	token string // optional bearer token
+	pprof bool   // also serve the pprof handlers
+
+	mu         sync.Mutex
+	cache      *dnsCache // nil if cache is disabled
+	forwarders []*forwarder
+	adaptive   *adaptiveRoute // nil if not in the adaptive dispatch mode
+}
+
+func (a *adminHandler) setCache(c *dnsCache) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cache = c
+}
+
+func (a *adminHandler) setAdaptive(r *adaptiveRoute) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.adaptive = r
+}
+
+func (a *adminHandler) addForwarder(f *forwarder) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.forwarders = append(a.forwarders, f)
+}
+
+func (a *adminHandler) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/stats", a.handleCacheStats)
+	mux.HandleFunc("/cache/flush", a.handleCacheFlush)
+	mux.HandleFunc("/upstreams", a.handleUpstreams)
+	mux.HandleFunc("/adaptive", a.handleAdaptive)
+	mux.HandleFunc("/adaptive/flush", a.handleAdaptiveFlush)
+	if a.pprof {
+		registerPprof(mux)
+	}
+	return a.auth(mux)
+}
+
+func (a *adminHandler) auth(next http.Handler) http.Handler {
+	if len(a.token) == 0 {
+		return next
+	}
+	want := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (a *adminHandler) getCache(w http.ResponseWriter) *dnsCache {
+	a.mu.Lock()
+	c := a.cache
+	a.mu.Unlock()
+	if c == nil {
+		http.Error(w, "cache is disabled", http.StatusNotFound)
+	}
+	return c
+}
+
+func (a *adminHandler) handleCacheStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := a.getCache(w)
+	if c == nil {
+		return
+	}
+	writeJSON(w, c.stats())
+}
+
+func (a *adminHandler) handleCacheFlush(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := a.getCache(w)
+	if c == nil {
+		return
+	}
+	if domain := req.URL.Query().Get("domain"); len(domain) > 0 {
+		c.flushName(domain)
+		writeJSON(w, map[string]interface{}{"flushed": domain})
+		return
+	}
+	c.flush()
+	writeJSON(w, map[string]interface{}{"flushed": "all"})
+}
+
+type upstreamStatus struct {
+	Group    string `json:"group"`
+	Address  string `json:"address"`
+	Healthy  bool   `json:"healthy"`
+	Failures uint32 `json:"failures"`
+}
+
+func (a *adminHandler) handleUpstreams(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.mu.Lock()
+	forwarders := a.forwarders
+	a.mu.Unlock()
+
+	status := make([]upstreamStatus, 0)
+	for _, f := range forwarders {
+		for _, u := range f.us {
+			status = append(status, upstreamStatus{
+				Group:    f.name,
+				Address:  u.Address(),
+				Healthy:  u.healthy(),
+				Failures: atomic.LoadUint32(&u.failures),
+			})
+		}
+	}
+	writeJSON(w, status)
+}
+
+func (a *adminHandler) getAdaptive(w http.ResponseWriter) *adaptiveRoute {
+	a.mu.Lock()
+	r := a.adaptive
+	a.mu.Unlock()
+	if r == nil {
+		http.Error(w, "adaptive dispatch mode is disabled", http.StatusNotFound)
+	}
+	return r
+}
+
+func (a *adminHandler) handleAdaptive(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r := a.getAdaptive(w)
+	if r == nil {
+		return
+	}
+	writeJSON(w, r.status())
+}
+
+func (a *adminHandler) handleAdaptiveFlush(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r := a.getAdaptive(w)
+	if r == nil {
+		return
+	}
+	r.flush()
+	writeJSON(w, map[string]interface{}{"flushed": "all"})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
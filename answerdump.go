@@ -0,0 +1,108 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+// answerDumpMaxSeen limits the memory used to deduplicate the mappings.
+// The set is cleared when it is full.
+const answerDumpMaxSeen = 1 << 20
+
+// answerDumper appends the domain to ip mappings in upstream responses to
+// a file. Every mapping is written only once in a session.
+// Lines are in the hosts format, e.g.
+// "www.example.com 1.2.3.4 # 2021-06-01T12:00:00+08:00".
+type answerDumper struct {
+	mu   sync.Mutex
+	w    *rotateFile
+	seen map[string]struct{}
+}
+
+func newAnswerDumper(file string, maxSize int64) (*answerDumper, error) {
+	w, err := newRotateFile(file, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &answerDumper{w: w, seen: make(map[string]struct{})}, nil
+}
+
+func (d *answerDumper) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.w.Close()
+}
+
+func (d *answerDumper) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	ctx, qi := withQueryInfo(ctx)
+	err := handler.ExecChainNode(ctx, qCtx, next)
+
+	r := qCtx.R()
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Question) == 0 {
+		return err
+	}
+	// Skip the responses from hosts and other local rules.
+	if _, ok := qi.answerOf(r); !ok && !qi.isCacheHit() {
+		return err
+	}
+	name := strings.TrimSuffix(strings.ToLower(r.Question[0].Name), ".")
+	if len(name) == 0 {
+		return err
+	}
+
+	var b strings.Builder
+	var keys []string
+	ts := time.Now().Format(time.RFC3339)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, rr := range r.Answer {
+		ip := rrIP(rr)
+		if ip == nil {
+			continue
+		}
+		k := name + " " + ip.String()
+		if _, ok := d.seen[k]; ok {
+			continue
+		}
+		keys = append(keys, k)
+		b.WriteString(k + " # " + ts + "\n")
+	}
+	if len(keys) == 0 {
+		return err
+	}
+	// Mappings that failed to be written will be retried by the next
+	// response.
+	if _, werr := d.w.Write([]byte(b.String())); werr != nil {
+		mlog.S().Warnf("failed to write answer dump, %v", werr)
+		return err
+	}
+	if len(d.seen)+len(keys) > answerDumpMaxSeen {
+		d.seen = make(map[string]struct{})
+	}
+	for _, k := range keys {
+		d.seen[k] = struct{}{}
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cacheHitNode marks the query as a cache hit, so its response is dumped.
+type cacheHitNode struct{}
+
+func (cacheHitNode) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	queryInfoFrom(ctx).setCacheHit()
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+func Test_answerDumper_writeError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "answers.txt")
+	d, err := newAnswerDumper(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	upstream := &testResponder{ip: net.IPv4(1, 2, 3, 4), ttl: 300}
+
+	// A failed write doesn't fail the query and the mapping is not
+	// marked as written.
+	d.w.f.Close()
+	execChain(t, handler.NewContext(newTestQuery("example.com", dns.TypeA), nil), d, cacheHitNode{}, upstream)
+	if len(d.seen) != 0 {
+		t.Fatalf("%d mappings are marked as written after a failed write", len(d.seen))
+	}
+
+	if err := d.w.open(); err != nil {
+		t.Fatal(err)
+	}
+	execChain(t, handler.NewContext(newTestQuery("example.com", dns.TypeA), nil), d, cacheHitNode{}, upstream)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "example.com 1.2.3.4 # ") {
+		t.Fatalf("unexpected dump %q", b)
+	}
+}
@@ -0,0 +1,213 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream/transport"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// bindConfig is the local address and/or network interface that
+// upstream connections are bound to.
+type bindConfig struct {
+	Addr      net.IP // nil if not set
+	Interface string // empty if not set
+}
+
+// parseBind parses the bindaddr and bindif args of an upstream. It returns
+// nil if both are empty. The address must be assigned to a local interface
+// and the interface must exist.
+func parseBind(addr, iface string) (*bindConfig, error) {
+	if len(addr) == 0 && len(iface) == 0 {
+		return nil, nil
+	}
+	b := new(bindConfig)
+	if len(addr) > 0 {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bindaddr %s", addr)
+		}
+		ok, err := isLocalIP(ip)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list local addresses, %w", err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("bindaddr %s is not assigned to any local interface", addr)
+		}
+		b.Addr = ip
+	}
+	if len(iface) > 0 {
+		if !bindIfSupported {
+			return nil, errors.New("bindif is only supported on linux")
+		}
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return nil, fmt.Errorf("invalid bindif %s, %w", iface, err)
+		}
+		b.Interface = iface
+	}
+	return b, nil
+}
+
+func isLocalIP(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dialer returns a dialer of network ("tcp" or "udp") that binds its
+// connections to b. control will also be applied to the connections if
+// it is not nil. b can be nil.
+func (b *bindConfig) dialer(network string, control func(network, address string, c syscall.RawConn) error) *net.Dialer {
+	d := &net.Dialer{Control: control}
+	if b == nil {
+		return d
+	}
+	if b.Addr != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: b.Addr}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: b.Addr}
+		}
+	}
+	if len(b.Interface) > 0 {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			if err := bindToDevice(c, b.Interface); err != nil {
+				return err
+			}
+			if control != nil {
+				return control(network, address, c)
+			}
+			return nil
+		}
+	}
+	return d
+}
+
+// newBoundUpstream is like upstream.NewUpstream, but all connections
+// are bound to opt.Bind. HTTP/3 is not supported.
+func newBoundUpstream(addr string, opt *upstreamOpt) (upstream.Upstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp":
+		dialAddr := udpDialAddr(u, opt)
+		return &udpFallbackUpstream{
+			u: &transport.Transport{
+				Logger: opt.Logger,
+				DialFunc: func(ctx context.Context) (net.Conn, error) {
+					return opt.Bind.dialer("udp", nil).DialContext(ctx, "udp", dialAddr)
+				},
+				WriteFunc: dnsutils.WriteMsgToUDP,
+				ReadFunc: func(c io.Reader) (*dns.Msg, int, error) {
+					return dnsutils.ReadMsgFromUDP(c, maxUDPSize)
+				},
+				EnablePipeline: true,
+				MaxConns:       opt.MaxConns,
+				IdleTimeout:    time.Second * 60,
+			},
+			t: newTCPFallback(dialAddr, opt),
+		}, nil
+	case "https":
+		if opt.EnableHTTP3 {
+			return nil, errors.New("bindaddr and bindif are not supported by http3 upstreams")
+		}
+	}
+
+	var control func(network, address string, c syscall.RawConn) error
+	if opt.EnableTFO && isTFOApplicable(addr, opt.EnableHTTP3) {
+		control = tfoControl
+	}
+	d := opt.Bind.dialer("tcp", control)
+	return newStreamUpstream(addr, &opt.Opt, func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", addr)
+	})
+}
+
+// udpDialAddr returns the host:port that a udp upstream u dials.
+// The port defaults to 53.
+func udpDialAddr(u *url.URL, opt *upstreamOpt) string {
+	dialAddr := u.Host
+	if len(opt.DialAddr) > 0 {
+		dialAddr = opt.DialAddr
+	}
+	if _, _, err := net.SplitHostPort(dialAddr); err != nil {
+		dialAddr = net.JoinHostPort(strings.Trim(dialAddr, "[]"), "53")
+	}
+	return dialAddr
+}
+
+// newTCPFallback returns the tcp transport that a udp upstream uses
+// for truncated responses.
+func newTCPFallback(dialAddr string, opt *upstreamOpt) *transport.Transport {
+	return &transport.Transport{
+		Logger: opt.Logger,
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			return opt.Bind.dialer("tcp", nil).DialContext(ctx, "tcp", dialAddr)
+		},
+		WriteFunc: dnsutils.WriteMsgToTCP,
+		ReadFunc:  dnsutils.ReadMsgFromTCP,
+	}
+}
+
+// udpFallbackUpstream is a udp upstream that retries truncated
+// responses over tcp.
+type udpFallbackUpstream struct {
+	u upstream.Upstream
+	t *transport.Transport
+}
+
+func (u *udpFallbackUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, err := u.u.ExchangeContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if r.Truncated {
+		return u.t.ExchangeContext(ctx, q)
+	}
+	return r, nil
+}
+
+func (u *udpFallbackUpstream) CloseIdleConnections() {
+	u.u.CloseIdleConnections()
+	u.t.CloseIdleConnections()
+}
+
+func (u *udpFallbackUpstream) Close() error {
+	u.u.Close()
+	return u.t.Close()
+}
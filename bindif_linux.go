@@ -0,0 +1,41 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const bindIfSupported = true
+
+// bindToDevice binds the socket to the network interface iface.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	if cErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	}); cErr != nil {
+		return cErr
+	}
+	if err != nil {
+		return os.NewSyscallError("failed to set so_bindtodevice", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+)
+
+var errBogusResponse = errors.New("response contains bogus ip, possibly a poisoned response")
+
+// bogusIPUpstream discards responses that contain any A/AAAA record
+// in the bogus ip list, so the forwarder will wait for other upstreams.
+type bogusIPUpstream struct {
+	bundled_upstream.Upstream
+	l      netlist.Matcher
+	logger *zap.Logger
+}
+
+func (u *bogusIPUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, err := u.Upstream.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		matched, err := u.l.Match(ip)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			u.logger.Debug("bogus response discarded", zap.String("from", u.Address()), zap.Stringer("ip", ip))
+			return nil, errBogusResponse
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,185 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	bootstrapTimeout    = time.Second * 3
+	defaultBootstrapTTL = time.Hour
+)
+
+// bootstrapUpstream is an upstream.Upstream whose server hostname is
+// resolved by the bootstrap servers instead of the system resolver.
+// The resolved address will be used for ttl, then the hostname will be
+// resolved again and a new upstream will be created.
+type bootstrapUpstream struct {
+	addr       string
+	host       string
+	port       string
+	opt        upstreamOpt // DialAddr will be set to the resolved address.
+	bootstraps []string
+	ttl        time.Duration
+	logger     *zap.Logger
+
+	mu       sync.Mutex
+	u        upstream.Upstream
+	expireAt time.Time
+}
+
+// needBootstrap reports whether the server hostname of addr is a domain.
+func needBootstrap(addr string) bool {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(u.Hostname()) == nil
+}
+
+func newBootstrapUpstream(addr string, opt *upstreamOpt, bootstraps []string, ttl time.Duration, logger *zap.Logger) (*bootstrapUpstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = defaultPort(u.Scheme)
+	}
+	if ttl <= 0 {
+		ttl = defaultBootstrapTTL
+	}
+	bs := make([]string, 0, len(bootstraps))
+	for _, s := range bootstraps {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		bs = append(bs, s)
+	}
+	return &bootstrapUpstream{
+		addr:       addr,
+		host:       u.Hostname(),
+		port:       port,
+		opt:        *opt,
+		bootstraps: bs,
+		ttl:        ttl,
+		logger:     logger,
+	}, nil
+}
+
+func (b *bootstrapUpstream) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u, err := b.getUpstream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return u.ExchangeContext(ctx, m)
+}
+
+func (b *bootstrapUpstream) CloseIdleConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.u != nil {
+		b.u.CloseIdleConnections()
+	}
+}
+
+func (b *bootstrapUpstream) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.u != nil {
+		return b.u.Close()
+	}
+	return nil
+}
+
+// getUpstream returns the current upstream. If its address is expired,
+// getUpstream resolves the hostname and creates a new one. If that failed,
+// the old one will be used.
+func (b *bootstrapUpstream) getUpstream(ctx context.Context) (upstream.Upstream, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.u != nil && time.Now().Before(b.expireAt) {
+		return b.u, nil
+	}
+
+	ip, err := b.resolve(ctx)
+	if err != nil {
+		if b.u != nil {
+			b.logger.Warn("failed to resolve upstream hostname, using the old address", zap.String("upstream", b.addr), zap.Error(err))
+			b.expireAt = time.Now().Add(bootstrapTimeout) // don't retry on every query
+			return b.u, nil
+		}
+		return nil, fmt.Errorf("failed to bootstrap %s, %w", b.host, err)
+	}
+
+	opt := b.opt
+	opt.DialAddr = net.JoinHostPort(ip.String(), b.port)
+	u, err := newUpstream(b.addr, &opt)
+	if err != nil {
+		return nil, err
+	}
+	b.logger.Debug("upstream hostname resolved", zap.String("upstream", b.addr), zap.String("dial_addr", opt.DialAddr))
+	if b.u != nil {
+		b.u.CloseIdleConnections() // in-use connections will be closed once they become idle.
+	}
+	b.u = u
+	b.expireAt = time.Now().Add(b.ttl)
+	return u, nil
+}
+
+// resolve resolves the hostname by the bootstrap servers. IPv4 addresses
+// are preferred.
+func (b *bootstrapUpstream) resolve(ctx context.Context) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+	defer cancel()
+
+	var lastErr error
+	for _, qtype := range [...]uint16{dns.TypeA, dns.TypeAAAA} {
+		q := new(dns.Msg)
+		q.SetQuestion(dns.Fqdn(b.host), qtype)
+		for _, server := range b.bootstraps {
+			r, _, err := new(dns.Client).ExchangeContext(ctx, q, server)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range r.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					return rr.A, nil
+				case *dns.AAAA:
+					return rr.AAAA, nil
+				}
+			}
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no ip address in the responses")
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,587 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/cache/redis_cache"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/concurrent_lru"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/go-redis/redis/v8"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLazyUpdateTimeout = time.Second * 5
+	defaultEmptyAnswerTTL    = time.Second * 300
+
+	// TTL of the stale response that is served when upstreams failed.
+	staleReplyTTL = 30
+
+	// Only entries that were hit at least prefetchMinHits times
+	// during their lifetime will be prefetched.
+	prefetchMinHits = 2
+)
+
+type cacheConfig struct {
+	// KeyPrefix will be added to all keys. Different prefixes can be
+	// used to separate responses from different routing modes.
+	KeyPrefix string
+
+	Size  int
+	Redis string
+
+	// Shards is the number of shards of the memory cache. Zero means
+	// the default. CleanupInterval is the interval that expired entries
+	// are removed from the memory cache.
+	Shards          int
+	CleanupInterval time.Duration
+
+	// Policy is the eviction policy of the memory cache.
+	// "lru" (default), "lfu" or "random".
+	Policy string
+
+	// StatsInterval is the interval of logging cache statistics.
+	// Zero disables it.
+	StatsInterval time.Duration
+
+	LazyCacheTTL      int
+	LazyCacheReplyTTL int
+
+	// StaleTTL is the time in seconds that an expired entry will be kept
+	// in the cache. It will only be used if the upstreams failed.
+	StaleTTL int
+
+	// MinTTL and MaxTTL clamp the ttl of the responses that will be
+	// stored. Zero means no limit. Responses with a zero ttl won't be
+	// affected by MinTTL.
+	MinTTL uint32
+	MaxTTL uint32
+
+	// NegativeTTLCap is the maximum ttl of cached negative responses.
+	// Zero means no limit.
+	NegativeTTLCap uint32
+
+	// PrefetchThreshold is the percentage of the remaining ttl. A cached
+	// entry will be refreshed in the background if its remaining ttl
+	// is less than it. Zero disables prefetching.
+	PrefetchThreshold int
+
+	// NoCache is the list of domains that are never cached. Their
+	// queries are always sent to upstreams. Nil means no such domain.
+	NoCache domain.Matcher[struct{}]
+
+	// Forced are the forced clients. Their responses are stored with
+	// a different key. Nil means no forced client.
+	Forced *forcedClients
+
+	// ECSMaxSubnets is the maximum number of network blocks that
+	// responses to ecs queries of one query are cached for.
+	ECSMaxSubnets int
+}
+
+// dnsCache is a cache executable. It is similar to the cache plugin from
+// mosdns but supports prefetching and serving stale entries.
+type dnsCache struct {
+	c       *cacheConfig
+	logger  *zap.Logger
+	backend cache.Backend
+	noCache *msg_matcher.QNameMatcher // nil if c.NoCache is nil
+	ecs     *ecsCacheIndex
+	now     func() time.Time // time.Now, replaced by tests
+
+	hits     *concurrent_lru.ConcurrentLRU // *uint32, used by prefetching
+	updateSF singleflight.Group
+
+	hitCount  uint64 // atomic
+	missCount uint64 // atomic
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+
+	// Entries stored before flushedAt, or before the flush time of their
+	// qname in flushedNames, are treated as misses.
+	flushMu      sync.RWMutex
+	flushedAt    time.Time
+	flushedNames map[string]time.Time
+}
+
+func newDNSCache(c *cacheConfig, logger *zap.Logger) (*dnsCache, error) {
+	var backend cache.Backend
+	if len(c.Redis) != 0 {
+		opt, err := redis.ParseURL(c.Redis)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url, %w", err)
+		}
+		opt.MaxRetries = -1
+		backend = &redis_cache.RedisCache{
+			Client: redis.NewClient(opt),
+			Logger: logger,
+		}
+	} else {
+		shards, shardSize, err := memCacheShardSize(c.Size, c.Shards)
+		if err != nil {
+			return nil, err
+		}
+		if c.Shards > 0 && c.Size%c.Shards != 0 {
+			logger.Warn("cache size is not a multiple of the number of shards, the actual size is rounded down",
+				zap.Int("size", c.Size), zap.Int("shards", c.Shards), zap.Int("actual_size", shards*shardSize))
+		}
+		backend, err = newMemCache(shards, shardSize, c.Policy, c.CleanupInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.LazyCacheReplyTTL <= 0 {
+		c.LazyCacheReplyTTL = 30
+	}
+
+	dc := &dnsCache{
+		c:         c,
+		logger:    logger,
+		backend:   backend,
+		now:       time.Now,
+		closeChan: make(chan struct{}),
+	}
+	if c.NoCache != nil {
+		dc.noCache = msg_matcher.NewQNameMatcher(c.NoCache)
+	}
+	dc.ecs = newECSCacheIndex(c.Size, c.ECSMaxSubnets)
+	if c.PrefetchThreshold > 0 {
+		size := c.Size
+		if size <= 0 {
+			size = 1024
+		}
+		dc.hits = concurrent_lru.NewConcurrentLRU(64, size/64+1, nil, nil)
+	}
+	if c.StatsInterval > 0 {
+		go dc.logStatsLoop(c.StatsInterval)
+	}
+	return dc, nil
+}
+
+func (c *dnsCache) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if c.noCache != nil && c.noCache.MatchMsg(q) {
+		err := handler.ExecChainNode(ctx, qCtx, next)
+		c.logger.Debug("response is not cached, domain is in the no cache list", qCtx.InfoField())
+		return err
+	}
+
+	// The key is the query in wire format (without its id), so queries
+	// with different DO/CD bits or edns0 options never share a response.
+	// The ecs of the query is not a part of the key. Responses to ecs
+	// queries are stored per network block of their ecs scope.
+	ecs := dnsutils.GetMsgECS(q)
+	keyQ := q
+	if ecs != nil {
+		keyQ = q.Copy()
+		dnsutils.RemoveMsgECS(keyQ)
+	}
+	msgKey, err := utils.GetMsgKey(keyQ, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get msg key, %w", err)
+	}
+	clientPrefix, err := c.c.Forced.keyPrefix(qCtx)
+	if err != nil {
+		return err
+	}
+	msgKey = c.c.KeyPrefix + clientPrefix + msgKey
+
+	// lookup in cache
+	hitKey, v, storedTime, expirationTime := c.lookup(msgKey, ecs)
+	if v != nil && c.flushed(q, storedTime) {
+		v = nil
+	}
+
+	// cache hit
+	var stale *dns.Msg
+	if v != nil {
+		r := new(dns.Msg)
+		if err := r.Unpack(v); err != nil {
+			return fmt.Errorf("failed to unpack cached data, %w", err)
+		}
+		// change msg id to query
+		r.Id = q.Id
+		if ecs != nil {
+			setResponseECS(r, ecs)
+		}
+		msgTTL := cachedMsgTTL(r, c.c.NegativeTTLCap)
+		elapsed := c.now().Sub(storedTime)
+		if elapsed < msgTTL { // not expired
+			c.logger.Debug("cache hit", qCtx.InfoField())
+			c.countHit(true)
+			metrics.observeCache(true)
+			queryInfoFrom(ctx).setCacheHit()
+			dnsutils.SubtractTTL(r, uint32(elapsed.Seconds()))
+			qCtx.SetResponse(r, handler.ContextStatusResponded)
+			if c.shouldPrefetch(hitKey, msgTTL-elapsed, msgTTL) {
+				c.logger.Debug("prefetching", qCtx.InfoField())
+				c.updateInBackground(qCtx, next, msgKey, ecs)
+			}
+			return nil
+		}
+
+		// expired but lazy update enabled
+		if c.c.LazyCacheTTL > 0 {
+			c.logger.Debug("expired cache hit", qCtx.InfoField())
+			c.countHit(true)
+			metrics.observeCache(true)
+			queryInfoFrom(ctx).setCacheHit()
+			queryInfoFrom(ctx).addEDE(dns.ExtendedErrorCodeStaleAnswer, "lazy cache")
+			dnsutils.SetTTL(r, uint32(c.c.LazyCacheReplyTTL))
+			qCtx.SetResponse(r, handler.ContextStatusResponded)
+			c.updateInBackground(qCtx, next, msgKey, ecs)
+			return nil
+		}
+
+		// expired, it can only be used if upstreams failed.
+		if c.c.StaleTTL > 0 && c.now().Before(expirationTime) {
+			stale = r
+		}
+	}
+
+	// cache miss, run the entry and try to store its response.
+	c.logger.Debug("cache miss", qCtx.InfoField())
+	c.countHit(false)
+	metrics.observeCache(false)
+	err = handler.ExecChainNode(ctx, qCtx, next)
+	r := qCtx.R()
+	if stale != nil && (err != nil || r == nil || r.Rcode == dns.RcodeServerFailure) {
+		c.logger.Warn("upstream failed, stale data served", qCtx.InfoField(), zap.Error(err))
+		dnsutils.SetTTL(stale, staleReplyTTL)
+		queryInfoFrom(ctx).setCacheHit()
+		queryInfoFrom(ctx).addEDE(dns.ExtendedErrorCodeStaleAnswer, "upstreams failed")
+		qCtx.SetResponse(stale, handler.ContextStatusResponded)
+		c.updateInBackground(qCtx, next, msgKey, ecs)
+		return nil
+	}
+	if r != nil {
+		c.store(msgKey, ecs, r)
+	}
+	return err
+}
+
+// lookup returns the cached response to a query of key with ecs e,
+// and the key it was found with. e is nil if the query has no ecs.
+func (c *dnsCache) lookup(key string, e *dns.EDNS0_SUBNET) (hitKey string, v []byte, storedTime, expirationTime time.Time) {
+	if e == nil {
+		v, storedTime, expirationTime = c.backend.Get(key)
+		return key, v, storedTime, expirationTime
+	}
+	for _, k := range c.ecs.keys(key, e) {
+		if v, storedTime, expirationTime = c.backend.Get(k); v != nil {
+			return k, v, storedTime, expirationTime
+		}
+	}
+	return "", nil, time.Time{}, time.Time{}
+}
+
+// store stores r as the response to a query of key with ecs e. e is
+// nil if the query has no ecs.
+func (c *dnsCache) store(key string, e *dns.EDNS0_SUBNET, r *dns.Msg) {
+	if e == nil {
+		c.tryStoreMsg(key, r)
+		return
+	}
+	if !isCacheableMsg(r) {
+		return
+	}
+	// The longest time that the entry can be kept.
+	lifetime := cachedMsgTTL(r, c.c.NegativeTTLCap) + time.Duration(c.c.LazyCacheTTL+c.c.StaleTTL)*time.Second
+	k, ok := c.ecs.add(key, e, ecsScopeOf(r), c.now().Add(lifetime))
+	if !ok {
+		c.logger.Debug("response is not cached, too many ecs subnets", zap.Stringer("ecs", e))
+		return
+	}
+	c.tryStoreMsg(k, r)
+}
+
+// cachedMsgTTL returns how long a cached response stays fresh. It is
+// the smallest ttl of all records, including the SOA of a negative
+// response, so every record still has a positive remaining ttl when the
+// response is served with the elapsed time subtracted. Responses without
+// any record use defaultEmptyAnswerTTL, but no more than negativeTTLCap
+// seconds. Zero negativeTTLCap means no limit.
+func cachedMsgTTL(r *dns.Msg, negativeTTLCap uint32) time.Duration {
+	for _, section := range [...][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				return time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second
+			}
+		}
+	}
+	if negativeTTLCap > 0 && time.Duration(negativeTTLCap)*time.Second < defaultEmptyAnswerTTL {
+		return time.Duration(negativeTTLCap) * time.Second
+	}
+	return defaultEmptyAnswerTTL
+}
+
+func (c *dnsCache) countHit(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hitCount, 1)
+	} else {
+		atomic.AddUint64(&c.missCount, 1)
+	}
+}
+
+// flushed reports whether the entry of q that was stored at storedTime
+// has been flushed.
+func (c *dnsCache) flushed(q *dns.Msg, storedTime time.Time) bool {
+	c.flushMu.RLock()
+	defer c.flushMu.RUnlock()
+	if storedTime.Before(c.flushedAt) {
+		return true
+	}
+	if len(q.Question) == 1 {
+		if t, ok := c.flushedNames[strings.ToLower(q.Question[0].Name)]; ok && storedTime.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush invalidates all entries.
+func (c *dnsCache) flush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.flushedAt = c.now()
+	c.flushedNames = nil // covered by flushedAt
+}
+
+// flushName invalidates all entries of the domain name.
+func (c *dnsCache) flushName(name string) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	if c.flushedNames == nil {
+		c.flushedNames = make(map[string]time.Time)
+	}
+	c.flushedNames[strings.ToLower(dns.Fqdn(name))] = c.now()
+}
+
+// size returns the number of entries in the cache, or -1 if the
+// backend doesn't support it.
+func (c *dnsCache) size() int {
+	if l, ok := c.backend.(interface{ Len() int }); ok {
+		return l.Len()
+	}
+	return -1
+}
+
+type cacheStats struct {
+	Size      int     `json:"size"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRatio  float64 `json:"hit_ratio"`
+	Evictions int64   `json:"evictions"` // -1 if the backend doesn't support it.
+}
+
+func (c *dnsCache) stats() cacheStats {
+	s := cacheStats{
+		Size:      c.size(),
+		Hits:      atomic.LoadUint64(&c.hitCount),
+		Misses:    atomic.LoadUint64(&c.missCount),
+		Evictions: -1,
+	}
+	if s.Hits+s.Misses > 0 {
+		s.HitRatio = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+	if m, ok := c.backend.(*memCache); ok {
+		s.Evictions = int64(m.evictions())
+	}
+	return s
+}
+
+func (c *dnsCache) logStatsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-ticker.C:
+			s := c.stats()
+			c.logger.Info("cache stats",
+				zap.Int("size", s.Size),
+				zap.Uint64("hits", s.Hits),
+				zap.Uint64("misses", s.Misses),
+				zap.Float64("hit_ratio", s.HitRatio),
+				zap.Int64("evictions", s.Evictions),
+			)
+		}
+	}
+}
+
+// Close closes the cache backend.
+func (c *dnsCache) Close() error {
+	c.closeOnce.Do(func() { close(c.closeChan) })
+	return c.backend.Close()
+}
+
+// shouldPrefetch counts a hit of the entry and reports whether
+// it is time to refresh it.
+func (c *dnsCache) shouldPrefetch(key string, remainingTTL, ttl time.Duration) bool {
+	if c.hits == nil {
+		return false
+	}
+
+	var hits uint32
+	if v, ok := c.hits.Get(key); ok {
+		hits = atomic.AddUint32(v.(*uint32), 1)
+	} else {
+		hits = 1
+		c.hits.Add(key, &hits)
+	}
+	return hits >= prefetchMinHits && remainingTTL < ttl*time.Duration(c.c.PrefetchThreshold)/100
+}
+
+// updateInBackground starts a goroutine to update the cache entry.
+// Concurrent updates of the same key will be merged. The entry is only
+// replaced by a new response from upstreams. If the update failed, it
+// is left as it is and expires as usual.
+func (c *dnsCache) updateInBackground(qCtx *handler.Context, next handler.ExecutableChainNode, key string, e *dns.EDNS0_SUBNET) {
+	// Updates of different clients' subnets are not merged.
+	sfKey := key
+	if e != nil {
+		sfKey = ecsSubnetKey(key, e, e.SourceNetmask)
+	}
+	// The copy holds the cached response that was just replied.
+	updateQCtx := qCtx.Copy()
+	updateQCtx.SetResponse(nil, handler.ContextStatusWaitingResponse)
+	updateFunc := func() (interface{}, error) {
+		c.logger.Debug("start cache update", updateQCtx.InfoField())
+		defer c.updateSF.Forget(sfKey)
+		// The deadline of the client's query may have passed already.
+		updateCtx, cancel := context.WithTimeout(context.Background(), defaultLazyUpdateTimeout)
+		defer cancel()
+
+		err := handler.ExecChainNode(updateCtx, updateQCtx, next)
+		if err != nil {
+			c.logger.Warn("failed to update cache", updateQCtx.InfoField(), zap.Error(err))
+			return nil, nil
+		}
+
+		if r := updateQCtx.R(); r != nil {
+			c.store(key, e, r)
+		}
+		c.logger.Debug("cache updated", updateQCtx.InfoField())
+		return nil, nil
+	}
+	c.updateSF.DoChan(sfKey, updateFunc) // DoChan won't block this goroutine
+}
+
+// tryStoreMsg clamps the ttl of r and stores it. Note that r is
+// modified in place, so the client will get the same ttl as the
+// stored one.
+func (c *dnsCache) tryStoreMsg(key string, r *dns.Msg) {
+	if !isCacheableMsg(r) || !setNegativeTTL(r, c.c.NegativeTTLCap) {
+		return
+	}
+	c.clampTTL(r)
+
+	v, err := r.Pack()
+	if err != nil {
+		c.logger.Warn("failed to pack msg", zap.Error(err))
+		return
+	}
+
+	now := c.now()
+	var expirationTime time.Time
+	if c.c.LazyCacheTTL > 0 {
+		expirationTime = now.Add(time.Duration(c.c.LazyCacheTTL) * time.Second)
+	} else {
+		minTTL := dnsutils.GetMinimalTTL(r)
+		if minTTL == 0 {
+			return
+		}
+		expirationTime = now.Add(time.Duration(minTTL) * time.Second)
+	}
+	if c.c.StaleTTL > 0 {
+		staleExpirationTime := now.Add(time.Duration(dnsutils.GetMinimalTTL(r)+uint32(c.c.StaleTTL)) * time.Second)
+		if staleExpirationTime.After(expirationTime) {
+			expirationTime = staleExpirationTime
+		}
+	}
+	c.backend.Store(key, v, now, expirationTime)
+	if c.hits != nil {
+		c.hits.Del(key) // new entry, reset its hit counter.
+	}
+}
+
+// isCacheableMsg reports whether r is a NOERROR or NXDOMAIN response
+// that is not truncated.
+func isCacheableMsg(r *dns.Msg) bool {
+	return (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError) && !r.Truncated
+}
+
+// setNegativeTTL sets the ttl of the SOA record of a negative (NXDOMAIN
+// or NODATA) response to the smaller one of its ttl and its MINIMUM
+// field (RFC 2308 5), but no more than cap. Zero cap means no limit.
+// The records of a NODATA response without SOA are capped at cap.
+// It reports false if r is a NXDOMAIN response without SOA, which
+// should not be cached.
+func setNegativeTTL(r *dns.Msg, cap uint32) bool {
+	if r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0 {
+		return true
+	}
+	for _, rr := range r.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if cap > 0 && cap < ttl {
+			ttl = cap
+		}
+		soa.Hdr.Ttl = ttl
+		return true
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return false
+	}
+	if cap > 0 {
+		dnsutils.ApplyMaximumTTL(r, cap)
+	}
+	return true
+}
+
+func (c *dnsCache) clampTTL(r *dns.Msg) {
+	if c.c.MaxTTL > 0 {
+		dnsutils.ApplyMaximumTTL(r, c.c.MaxTTL)
+	}
+	// Don't extend the ttl of transient records.
+	if c.c.MinTTL > 0 && dnsutils.GetMinimalTTL(r) > 0 {
+		dnsutils.ApplyMinimalTTL(r, c.c.MinTTL)
+	}
+}
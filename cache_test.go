@@ -0,0 +1,280 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, c *cacheConfig) *dnsCache {
+	t.Helper()
+	c.Size = 1024
+	c.CleanupInterval = time.Minute
+	c.ECSMaxSubnets = 16
+	dc, err := newDNSCache(c, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dc.Close() })
+	return dc
+}
+
+func Test_dnsCache_ttl(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      uint32 // ttl of the upstream response
+		elapsed  time.Duration
+		wantTTLs []uint32 // ttl of the response of each query
+	}{
+		{name: "decrease", ttl: 300, elapsed: 100 * time.Second, wantTTLs: []uint32{300, 200, 100}},
+		{name: "max ttl", ttl: 3600, elapsed: 100 * time.Second, wantTTLs: []uint32{600, 500, 400}},
+		{name: "min ttl", ttl: 10, elapsed: 20 * time.Second, wantTTLs: []uint32{60, 40, 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := newTestCache(t, &cacheConfig{MinTTL: 60, MaxTTL: 600})
+			now := time.Now()
+			dc.now = func() time.Time { return now }
+			upstream := &testResponder{ip: net.IPv4(1, 2, 3, 4), ttl: tt.ttl}
+
+			for i, want := range tt.wantTTLs {
+				qCtx := handler.NewContext(newTestQuery("example.com", dns.TypeA), nil)
+				execChain(t, qCtx, dc, upstream)
+				r := qCtx.R()
+				if r == nil || len(r.Answer) != 1 {
+					t.Fatalf("query %d: unexpected response %v", i, r)
+				}
+				if got := r.Answer[0].Header().Ttl; got != want {
+					t.Fatalf("query %d: ttl = %d, want %d", i, got, want)
+				}
+				now = now.Add(tt.elapsed)
+			}
+			if upstream.queries != 1 {
+				t.Fatalf("upstream queried %d times, want 1", upstream.queries)
+			}
+		})
+	}
+}
+
+func newNegativeResponse(rcode int, soaTTL, minTTL uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetRcode(newTestQuery("example.com", dns.TypeA), rcode)
+	r.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+		Ns:     "ns.example.com.",
+		Mbox:   "admin.example.com.",
+		Minttl: minTTL,
+	}}
+	return r
+}
+
+func Test_setNegativeTTL(t *testing.T) {
+	noSOA := new(dns.Msg)
+	noSOA.SetRcode(newTestQuery("example.com", dns.TypeA), dns.RcodeNameError)
+
+	tests := []struct {
+		name    string
+		r       *dns.Msg
+		cap     uint32
+		wantOK  bool
+		wantTTL uint32
+	}{
+		{name: "nxdomain soa minimum", r: newNegativeResponse(dns.RcodeNameError, 3600, 300), wantOK: true, wantTTL: 300},
+		{name: "nxdomain soa ttl", r: newNegativeResponse(dns.RcodeNameError, 100, 300), wantOK: true, wantTTL: 100},
+		{name: "nxdomain cap", r: newNegativeResponse(dns.RcodeNameError, 3600, 300), cap: 60, wantOK: true, wantTTL: 60},
+		{name: "nodata soa minimum", r: newNegativeResponse(dns.RcodeSuccess, 3600, 300), wantOK: true, wantTTL: 300},
+		{name: "nodata cap", r: newNegativeResponse(dns.RcodeSuccess, 3600, 300), cap: 60, wantOK: true, wantTTL: 60},
+		{name: "nxdomain without soa", r: noSOA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := setNegativeTTL(tt.r, tt.cap); ok != tt.wantOK {
+				t.Fatalf("setNegativeTTL() = %v, want %v", ok, tt.wantOK)
+			}
+			if tt.wantOK {
+				if got := tt.r.Ns[0].Header().Ttl; got != tt.wantTTL {
+					t.Fatalf("soa ttl = %d, want %d", got, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+// negativeResponder is a handler.Executable that replies r.
+type negativeResponder struct {
+	r       *dns.Msg
+	queries int
+}
+
+func (n *negativeResponder) Exec(_ context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	n.queries++
+	r := n.r.Copy()
+	r.Id = qCtx.Q().Id
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	return nil
+}
+
+func Test_dnsCache_negative(t *testing.T) {
+	tests := []struct {
+		name    string
+		rcode   int
+		cap     uint32
+		wantTTL uint32
+	}{
+		{name: "nxdomain", rcode: dns.RcodeNameError, wantTTL: 300},
+		{name: "nxdomain cap", rcode: dns.RcodeNameError, cap: 60, wantTTL: 60},
+		{name: "nodata", rcode: dns.RcodeSuccess, wantTTL: 300},
+		{name: "nodata cap", rcode: dns.RcodeSuccess, cap: 60, wantTTL: 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := newTestCache(t, &cacheConfig{NegativeTTLCap: tt.cap})
+			now := time.Now()
+			dc.now = func() time.Time { return now }
+			upstream := &negativeResponder{r: newNegativeResponse(tt.rcode, 3600, 300)}
+
+			for i := 0; i < 2; i++ {
+				qCtx := handler.NewContext(newTestQuery("example.com", dns.TypeA), nil)
+				execChain(t, qCtx, dc, upstream)
+				r := qCtx.R()
+				if r == nil || r.Rcode != tt.rcode || len(r.Ns) != 1 {
+					t.Fatalf("query %d: unexpected response %v", i, r)
+				}
+				if got := r.Ns[0].Header().Ttl; got != tt.wantTTL {
+					t.Fatalf("query %d: soa ttl = %d, want %d", i, got, tt.wantTTL)
+				}
+			}
+			if upstream.queries != 1 {
+				t.Fatalf("upstream queried %d times, want 1", upstream.queries)
+			}
+
+			// expired after the negative ttl.
+			now = now.Add(time.Duration(tt.wantTTL) * time.Second)
+			qCtx := handler.NewContext(newTestQuery("example.com", dns.TypeA), nil)
+			execChain(t, qCtx, dc, upstream)
+			if upstream.queries != 2 {
+				t.Fatalf("upstream queried %d times after the ttl, want 2", upstream.queries)
+			}
+		})
+	}
+}
+
+func Test_dnsCache_nodataWithoutSOA(t *testing.T) {
+	// Responses without any record are only stored with lazy cache.
+	dc := newTestCache(t, &cacheConfig{NegativeTTLCap: 60, LazyCacheTTL: 3600, LazyCacheReplyTTL: 5})
+	storedAt := time.Now()
+	now := storedAt
+	dc.now = func() time.Time { return now }
+	q := newTestQuery("example.com", dns.TypeA)
+	nodata := new(dns.Msg)
+	nodata.SetReply(q)
+	execChain(t, handler.NewContext(q.Copy(), nil), dc, &negativeResponder{r: nodata})
+
+	// The entry is fresh for NegativeTTLCap seconds, then it is served
+	// as a lazy cache reply.
+	for _, tt := range []struct {
+		elapsed  time.Duration
+		wantLazy bool
+	}{{59 * time.Second, false}, {60 * time.Second, true}} {
+		now = storedAt.Add(tt.elapsed)
+		ctx, qi := withQueryInfo(context.Background())
+		err := handler.ExecChainNode(ctx, handler.NewContext(q.Copy(), nil), linkChain(dc, &failingResponder{calls: make(chan struct{}, 1)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lazy := len(qi.getEDEs()) > 0; lazy != tt.wantLazy {
+			t.Fatalf("after %s: lazy reply = %v, want %v", tt.elapsed, lazy, tt.wantLazy)
+		}
+	}
+}
+
+// failingResponder is a handler.Executable that acts as an upstream
+// that is down. Every call is sent to calls.
+type failingResponder struct {
+	calls chan struct{}
+}
+
+func (f *failingResponder) Exec(_ context.Context, _ *handler.Context, _ handler.ExecutableChainNode) error {
+	f.calls <- struct{}{}
+	return errors.New("upstream is down")
+}
+
+// waitUpdate waits for n calls to f and the cache update of q to finish.
+func waitUpdate(t *testing.T, dc *dnsCache, q *dns.Msg, f *failingResponder, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-f.calls:
+		case <-time.After(time.Second):
+			t.Fatal("upstream is not queried")
+		}
+	}
+	key, err := utils.GetMsgKey(q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Do joins the update in flight, if any.
+	dc.updateSF.Do(key, func() (interface{}, error) { return nil, nil })
+}
+
+func Test_dnsCache_failedUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		c         cacheConfig
+		fgQueries int    // queries sent to the failing upstream by the client query
+		wantTTL   uint32 // ttl of the reply while upstream is down
+	}{
+		{name: "lazy", c: cacheConfig{LazyCacheTTL: 3600, LazyCacheReplyTTL: 5}, wantTTL: 5},
+		{name: "stale", c: cacheConfig{StaleTTL: 3600}, fgQueries: 1, wantTTL: staleReplyTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := newTestCache(t, &tt.c)
+			now := time.Now()
+			dc.now = func() time.Time { return now }
+			q := newTestQuery("example.com", dns.TypeA)
+			execChain(t, handler.NewContext(q.Copy(), nil), dc, &testResponder{ip: net.IPv4(1, 2, 3, 4), ttl: 60})
+
+			// The entry expired and upstream is down. Every reply must
+			// still be a stale one, a failed update must not refresh it.
+			now = now.Add(120 * time.Second)
+			down := &failingResponder{calls: make(chan struct{}, 4)}
+			for i := 0; i < 3; i++ {
+				qCtx := handler.NewContext(q.Copy(), nil)
+				execChain(t, qCtx, dc, down)
+				waitUpdate(t, dc, q, down, tt.fgQueries+1)
+				r := qCtx.R()
+				if r == nil || len(r.Answer) != 1 {
+					t.Fatalf("query %d: unexpected response %v", i, r)
+				}
+				if got := r.Answer[0].Header().Ttl; got != tt.wantTTL {
+					t.Fatalf("query %d: ttl = %d, want %d", i, got, tt.wantTTL)
+				}
+				now = now.Add(time.Second)
+			}
+		})
+	}
+}
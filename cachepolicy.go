@@ -0,0 +1,185 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"math/rand"
+)
+
+// evictionPolicy chooses which entry of a full cache shard will be
+// evicted. It is not safe for concurrent use.
+type evictionPolicy interface {
+	add(key string)
+	touch(key string) // key was read or updated
+	remove(key string)
+	victim() string // must not be called if there are no keys
+}
+
+// evictionPolicyOf returns the constructor of the policy.
+func evictionPolicyOf(name string) (func() evictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return func() evictionPolicy { return newLRUPolicy() }, nil
+	case "lfu":
+		return func() evictionPolicy { return newLFUPolicy() }, nil
+	case "random":
+		return func() evictionPolicy { return newRandomPolicy() }, nil
+	default:
+		return nil, fmt.Errorf("invalid cache policy %s", name)
+	}
+}
+
+// lruPolicy evicts the least recently used key.
+type lruPolicy struct {
+	l *list.List // front is the least recently used
+	m map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{l: list.New(), m: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) add(key string) {
+	p.m[key] = p.l.PushBack(key)
+}
+
+func (p *lruPolicy) touch(key string) {
+	if e, ok := p.m[key]; ok {
+		p.l.MoveToBack(e)
+	}
+}
+
+func (p *lruPolicy) remove(key string) {
+	if e, ok := p.m[key]; ok {
+		p.l.Remove(e)
+		delete(p.m, key)
+	}
+}
+
+func (p *lruPolicy) victim() string {
+	return p.l.Front().Value.(string)
+}
+
+// lfuPolicy evicts the least frequently used key. Keys that were used
+// equally often are evicted from the least recently used one.
+type lfuPolicy struct {
+	h   lfuHeap
+	m   map[string]*lfuItem
+	seq uint64
+}
+
+type lfuItem struct {
+	key   string
+	hits  uint64
+	seq   uint64 // last used
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].seq < h[j].seq
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{m: make(map[string]*lfuItem)}
+}
+
+func (p *lfuPolicy) add(key string) {
+	p.seq++
+	item := &lfuItem{key: key, seq: p.seq}
+	p.m[key] = item
+	heap.Push(&p.h, item)
+}
+
+func (p *lfuPolicy) touch(key string) {
+	if item, ok := p.m[key]; ok {
+		p.seq++
+		item.hits++
+		item.seq = p.seq
+		heap.Fix(&p.h, item.index)
+	}
+}
+
+func (p *lfuPolicy) remove(key string) {
+	if item, ok := p.m[key]; ok {
+		heap.Remove(&p.h, item.index)
+		delete(p.m, key)
+	}
+}
+
+func (p *lfuPolicy) victim() string {
+	return p.h[0].key
+}
+
+// randomPolicy evicts a random key.
+type randomPolicy struct {
+	keys []string
+	m    map[string]int // index in keys
+}
+
+func newRandomPolicy() *randomPolicy {
+	return &randomPolicy{m: make(map[string]int)}
+}
+
+func (p *randomPolicy) add(key string) {
+	p.m[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy) touch(string) {}
+
+func (p *randomPolicy) remove(key string) {
+	i, ok := p.m[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.m[p.keys[i]] = i
+	p.keys = p.keys[:last]
+	delete(p.m, key)
+}
+
+func (p *randomPolicy) victim() string {
+	return p.keys[rand.Intn(len(p.keys))]
+}
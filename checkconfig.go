@@ -0,0 +1,415 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/go-redis/redis/v8"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// checkServerOpt validates the options of the servers, so bad options
+// fail the startup before anything is listening.
+func checkServerOpt() error {
+	if len(opt.ServerAddr) == 0 && len(opt.UnixSocket) == 0 {
+		return errors.New("missing server address")
+	}
+	if opt.NoCompression && opt.ForceCompression {
+		return errors.New("no-compression can not be used with force-compression")
+	}
+	if opt.TCPMaxConcurrent <= 0 {
+		return fmt.Errorf("invalid tcp max concurrent %d", opt.TCPMaxConcurrent)
+	}
+	if opt.WarmupConcurrent <= 0 {
+		return fmt.Errorf("invalid warm-up concurrency %d", opt.WarmupConcurrent)
+	}
+	if opt.RTTReportInterval < 0 {
+		return fmt.Errorf("invalid rtt report interval %d", opt.RTTReportInterval)
+	}
+	hasCert := len(opt.TLSCert) > 0 || len(opt.TLSKey) > 0
+	if hasCert {
+		if _, err := tls.LoadX509KeyPair(opt.TLSCert, opt.TLSKey); err != nil {
+			return fmt.Errorf("failed to load tls certificate, %w", err)
+		}
+	}
+	if len(opt.DoTServerAddr) > 0 && !hasCert {
+		return errors.New("dot server requires a tls certificate, use --tls-cert and --tls-key to set it")
+	}
+	if opt.DoHH3 && (len(opt.DoHServerAddr) == 0 || !hasCert) {
+		return errors.New("--doh-h3 requires a doh server with a tls certificate")
+	}
+	return nil
+}
+
+// checkEntryOpt validates the options of the entry that can be checked
+// without building anything, so initEntry fails before it opens files
+// or loads lists. rules is nil if there is no rules file.
+func checkEntryOpt(rules *ruleSet) error {
+	if err := checkMsgSizeLimit(opt.MaxQuerySize); err != nil {
+		return fmt.Errorf("invalid max query size, %w", err)
+	}
+	if opt.RRRotate && opt.SortByLatency {
+		return errors.New("rr-rotate conflicts with sort-answers-by-latency")
+	}
+	if opt.SortByLatency {
+		if opt.LatencyProbePort <= 0 || opt.LatencyProbePort > 65535 {
+			return fmt.Errorf("invalid latency probe port %d", opt.LatencyProbePort)
+		}
+		if opt.SortAnswersKeep < 0 {
+			return fmt.Errorf("invalid sort answers keep %d", opt.SortAnswersKeep)
+		}
+	}
+	if opt.NoIPv6 && len(opt.Prefer) > 0 {
+		return errors.New("prefer can not be used with no-ipv6")
+	}
+	if opt.NoIPv6 && len(opt.DNS64Prefix) > 0 {
+		return errors.New("dns64 can not be used with no-ipv6")
+	}
+	if len(opt.FakeIPRange) > 0 {
+		if len(opt.Upstream) > 0 || len(opt.RemoteUpstream) == 0 {
+			return errors.New("fake ip requires local and remote upstream")
+		}
+		if len(opt.RemoteDomain) == 0 && !rules.hasDomains(ruleRemote) {
+			return errors.New("fake ip requires remote domain")
+		}
+	} else if len(opt.FakeIPFile) > 0 {
+		return errors.New("fake ip file requires fake ip range")
+	}
+	if !opt.LocalPTR && len(opt.LocalPTRName) > 0 {
+		return errors.New("local ptr name requires local ptr")
+	}
+	if (len(opt.ForceLocalClient) > 0 || len(opt.ForceRemoteClient) > 0) && len(opt.Upstream) > 0 {
+		return errors.New("force client requires local and remote upstream")
+	}
+	if opt.ECSFromClient {
+		if len(opt.RemoteECS) > 0 {
+			return errors.New("ecs from client conflicts with remote ecs")
+		}
+		if opt.ECSClientMask4 <= 0 || opt.ECSClientMask4 > 32 {
+			return fmt.Errorf("invalid ecs client ipv4 mask %d", opt.ECSClientMask4)
+		}
+		if opt.ECSClientMask6 <= 0 || opt.ECSClientMask6 > 128 {
+			return fmt.Errorf("invalid ecs client ipv6 mask %d", opt.ECSClientMask6)
+		}
+	}
+	if opt.CacheSize > 0 || len(opt.RedisCache) > 0 {
+		if opt.CacheCleanup <= 0 {
+			return fmt.Errorf("invalid cache cleanup interval %d", opt.CacheCleanup)
+		}
+		if opt.CacheECSSubnets <= 0 {
+			return fmt.Errorf("invalid cache ecs max subnets %d", opt.CacheECSSubnets)
+		}
+	}
+	if opt.CoalesceWindow < 0 {
+		return fmt.Errorf("invalid coalesce window %d", opt.CoalesceWindow)
+	}
+	if opt.UDPSize < dns.MinMsgSize || opt.UDPSize > maxUDPSize {
+		return fmt.Errorf("invalid udp size %d, must be in [%d, %d]", opt.UDPSize, dns.MinMsgSize, maxUDPSize)
+	}
+	if opt.UpstreamRetries < 0 {
+		return fmt.Errorf("invalid upstream retries %d", opt.UpstreamRetries)
+	}
+	if opt.UpstreamRetryBackoff < 0 {
+		return fmt.Errorf("invalid upstream retry backoff %d", opt.UpstreamRetryBackoff)
+	}
+	if opt.MaxCNAMEDepth <= 0 {
+		return fmt.Errorf("invalid max cname depth %d", opt.MaxCNAMEDepth)
+	}
+
+	if len(opt.Upstream) > 0 {
+		if opt.IPv6RemoteOnly || len(opt.LocalQType) > 0 || len(opt.RemoteQType) > 0 {
+			return errors.New("qtype routing requires local and remote upstream")
+		}
+		if len(opt.ScheduleRule) > 0 {
+			return errors.New("schedule rules require local and remote upstream")
+		}
+		if opt.RemoteOnNXDomain {
+			return errors.New("retry remote on nxdomain requires local and remote upstream")
+		}
+		return nil
+	}
+	if len(opt.LocalUpstream) == 0 {
+		return errors.New("missing local upstream")
+	}
+	if len(opt.RemoteUpstream) == 0 {
+		return errors.New("missing remote upstream")
+	}
+	if len(opt.LocalIP) == 0 && !rules.hasIPs(ruleLocal) && len(opt.GeoIPDB) == 0 {
+		if len(opt.LocalCountry) > 0 {
+			return errors.New("local country requires geoip database")
+		}
+		if opt.TrustLocalIPOnly || len(opt.VerifyLocalIP) > 0 || len(opt.LocalIPMatch) > 0 || len(opt.LocalNoIP) > 0 {
+			return errors.New("local ip verification requires local ip")
+		}
+	}
+	if opt.DispatchMode == "adaptive" && opt.AdaptiveTTL <= 0 {
+		return fmt.Errorf("invalid adaptive ttl %d", opt.AdaptiveTTL)
+	}
+	return nil
+}
+
+// checkConfig validates all options without starting servers, sending
+// queries, creating files or downloading lists. It prints every problem
+// found and returns the number of them.
+//
+// Upstreams and list files are checked one by one, so all of them are
+// reported. The entry is not built, the rest of the options are parsed
+// as initEntry does.
+func checkConfig() int {
+	var problems []string
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	noDownload = true
+
+	if err := checkServerOpt(); err != nil {
+		report("server: %v", err)
+	}
+
+	upstreams := map[string][]string{
+		"upstream":        opt.Upstream,
+		"local-upstream":  opt.LocalUpstream,
+		"remote-upstream": opt.RemoteUpstream,
+	}
+	for _, s := range opt.Group {
+		if _, u, ok := strings.Cut(s, "="); ok {
+			upstreams["group"] = append(upstreams["group"], u)
+		}
+	}
+	for _, s := range opt.DomainUpstream {
+		if _, u, ok := strings.Cut(s, "="); ok {
+			upstreams["domain-upstream"] = append(upstreams["domain-upstream"], u)
+		}
+	}
+	for _, flag := range [...]string{"upstream", "local-upstream", "remote-upstream", "group", "domain-upstream"} {
+		for _, s := range upstreams[flag] {
+			if err := checkUpstream(s); err != nil {
+				report("--%s %s: %v", flag, s, err)
+			}
+		}
+	}
+
+	var groupDomains []string
+	for _, s := range opt.GroupDomain {
+		if _, f, ok := strings.Cut(s, "="); ok {
+			groupDomains = append(groupDomains, f)
+		}
+	}
+	var scheduleDomains []string
+	for _, s := range opt.ScheduleRule {
+		r, err := parseScheduleRule(s)
+		if err != nil {
+			report("--schedule-rule: %v", err)
+			continue
+		}
+		scheduleDomains = append(scheduleDomains, r.domains...)
+	}
+	for _, fl := range [...]struct {
+		flag  string
+		files []string
+	}{
+		{"blacklist-domain", opt.BlacklistDomain},
+		{"block-domain", opt.BlockDomain},
+		{"local-domain", opt.LocalDomain},
+		{"remote-domain", opt.RemoteDomain},
+		{"group-domain", groupDomains},
+		{"schedule-rule", scheduleDomains},
+		{"no-cache-domain", opt.NoCacheDomain},
+	} {
+		for _, f := range fl.files {
+			if _, err := loadDomainMatcher([]string{f}); err != nil {
+				report("--%s %s: %v", fl.flag, f, err)
+			}
+		}
+	}
+	for _, fl := range [...]struct {
+		flag  string
+		files []string
+	}{{"local-ip", opt.LocalIP}, {"bogus-ip", opt.BogusIP}} {
+		for _, f := range fl.files {
+			if _, err := newIPList([]string{f}); err != nil {
+				report("--%s %s: %v", fl.flag, f, err)
+			}
+		}
+	}
+	if len(opt.GeoIPDB) > 0 {
+		if _, err := newGeoIPDB(opt.GeoIPDB, localCountries()); err != nil {
+			report("--geoip-db %s: %v", opt.GeoIPDB, err)
+		}
+	}
+	for _, f := range opt.WarmupDomain {
+		if _, err := loadWarmupDomains([]string{f}); err != nil {
+			report("--warmup-domain %s: %v", f, err)
+		}
+	}
+	for _, f := range opt.Hosts {
+		if _, err := loadHosts([]string{f}); err != nil {
+			report("--hosts %s: %v", f, err)
+		}
+	}
+	var rules *ruleSet
+	if len(opt.Rules) > 0 {
+		rs, err := loadRules(opt.Rules)
+		if err != nil {
+			report("--rules %s: %v", opt.Rules, err)
+		}
+		rules = rs
+	}
+
+	if err := checkStdinList(); err != nil {
+		report("%v", err)
+	}
+	if err := checkEntryOpt(rules); err != nil {
+		report("%v", err)
+	}
+	for _, err := range checkEntryArgs(rules) {
+		report("%v", err)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) == 0 {
+		fmt.Println("configuration is ok")
+	} else {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+	}
+	return len(problems)
+}
+
+// checkEntryArgs parses the args of the entry as initEntry does, without
+// building anything. It returns all errors.
+func checkEntryArgs(rules *ruleSet) []error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, fl := range [...]struct {
+		flag    string
+		clients []string
+	}{
+		{"allow-client", opt.AllowClient},
+		{"force-local-client", opt.ForceLocalClient},
+		{"force-remote-client", opt.ForceRemoteClient},
+	} {
+		if len(fl.clients) > 0 {
+			if err := netlist.BatchLoad(netlist.NewList(), fl.clients); err != nil {
+				check(fmt.Errorf("failed to load %s, %w", fl.flag, err))
+			}
+		}
+	}
+	_, err := newAnyQuery(opt.AnyMode, zap.NewNop())
+	check(err)
+	_, _, err = parseBlockMode(opt)
+	check(err)
+	if len(opt.Prefer) > 0 {
+		_, err := newPreferFamily(opt.Prefer, zap.NewNop())
+		check(err)
+	}
+	if len(opt.DNS64Prefix) > 0 {
+		if _, err := newDNS64(opt.DNS64Prefix, zap.NewNop()); err != nil {
+			check(fmt.Errorf("invalid dns64 prefix, %w", err))
+		}
+	}
+	if len(opt.FakeIPRange) > 0 {
+		_, err := newFakeIPPool(opt.FakeIPRange)
+		check(err)
+	}
+	if opt.LocalPTR {
+		_, err := newLocalPTR(opt.LocalPTRName, opt.HostsTTL)
+		check(err)
+	}
+	if len(opt.RedisCache) > 0 {
+		if _, err := redis.ParseURL(opt.RedisCache); err != nil {
+			check(fmt.Errorf("invalid redis url, %w", err))
+		}
+	} else if opt.CacheSize > 0 {
+		_, _, err := memCacheShardSize(opt.CacheSize, opt.CacheShards)
+		check(err)
+		_, err = evictionPolicyOf(opt.CachePolicy)
+		check(err)
+	}
+	if len(opt.Rewrite) > 0 || len(opt.RewriteCNAME) > 0 {
+		_, err := newRewriter(opt.Rewrite, opt.RewriteCNAME, zap.NewNop())
+		check(err)
+	}
+	if len(opt.TTLOverride) > 0 {
+		_, err := parseTTLOverride(opt.TTLOverride)
+		check(err)
+	}
+	_, err = parseGroups(opt.Group, opt.GroupDomain)
+	check(err)
+	_, err = parseDomainPins(opt.DomainUpstream)
+	check(err)
+	if len(opt.Upstream) > 0 {
+		return errs
+	}
+
+	if len(opt.RemoteECS) > 0 {
+		if _, err := parseECS(opt.RemoteECS); err != nil {
+			check(fmt.Errorf("invalid remote ecs, %w", err))
+		}
+	}
+	for _, types := range [...][]string{opt.LocalQType, opt.RemoteQType} {
+		_, err := parseQTypes(types)
+		check(err)
+	}
+	hasLocalIP := len(opt.LocalIP) > 0 || rules.hasIPs(ruleLocal) || len(opt.GeoIPDB) > 0
+	if hasLocalIP {
+		_, err := localIPVerifyMode(opt)
+		check(err)
+	}
+	hasLocalDomain := len(opt.LocalDomain) > 0 || rules.hasDomains(ruleLocal)
+	hasRemoteDomain := len(opt.RemoteDomain) > 0 || rules.hasDomains(ruleRemote)
+	defaultRoute, err := defaultRouteOf(opt.DefaultRoute, hasLocalIP, hasLocalDomain, hasRemoteDomain)
+	if err != nil {
+		return append(errs, err)
+	}
+	switch {
+	case opt.DispatchMode == "adaptive":
+		if !hasLocalIP || defaultRoute == "remote" {
+			check(errors.New("adaptive dispatch mode requires local ip and local default route"))
+		}
+	case hasLocalIP && defaultRoute == "local":
+		check(setDispatchMode(new(executable_seq.FallbackConfig), opt))
+	}
+	return errs
+}
+
+// checkUpstream parses s and builds its upstream without connecting
+// to it.
+func checkUpstream(s string) error {
+	uc, err := parseUpstream(s)
+	if err != nil {
+		return err
+	}
+	f, err := newForwarder("check", []*upstreamConfig{uc}, opt.CA, false, zap.NewNop())
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,91 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+var (
+	errCNAMELoop    = errors.New("response contains a cname loop")
+	errCNAMETooLong = errors.New("response contains a cname chain that is too long")
+)
+
+// cnameCheckUpstream discards responses whose CNAME chain starting from
+// the query name loops or is longer than maxDepth, so they are never
+// used for ip based routing. If all upstreams return such responses,
+// the client gets a SERVFAIL.
+type cnameCheckUpstream struct {
+	bundled_upstream.Upstream
+	maxDepth int
+	logger   *zap.Logger
+}
+
+func (u *cnameCheckUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, err := u.Upstream.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(q.Question) != 1 {
+		return r, nil
+	}
+	if name, err := checkCNAMEChain(q.Question[0].Name, r.Answer, u.maxDepth); err != nil {
+		u.logger.Warn("invalid cname chain", zap.String("from", u.Address()), zap.String("qname", q.Question[0].Name), zap.String("name", name), zap.Error(err))
+		return nil, err
+	}
+	return r, nil
+}
+
+// checkCNAMEChain follows the CNAME records in rrs from name. If the
+// chain loops or has more than maxDepth records, it returns the name
+// where the chain is cut and the reason.
+func checkCNAMEChain(name string, rrs []dns.RR, maxDepth int) (string, error) {
+	var targets map[string]string
+	for _, rr := range rrs {
+		if c, ok := rr.(*dns.CNAME); ok {
+			if targets == nil {
+				targets = make(map[string]string)
+			}
+			targets[dns.CanonicalName(c.Hdr.Name)] = dns.CanonicalName(c.Target)
+		}
+	}
+	if targets == nil {
+		return "", nil
+	}
+
+	name = dns.CanonicalName(name)
+	seen := map[string]struct{}{name: {}}
+	for depth := 0; ; depth++ {
+		target, ok := targets[name]
+		if !ok {
+			return "", nil
+		}
+		if _, dup := seen[target]; dup {
+			return target, errCNAMELoop
+		}
+		if depth >= maxDepth {
+			return name, errCNAMETooLong
+		}
+		seen[target] = struct{}{}
+		name = target
+	}
+}
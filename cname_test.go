@@ -0,0 +1,87 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func newCNAME(name, target string) dns.RR {
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: target,
+	}
+}
+
+func Test_checkCNAMEChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		rrs      []dns.RR
+		wantName string
+		wantErr  error
+	}{
+		{name: "no cname"},
+		{name: "chain", rrs: []dns.RR{newCNAME("a.", "b."), newCNAME("b.", "c.")}},
+		{name: "self loop", rrs: []dns.RR{newCNAME("a.", "a.")}, wantName: "a.", wantErr: errCNAMELoop},
+		{name: "loop", rrs: []dns.RR{newCNAME("a.", "b."), newCNAME("b.", "c."), newCNAME("c.", "b.")}, wantName: "b.", wantErr: errCNAMELoop},
+		{name: "loop in other case", rrs: []dns.RR{newCNAME("a.", "B."), newCNAME("b.", "A.")}, wantName: "a.", wantErr: errCNAMELoop},
+		{name: "too long", rrs: []dns.RR{newCNAME("a.", "b."), newCNAME("b.", "c."), newCNAME("c.", "d.")}, wantName: "c.", wantErr: errCNAMETooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := checkCNAMEChain("a.", tt.rrs, 2)
+			if name != tt.wantName || err != tt.wantErr {
+				t.Fatalf("checkCNAMEChain() = %q, %v, want %q, %v", name, err, tt.wantName, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_cnameCheckUpstream_loop(t *testing.T) {
+	u := &testUpstream{addr: "loop", f: func(q *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = []dns.RR{newCNAME("example.com.", "a.example.com."), newCNAME("a.example.com.", "example.com.")}
+		return r, nil
+	}}
+	f := &forwarder{
+		name:   "test",
+		logger: zap.NewNop(),
+		us:     []*observedUpstream{newObservedUpstream(&cnameCheckUpstream{Upstream: u, maxDepth: 16, logger: zap.NewNop()}, 0)},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	qCtx := handler.NewContext(newTestQuery("example.com", dns.TypeA), nil)
+	err := f.Exec(ctx, qCtx, nil)
+	if ctx.Err() != nil {
+		t.Fatal("exchange did not terminate")
+	}
+	if !errors.Is(err, errCNAMELoop) {
+		t.Fatalf("Exec() error = %v, want %v", err, errCNAMELoop)
+	}
+	if qCtx.Status() != handler.ContextStatusServerFailed || qCtx.R() != nil {
+		t.Fatalf("status = %s, want %s without a response", qCtx.Status(), handler.ContextStatusServerFailed)
+	}
+}
@@ -0,0 +1,125 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// compressionHandler forces or disables the name compression of
+// responses. Without it, responses are only compressed if they don't
+// fit in the udp payload size of the client.
+type compressionHandler struct {
+	dns_handler.Handler
+	compress bool
+}
+
+func (h *compressionHandler) ServeDNS(ctx context.Context, req *dns.Msg, w dns_handler.ResponseWriter, meta *handler.RequestMeta) error {
+	cw := &compressionWriter{ResponseWriter: w, compress: h.compress}
+	if meta.FromUDP {
+		cw.udpSize = udpSizeOf(req)
+	}
+	return h.Handler.ServeDNS(ctx, req, cw, meta)
+}
+
+type compressionWriter struct {
+	dns_handler.ResponseWriter
+	compress bool
+	udpSize  int // zero if the request is not from udp
+}
+
+// Write sets the compression flag of m. Udp servers call m.Truncate,
+// which compresses m if it is too large. So uncompressed responses are
+// truncated here first. Compressed udp responses are handled by
+// compressedPacketConn.
+func (w *compressionWriter) Write(m *dns.Msg) error {
+	if w.udpSize > 0 && !w.compress {
+		truncateUncompressed(m, w.udpSize)
+	}
+	m.Compress = w.compress
+	return w.ResponseWriter.Write(m)
+}
+
+// udpSizeOf returns the udp payload size that the client of q accepts.
+func udpSizeOf(q *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := q.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+// truncateUncompressed removes records from the end of m until its
+// uncompressed length fits in size. The TC bit is set if any answer or
+// authority record is removed.
+func truncateUncompressed(m *dns.Msg, size int) {
+	m.Compress = false
+	for m.Len() > size {
+		switch {
+		case removeLastNonOPT(&m.Extra):
+		case len(m.Ns) > 0:
+			m.Ns = m.Ns[:len(m.Ns)-1]
+			m.Truncated = true
+		case len(m.Answer) > 0:
+			m.Answer = m.Answer[:len(m.Answer)-1]
+			m.Truncated = true
+		default:
+			return
+		}
+	}
+}
+
+// removeLastNonOPT removes the last record that is not an OPT record
+// from rrs. It reports whether a record is removed.
+func removeLastNonOPT(rrs *[]dns.RR) bool {
+	s := *rrs
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i].Header().Rrtype != dns.TypeOPT {
+			*rrs = append(s[:i], s[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// compressedPacketConn compresses the dns messages written to it.
+// Udp servers only compress a response if it is too large, so this
+// is the only way to force compression for udp.
+type compressedPacketConn struct {
+	net.PacketConn
+}
+
+func (c *compressedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil { // not likely, send it as is.
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	m.Compress = true
+	cb, err := m.Pack()
+	if err != nil {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	if _, err := c.PacketConn.WriteTo(cb, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
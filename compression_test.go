@@ -0,0 +1,144 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+type testPacketConn struct {
+	net.PacketConn
+	b []byte
+}
+
+func (c *testPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.b = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+type testResponseWriter struct {
+	m *dns.Msg
+}
+
+func (w *testResponseWriter) Write(m *dns.Msg) error {
+	w.m = m
+	return nil
+}
+
+// newTestResponse returns a response of n A records with the same
+// name, which compresses well.
+func newTestResponse(n int) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("a-long-domain-name.example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	for i := 0; i < n; i++ {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(1, 2, 3, byte(i)),
+		})
+	}
+	return r
+}
+
+func Test_compressedPacketConn(t *testing.T) {
+	r := newTestResponse(10)
+	b, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testPacketConn{}
+	n, err := (&compressedPacketConn{PacketConn: c}).WriteTo(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) {
+		t.Fatalf("WriteTo returned %d, want %d", n, len(b))
+	}
+
+	r.Compress = true
+	if want := r.Len(); len(c.b) != want {
+		t.Fatalf("compressed length is %d, want %d", len(c.b), want)
+	}
+	if len(c.b) >= len(b) {
+		t.Fatalf("compressed length %d is not less than uncompressed length %d", len(c.b), len(b))
+	}
+
+	got := new(dns.Msg)
+	if err := got.Unpack(c.b); err != nil {
+		t.Fatal(err)
+	}
+	got.Compress = true
+	if got.String() != r.String() {
+		t.Fatalf("round trip result:\n%s\nwant:\n%s", got, r)
+	}
+}
+
+func Test_compressionWriter(t *testing.T) {
+	tests := []struct {
+		name          string
+		compress      bool
+		udpSize       int
+		answers       int
+		wantAnswers   int
+		wantTruncated bool
+	}{
+		{name: "compress", compress: true, udpSize: 512, answers: 30, wantAnswers: 30},
+		{name: "no compression tcp", udpSize: 0, answers: 30, wantAnswers: 30},
+		{name: "no compression fits", udpSize: 512, answers: 5, wantAnswers: 5},
+		// header 12 + question 36 + 46 bytes per uncompressed answer.
+		{name: "no compression truncated", udpSize: 512, answers: 30, wantAnswers: 10, wantTruncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &testResponseWriter{}
+			w := &compressionWriter{ResponseWriter: rw, compress: tt.compress, udpSize: tt.udpSize}
+			if err := w.Write(newTestResponse(tt.answers)); err != nil {
+				t.Fatal(err)
+			}
+			m := rw.m
+			if m.Compress != tt.compress {
+				t.Fatalf("Compress = %v, want %v", m.Compress, tt.compress)
+			}
+			if len(m.Answer) != tt.wantAnswers || m.Truncated != tt.wantTruncated {
+				t.Fatalf("got %d answers, truncated %v, want %d, %v", len(m.Answer), m.Truncated, tt.wantAnswers, tt.wantTruncated)
+			}
+
+			b, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != m.Len() {
+				t.Fatalf("packed length is %d, want %d", len(b), m.Len())
+			}
+			if tt.udpSize > 0 && !tt.compress && len(b) > tt.udpSize {
+				t.Fatalf("packed length %d exceeds udp size %d", len(b), tt.udpSize)
+			}
+			got := new(dns.Msg)
+			if err := got.Unpack(b); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Answer) != tt.wantAnswers || got.Truncated != tt.wantTruncated {
+				t.Fatalf("round trip got %d answers, truncated %v", len(got.Answer), got.Truncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"sync"
+)
+
+const (
+	clientCookieLen    = 8
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+)
+
+var (
+	errCookieMismatch = errors.New("client cookie mismatch, possibly a spoofed response")
+	errBadCookie      = errors.New("upstream returned BADCOOKIE")
+)
+
+// cookieUpstream sends DNS Cookies (RFC 7873) to a plaintext upstream.
+// The client cookie is random and fixed for the upstream. The server
+// cookie is learned from responses and sent with later queries.
+// Responses that don't echo the client cookie are discarded. A
+// BADCOOKIE response is retried once with the new server cookie.
+// Cookies from the client are not forwarded, and cookies in responses
+// are not sent to the client.
+type cookieUpstream struct {
+	bundled_upstream.Upstream
+	logger *zap.Logger
+
+	client [clientCookieLen]byte
+
+	mu     sync.Mutex
+	server []byte // nil if unknown
+}
+
+func newCookieUpstream(u bundled_upstream.Upstream, logger *zap.Logger) *cookieUpstream {
+	c := &cookieUpstream{Upstream: u, logger: logger}
+	rand.Read(c.client[:])
+	return c
+}
+
+func (u *cookieUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	clientOpt := q.IsEdns0()
+	r, err := u.exchange(ctx, q)
+	if err == nil && r.Rcode == dns.RcodeBadCookie {
+		u.logger.Debug("upstream returned BADCOOKIE, retrying", zap.String("upstream", u.Address()))
+		r, err = u.exchange(ctx, q)
+		if err == nil && r.Rcode == dns.RcodeBadCookie {
+			err = errBadCookie
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if clientOpt == nil {
+		dnsutils.RemoveEDNS0(r)
+	} else if opt := r.IsEdns0(); opt != nil {
+		dnsutils.RemoveEDNS0Option(opt, dns.EDNS0COOKIE)
+	}
+	return r, nil
+}
+
+// exchange sends q with the current cookies and learns the server
+// cookie from the response.
+func (u *cookieUpstream) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	qCopy := q.Copy()
+	opt := qCopy.IsEdns0()
+	if opt == nil {
+		opt = dnsutils.UpgradeEDNS0(qCopy)
+	}
+	dnsutils.RemoveEDNS0Option(opt, dns.EDNS0COOKIE)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: u.cookie()})
+
+	r, err := u.Upstream.Exchange(ctx, qCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	ropt := r.IsEdns0()
+	if ropt == nil {
+		return r, nil
+	}
+	rc, ok := dnsutils.GetEDNS0Option(ropt, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	if !ok {
+		// The upstream doesn't support cookies.
+		return r, nil
+	}
+	b, err := hex.DecodeString(rc.Cookie)
+	if err != nil || len(b) < clientCookieLen || string(b[:clientCookieLen]) != string(u.client[:]) {
+		u.logger.Warn("discarded a response with a mismatched cookie", zap.String("upstream", u.Address()))
+		return nil, errCookieMismatch
+	}
+	if server := b[clientCookieLen:]; len(server) >= minServerCookieLen && len(server) <= maxServerCookieLen {
+		u.setServerCookie(server)
+	}
+	return r, nil
+}
+
+// cookie returns the hex encoded cookie option data.
+func (u *cookieUpstream) cookie() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return hex.EncodeToString(u.client[:]) + hex.EncodeToString(u.server)
+}
+
+func (u *cookieUpstream) setServerCookie(b []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.server = append(u.server[:0], b...)
+}
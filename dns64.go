@@ -0,0 +1,202 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+)
+
+var (
+	// dns64WellKnownPrefix is the well-known prefix from RFC 6052.
+	dns64WellKnownPrefix = net.ParseIP("64:ff9b::")
+
+	// A records in these ranges are never synthesized. See RFC 6147 5.1.4.
+	dns64ExcludedNets = mustParseCIDRs("0.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "255.255.255.255/32")
+
+	// The well-known prefix must not be used with non-global addresses.
+	// See RFC 6052 3.1.
+	dns64NonGlobalNets = mustParseCIDRs("10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16")
+)
+
+func mustParseCIDRs(ss ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// dns64 synthesizes AAAA records from A records (RFC 6147) if
+// there is no native AAAA record.
+type dns64 struct {
+	prefix net.IP
+	bits   int
+	logger *zap.Logger
+}
+
+// newDNS64 creates a dns64 from a prefix, e.g. "64:ff9b::/96".
+// The prefix length must be one of 32, 40, 48, 56, 64 and 96.
+func newDNS64(s string, logger *zap.Logger) (*dns64, error) {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%s is not an ipv6 prefix", s)
+	}
+	bits, _ := n.Mask.Size()
+	switch bits {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid prefix length %d, must be one of 32, 40, 48, 56, 64 and 96", bits)
+	}
+	return &dns64{prefix: n.IP.To16(), bits: bits, logger: logger}, nil
+}
+
+func (d *dns64) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA || q.Question[0].Qclass != dns.ClassINET {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	// The client is validating by itself and wants the response as is.
+	// See RFC 6147 5.5.
+	if q.CheckingDisabled && dnssecOK(q) {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+
+	if err := handler.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil || r.Rcode != dns.RcodeSuccess || hasAAAA(r.Answer) {
+		return nil
+	}
+
+	qA := q.Copy()
+	qA.Question[0].Qtype = dns.TypeA
+	aCtx := handler.NewContext(qA, qCtx.ReqMeta())
+	if err := handler.ExecChainNode(ctx, aCtx, next); err != nil {
+		d.logger.Warn("failed to query A records for synthesis", qCtx.InfoField(), zap.Error(err))
+		return nil
+	}
+	ra := aCtx.R()
+	if ra == nil || ra.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	// The ttl of synthesized records must not exceed the negative
+	// caching ttl of the AAAA response. See RFC 6147 5.1.7.
+	maxTTL := ^uint32(0)
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			maxTTL = soa.Hdr.Ttl
+			if soa.Minttl < maxTTL {
+				maxTTL = soa.Minttl
+			}
+		}
+	}
+
+	answer := make([]dns.RR, 0, len(ra.Answer))
+	synthesized := 0
+	for _, rr := range ra.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if !d.synthesizable(rr.A) {
+				continue
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			if hdr.Ttl > maxTTL {
+				hdr.Ttl = maxTTL
+			}
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: d.synthesize(rr.A)})
+			synthesized++
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeA { // can't sign synthesized records
+				continue
+			}
+			answer = append(answer, dns.Copy(rr))
+		default: // e.g. CNAME
+			answer = append(answer, dns.Copy(rr))
+		}
+	}
+	if synthesized == 0 {
+		return nil
+	}
+
+	res := r.Copy()
+	res.Answer = answer
+	res.Ns = nil
+	res.AuthenticatedData = false // synthesized records are not validated
+	d.logger.Debug("aaaa records synthesized", qCtx.InfoField(), zap.Int("num", synthesized))
+	qCtx.SetResponse(res, handler.ContextStatusResponded)
+	return nil
+}
+
+func (d *dns64) synthesizable(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	for _, n := range dns64ExcludedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if d.bits == 96 && d.prefix.Equal(dns64WellKnownPrefix) {
+		for _, n := range dns64NonGlobalNets {
+			if n.Contains(ip) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// synthesize embeds ip4 into the prefix. See RFC 6052 2.2.
+func (d *dns64) synthesize(ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix)
+	n := d.bits / 8
+	for _, b := range ip4.To4() {
+		if n == 8 { // bits 64 to 71 must be zero.
+			n++
+		}
+		ip[n] = b
+		n++
+	}
+	return ip
+}
+
+func hasAAAA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return true
+		}
+	}
+	return false
+}
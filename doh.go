@@ -0,0 +1,133 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/http_handler"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// dohHandler is a RFC 8484 DoH http handler. It accepts both GET and POST
+// requests.
+type dohHandler struct {
+	dnsHandler dns_handler.Handler
+	path       string // If it is empty, dohHandler will ignore the request path.
+	logger     *zap.Logger
+}
+
+func (h *dohHandler) warnErr(req *http.Request, msg string, err error) {
+	h.logger.Warn(msg, zap.String("from", req.RemoteAddr), zap.String("method", req.Method), zap.String("url", req.RequestURI), zap.Error(err))
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(h.path) != 0 && req.URL.Path != h.path {
+		w.WriteHeader(http.StatusNotFound)
+		h.warnErr(req, "invalid request", fmt.Errorf("invalid request path %s", req.URL.Path))
+		return
+	}
+
+	q, err := http_handler.ReadMsgFromReq(req)
+	if err != nil {
+		h.warnErr(req, "invalid request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	meta := new(handler.RequestMeta)
+	if ip, _, _ := net.SplitHostPort(req.RemoteAddr); len(ip) > 0 {
+		meta.ClientIP = net.ParseIP(ip)
+	}
+
+	if err := h.dnsHandler.ServeDNS(req.Context(), q, &dohResponseWriter{w: w}, meta); err != nil {
+		h.warnErr(req, "handler err", err)
+		panic(http.ErrAbortHandler) // force http server to close the downstream connection.
+	}
+}
+
+type dohResponseWriter struct {
+	w http.ResponseWriter
+}
+
+func (d *dohResponseWriter) Write(m *dns.Msg) error {
+	b, buf, err := pool.PackBuffer(m)
+	if err != nil {
+		d.w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	defer buf.Release()
+
+	d.w.Header().Set("Content-Type", "application/dns-message")
+	d.w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dnsutils.GetMinimalTTL(m)))
+	_, err = d.w.Write(b)
+	return err
+}
+
+// doh3Server is a DoH server over HTTP/3.
+type doh3Server struct {
+	*http3.Server
+	closed uint32 // atomic
+}
+
+func (s *doh3Server) Close() error {
+	atomic.StoreUint32(&s.closed, 1)
+	return s.Server.Close()
+}
+
+// startDoH3Server serves h over HTTP/3 on the udp socket of addr. The
+// server is closed on shutdown.
+func startDoH3Server(addr string, h http.Handler, tlsConfig *tls.Config) (*doh3Server, error) {
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &doh3Server{Server: &http3.Server{Server: &http.Server{Handler: h, TLSConfig: tlsConfig}}}
+	registerCloser(s)
+	mlog.S().Infof("listening on doh http/3 socket %s", c.LocalAddr())
+	go func() {
+		err := s.Serve(c)
+		if err != nil && atomic.LoadUint32(&s.closed) == 0 {
+			mlog.S().Fatalf("doh http/3 server exited: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// altSvcHandler advertises the HTTP/3 server with the Alt-Svc header
+// in the responses of HTTP/1.1 and HTTP/2 requests. Clients that don't
+// support HTTP/3 ignore it and keep using the tcp connection.
+type altSvcHandler struct {
+	http.Handler
+	h3 *doh3Server
+}
+
+func (a *altSvcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.h3.SetQuicHeaders(w.Header())
+	a.Handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,182 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/miekg/dns"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	doqNoError            = 0x0 // DOQ_NO_ERROR
+	defaultDoQIdleTimeout = time.Second * 30
+	doqHandshakeTimeout   = time.Second * 5
+)
+
+// doqUpstream is a RFC 9250 DNS-over-QUIC upstream. All queries share
+// one QUIC connection, each of them is sent over a new stream. The
+// connection will be re-established if it is closed or broken.
+type doqUpstream struct {
+	dialAddr   string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+
+	mu   sync.Mutex
+	conn quic.EarlyConnection
+}
+
+func newDoQUpstream(addr string, opt *upstream.Opt) (*doqUpstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if opt.TLSConfig != nil {
+		tlsConfig = opt.TLSConfig.Clone()
+	} else {
+		tlsConfig = new(tls.Config)
+	}
+	if len(tlsConfig.ServerName) == 0 {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	tlsConfig.NextProtos = []string{"doq"}
+
+	idleTimeout := defaultDoQIdleTimeout
+	if opt.IdleTimeout > 0 {
+		idleTimeout = opt.IdleTimeout
+	}
+
+	dialAddr := u.Host
+	if len(opt.DialAddr) > 0 {
+		dialAddr = opt.DialAddr
+	}
+	if _, _, err := net.SplitHostPort(dialAddr); err != nil {
+		dialAddr = net.JoinHostPort(dialAddr, "853")
+	}
+
+	return &doqUpstream{
+		dialAddr:  dialAddr,
+		tlsConfig: tlsConfig,
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: doqHandshakeTimeout,
+			MaxIdleTimeout:       idleTimeout,
+			TokenStore:           quic.NewLRUTokenStore(4, 8),
+		},
+	}, nil
+}
+
+func (u *doqUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	conn, err := u.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := u.exchangeConn(ctx, conn, q)
+	if err != nil && ctx.Err() == nil && (conn.Context().Err() != nil || errors.Is(err, quic.Err0RTTRejected)) {
+		// The connection was closed (e.g. idle timeout) or the 0-RTT data
+		// was rejected. Retry once with a new connection.
+		u.resetConn(conn)
+		conn, err = u.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r, err = u.exchangeConn(ctx, conn, q)
+	}
+	return r, err
+}
+
+func (u *doqUpstream) exchangeConn(ctx context.Context, conn quic.EarlyConnection, q *dns.Msg) (*dns.Msg, error) {
+	b, buf, err := pool.PackBuffer(q)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Release()
+	b[0], b[1] = 0, 0 // The message id must be 0 in DoQ.
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ddl, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(ddl)
+	}
+
+	if _, err := dnsutils.WriteRawMsgToTCP(stream, b); err != nil {
+		stream.CancelRead(doqNoError)
+		return nil, err
+	}
+	stream.Close() // Indicates the end of the query.
+
+	r, _, err := dnsutils.ReadMsgFromTCP(stream)
+	if err != nil {
+		stream.CancelRead(doqNoError)
+		return nil, err
+	}
+	r.Id = q.Id
+	return r, nil
+}
+
+// getConn returns the current connection or dials a new one. Connections
+// are dialed with 0-RTT enabled, it takes effect if the tls session is
+// resumed.
+func (u *doqUpstream) getConn(ctx context.Context) (quic.EarlyConnection, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil && u.conn.Context().Err() == nil {
+		return u.conn, nil
+	}
+	conn, err := quic.DialAddrEarlyContext(ctx, u.dialAddr, u.tlsConfig, u.quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	u.conn = conn
+	return conn, nil
+}
+
+func (u *doqUpstream) resetConn(conn quic.EarlyConnection) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == conn {
+		u.conn = nil
+	}
+	conn.CloseWithError(doqNoError, "")
+}
+
+// CloseIdleConnections is a no-op. The connection will be closed by
+// the quic idle timeout.
+func (u *doqUpstream) CloseIdleConnections() {}
+
+func (u *doqUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil {
+		u.conn.CloseWithError(doqNoError, "")
+		u.conn = nil
+	}
+	return nil
+}
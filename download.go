@@ -0,0 +1,151 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isURLEntry reports whether the list entry s is a http(s) url.
+func isURLEntry(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// splitURLEntry splits a "https://host/geosite.dat:tag" entry. tag is
+// empty if s has no tag. Only a ":" in the last element of the url path
+// starts a tag, a ":" in the host is a port.
+func splitURLEntry(s string) (u, tag string) {
+	rest := s[strings.Index(s, "://")+3:]
+	if !strings.Contains(rest, "/") {
+		return s, ""
+	}
+	i := strings.LastIndex(s, ":")
+	if i < strings.LastIndex(s, "/") {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// noDownload makes downloadEntries use the copies of the last
+// successful downloads only. Url entries that were never downloaded
+// are skipped. It is set by --check-config.
+var noDownload bool
+
+// downloadEntries downloads the url entries in entries and replaces
+// them by their local copies, so the entries can be loaded as files.
+// If a url can't be downloaded, the copy of the last successful
+// download will be used.
+func downloadEntries(entries []string) ([]string, error) {
+	o := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !isURLEntry(e) {
+			o = append(o, e)
+			continue
+		}
+		u, tag := splitURLEntry(e)
+		var file string
+		var err error
+		if noDownload {
+			file = cacheFileOf(u)
+			if _, err := os.Stat(file); err != nil {
+				mlog.S().Warnf("%s is not checked, it has not been downloaded yet", u)
+				continue
+			}
+		} else if file, err = downloadToCache(u); err != nil {
+			return nil, err
+		}
+		if len(tag) > 0 {
+			file = file + ":" + tag
+		}
+		o = append(o, file)
+	}
+	return o, nil
+}
+
+// downloadToCache downloads u to the list cache dir and returns the
+// file path.
+func downloadToCache(u string) (string, error) {
+	if err := os.MkdirAll(opt.ListCacheDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create list cache dir, %w", err)
+	}
+	file := cacheFileOf(u)
+
+	err := download(u, file, time.Duration(opt.DownloadTimeout)*time.Second)
+	if err == nil {
+		mlog.S().Infof("%s downloaded", u)
+		return file, nil
+	}
+	fi, statErr := os.Stat(file)
+	if statErr != nil {
+		return "", fmt.Errorf("failed to download %s, %w", u, err)
+	}
+	mlog.S().Warnf("failed to download %s, using the copy downloaded at %s: %v", u, fi.ModTime().Format(time.RFC3339), err)
+	return file, nil
+}
+
+// cacheFileOf returns the path of the local copy of u. The file is
+// named after the last element of the url path, without the query.
+func cacheFileOf(u string) string {
+	h := sha256.Sum256([]byte(u))
+	name := u
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	return filepath.Join(opt.ListCacheDir, hex.EncodeToString(h[:8])+"_"+path.Base(name))
+}
+
+// download writes the body of u to file. file is only replaced if the
+// download is complete.
+func download(u, file string, timeout time.Duration) error {
+	c := &http.Client{Timeout: timeout}
+	resp, err := c.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("http status " + resp.Status)
+	}
+
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
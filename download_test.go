@@ -0,0 +1,54 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_splitURLEntry(t *testing.T) {
+	tests := []struct {
+		s, u, tag string
+	}{
+		{"https://example.com/geosite.dat:cn", "https://example.com/geosite.dat", "cn"},
+		{"https://example.com:8443/geosite.dat:cn", "https://example.com:8443/geosite.dat", "cn"},
+		{"https://example.com:8443/china_ip.txt", "https://example.com:8443/china_ip.txt", ""},
+		{"https://example.com:8443", "https://example.com:8443", ""},
+		{"http://example.com", "http://example.com", ""},
+	}
+	for _, tt := range tests {
+		u, tag := splitURLEntry(tt.s)
+		if u != tt.u || tag != tt.tag {
+			t.Fatalf("splitURLEntry(%s) = %s, %s, want %s, %s", tt.s, u, tag, tt.u, tt.tag)
+		}
+	}
+}
+
+func Test_cacheFileOf(t *testing.T) {
+	for _, u := range []string{"https://example.com/geosite.dat?token=abc", "https://example.com/geosite.dat#cn"} {
+		f := filepath.Base(cacheFileOf(u))
+		if !strings.HasSuffix(f, "_geosite.dat") {
+			t.Fatalf("cacheFileOf(%s) = %s", u, f)
+		}
+	}
+	if cacheFileOf("https://example.com/geosite.dat?a") == cacheFileOf("https://example.com/geosite.dat?b") {
+		t.Fatal("urls with different queries share a cache file")
+	}
+}
@@ -0,0 +1,155 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/concurrent_lru"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ecsCacheIndex remembers the ecs scope prefix lengths that upstreams
+// returned for each query, so responses to ecs queries can be cached
+// per network block (RFC 7871 7.3.1). Keys are the cache keys of the
+// queries without ecs. The number of network blocks of each key is
+// limited by maxSubnets, so clients from many subnets can't flood the
+// cache with one name.
+type ecsCacheIndex struct {
+	maxSubnets int
+
+	mu    sync.Mutex                    // serializes the creation of entries
+	names *concurrent_lru.ConcurrentLRU // *ecsNameIndex
+}
+
+type ecsNameIndex struct {
+	mu      sync.Mutex
+	scopes  []uint8              // longest first
+	subnets map[string]time.Time // subnet key -> expiration time
+}
+
+func newECSCacheIndex(size, maxSubnets int) *ecsCacheIndex {
+	if size <= 0 {
+		size = 1024
+	}
+	return &ecsCacheIndex{
+		maxSubnets: maxSubnets,
+		names:      concurrent_lru.NewConcurrentLRU(64, size/64+1, nil, nil),
+	}
+}
+
+// keys returns the cache keys that may hold a response to a query of
+// key with ecs e, longest scope first.
+func (x *ecsCacheIndex) keys(key string, e *dns.EDNS0_SUBNET) []string {
+	v, ok := x.names.Get(ecsFamilyKey(key, e))
+	if !ok {
+		return nil
+	}
+	ni := v.(*ecsNameIndex)
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	keys := make([]string, 0, len(ni.scopes))
+	for _, scope := range ni.scopes {
+		keys = append(keys, ecsSubnetKey(key, e, scope))
+	}
+	return keys
+}
+
+// add records that the response to a query of key with ecs e has the
+// ecs scope prefix length scope, and returns the cache key to store it.
+// It returns false if the key already has maxSubnets unexpired network
+// blocks.
+func (x *ecsCacheIndex) add(key string, e *dns.EDNS0_SUBNET, scope uint8, expirationTime time.Time) (string, bool) {
+	fk := ecsFamilyKey(key, e)
+	x.mu.Lock()
+	v, ok := x.names.Get(fk)
+	if !ok {
+		v = &ecsNameIndex{subnets: make(map[string]time.Time)}
+		x.names.Add(fk, v)
+	}
+	x.mu.Unlock()
+	ni := v.(*ecsNameIndex)
+
+	sk := ecsSubnetKey(key, e, scope)
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	if _, ok := ni.subnets[sk]; !ok && len(ni.subnets) >= x.maxSubnets {
+		now := time.Now()
+		for k, t := range ni.subnets {
+			if now.After(t) {
+				delete(ni.subnets, k)
+			}
+		}
+		if len(ni.subnets) >= x.maxSubnets {
+			return "", false
+		}
+	}
+	ni.subnets[sk] = expirationTime
+	for _, s := range ni.scopes {
+		if s == scope {
+			return sk, true
+		}
+	}
+	ni.scopes = append(ni.scopes, scope)
+	sort.Slice(ni.scopes, func(i, j int) bool { return ni.scopes[i] > ni.scopes[j] })
+	return sk, true
+}
+
+func ecsFamilyKey(key string, e *dns.EDNS0_SUBNET) string {
+	return fmt.Sprintf("%secs%d", key, e.Family)
+}
+
+// ecsSubnetKey returns the cache key of the network block of e with
+// prefix length scope. Scope can't be longer than the source prefix,
+// because the rest of the address is unknown.
+func ecsSubnetKey(key string, e *dns.EDNS0_SUBNET, scope uint8) string {
+	if scope > e.SourceNetmask {
+		scope = e.SourceNetmask
+	}
+	bits := 32
+	if e.Family == 2 {
+		bits = 128
+	}
+	ip := e.Address.Mask(net.CIDRMask(int(scope), bits))
+	return fmt.Sprintf("%secs%d:%s/%d", key, e.Family, ip, scope)
+}
+
+// ecsScopeOf returns the ecs scope prefix length of response r. A
+// response without ecs is valid for all clients, its scope is 0.
+func ecsScopeOf(r *dns.Msg) uint8 {
+	if e := dnsutils.GetMsgECS(r); e != nil {
+		return e.SourceScope
+	}
+	return 0
+}
+
+// setResponseECS makes the ecs of the cached response r echo the ecs
+// e of the query that it is served to.
+func setResponseECS(r *dns.Msg, e *dns.EDNS0_SUBNET) {
+	re := dnsutils.GetMsgECS(r)
+	if re == nil {
+		return
+	}
+	re.Family = e.Family
+	re.SourceNetmask = e.SourceNetmask
+	re.Address = e.Address
+}
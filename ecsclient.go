@@ -0,0 +1,87 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// clientECS attaches the network of the client ip, truncated to mask4
+// or mask6 bits, to A/AAAA queries as the edns0 client subnet. It runs
+// before the cache, so responses are cached per client network.
+//
+// Clients with private, loopback or link-local ips are skipped, their
+// networks mean nothing to upstreams. The ecs is removed from the
+// response if the client didn't send one.
+type clientECS struct {
+	mask4, mask6 uint8
+	overwrite    bool // overwrite the ecs that is already in the query
+}
+
+func (c *clientECS) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	ip := qCtx.ReqMeta().ClientIP
+	if !isPublicIP(ip) || len(q.Question) != 1 || (q.Question[0].Qtype != dns.TypeA && q.Question[0].Qtype != dns.TypeAAAA) {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+
+	opt := q.IsEdns0()
+	var clientEcs *dns.EDNS0_SUBNET
+	if opt != nil {
+		clientEcs = dnsutils.GetECS(opt)
+	}
+	if clientEcs != nil && !c.overwrite {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	var e *dns.EDNS0_SUBNET
+	if ip4 := ip.To4(); ip4 != nil {
+		e = dnsutils.NewEDNS0Subnet(ip4, c.mask4, false)
+	} else {
+		e = dnsutils.NewEDNS0Subnet(ip, c.mask6, true)
+	}
+	upgraded := opt == nil
+	if upgraded {
+		opt = dnsutils.UpgradeEDNS0(q)
+	}
+	dnsutils.AddECS(opt, e, true)
+
+	if err := handler.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r != nil {
+		switch {
+		case upgraded:
+			dnsutils.RemoveEDNS0(r)
+		case clientEcs == nil:
+			dnsutils.RemoveMsgECS(r)
+		default:
+			setResponseECS(r, clientEcs)
+		}
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is a global unicast address that is
+// not in a private network.
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
@@ -0,0 +1,77 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+)
+
+// EDNS0 udp payload size of the OPT record that is added to responses
+// without one.
+const edeUDPSize = 1232
+
+// edeHandler adds RFC 8914 extended dns errors to the responses of
+// clients that sent an EDNS0 OPT record. The errors are recorded in the
+// queryInfo of the query by the nodes that blocked, filtered or failed
+// it, see queryInfo.addEDE.
+type edeHandler struct {
+	dns_handler.Handler
+}
+
+func (h *edeHandler) ServeDNS(ctx context.Context, req *dns.Msg, w dns_handler.ResponseWriter, meta *handler.RequestMeta) error {
+	if req.IsEdns0() == nil {
+		return h.Handler.ServeDNS(ctx, req, w, meta)
+	}
+	ctx, qi := withQueryInfo(ctx)
+	return h.Handler.ServeDNS(ctx, req, &edeWriter{ResponseWriter: w, qi: qi}, meta)
+}
+
+type edeWriter struct {
+	dns_handler.ResponseWriter
+	qi *queryInfo
+}
+
+// Write adds the recorded errors to m. A network error is only added
+// if m is a SERVFAIL, an upstream may have failed before another one
+// answered.
+func (w *edeWriter) Write(m *dns.Msg) error {
+	edes := w.qi.getEDEs()
+	if m.Rcode == dns.RcodeServerFailure && w.qi.isUpstreamFailed() {
+		edes = append(edes, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeNetworkError,
+			ExtraText: "upstreams failed",
+		})
+	}
+	if len(edes) == 0 {
+		return w.ResponseWriter.Write(m)
+	}
+
+	m = m.Copy()
+	o := m.IsEdns0()
+	if o == nil {
+		m.SetEdns0(edeUDPSize, false)
+		o = m.IsEdns0()
+	}
+	for _, e := range edes {
+		o.Option = append(o.Option, e)
+	}
+	return w.ResponseWriter.Write(m)
+}
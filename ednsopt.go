@@ -0,0 +1,96 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// parseEDNSOptions parses the "CODE:hexdata" args of --edns-option.
+// Options that are managed by other flags (ECS, cookie, padding) are
+// not allowed.
+func parseEDNSOptions(ss []string) ([]*dns.EDNS0_LOCAL, error) {
+	opts := make([]*dns.EDNS0_LOCAL, 0, len(ss))
+	for _, s := range ss {
+		cs, hs, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid edns option %s, want CODE:hexdata", s)
+		}
+		code, err := strconv.ParseUint(cs, 10, 16)
+		if err != nil || code == 0 {
+			return nil, fmt.Errorf("invalid edns option code %s", cs)
+		}
+		switch uint16(code) {
+		case dns.EDNS0SUBNET, dns.EDNS0COOKIE, dns.EDNS0PADDING:
+			return nil, fmt.Errorf("edns option %d is managed by other options", code)
+		}
+		data, err := hex.DecodeString(hs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid edns option data %s, %w", hs, err)
+		}
+		opts = append(opts, &dns.EDNS0_LOCAL{Code: uint16(code), Data: data})
+	}
+	return opts, nil
+}
+
+// ednsOptionUpstream attaches options to the queries. Other options of
+// the query are kept, and options of the same codes are replaced.
+// These options will be removed from the response, unless the client
+// sent them as well.
+type ednsOptionUpstream struct {
+	bundled_upstream.Upstream
+	opts []*dns.EDNS0_LOCAL
+}
+
+func (u *ednsOptionUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	clientOpt := q.IsEdns0()
+
+	qCopy := q.Copy()
+	opt := qCopy.IsEdns0()
+	if opt == nil {
+		opt = dnsutils.UpgradeEDNS0(qCopy)
+	}
+	for _, o := range u.opts {
+		dnsutils.RemoveEDNS0Option(opt, o.Code)
+		opt.Option = append(opt.Option, o)
+	}
+	r, err := u.Upstream.Exchange(ctx, qCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	if clientOpt == nil {
+		dnsutils.RemoveEDNS0(r)
+		return r, nil
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range u.opts {
+			if dnsutils.GetEDNS0Option(clientOpt, o.Code) == nil {
+				dnsutils.RemoveEDNS0Option(opt, o.Code)
+			}
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,375 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// TTL of fake ip answers. It is short, so clients won't keep an
+	// address after it was recycled for another domain.
+	fakeIPTTL = 1
+
+	// fakeIPMaxPool is the maximum number of addresses in the pool.
+	fakeIPMaxPool = 1 << 18
+)
+
+// fakeIPPool assigns addresses of the fake ip ranges to domains. The
+// same offset in the v4 and v6 range is assigned to a domain. When all
+// addresses are assigned, the least recently used one is recycled.
+type fakeIPPool struct {
+	v4, v6 *net.IPNet // nil if not configured
+	size   uint32     // usable offsets are [1, size]
+
+	mu     sync.Mutex
+	lru    *list.List // *fakeIPEntry, the front is the most recently used
+	byName map[string]*list.Element
+	byOff  map[uint32]*list.Element
+	next   uint32 // the next offset that has never been assigned
+}
+
+type fakeIPEntry struct {
+	name string
+	off  uint32
+}
+
+// newFakeIPPool parses the --fake-ip-range args. At most one ipv4 and
+// one ipv6 range can be configured.
+func newFakeIPPool(ranges []string) (*fakeIPPool, error) {
+	p := &fakeIPPool{
+		size:   fakeIPMaxPool,
+		lru:    list.New(),
+		byName: make(map[string]*list.Element),
+		byOff:  make(map[uint32]*list.Element),
+		next:   1,
+	}
+	for _, s := range ranges {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fake ip range %s, %w", s, err)
+		}
+		ones, bits := n.Mask.Size()
+		hostBits := bits - ones
+		var size uint64
+		if bits == 32 {
+			if p.v4 != nil {
+				return nil, fmt.Errorf("invalid fake ip range %s, only one ipv4 range is allowed", s)
+			}
+			n.IP = n.IP.To4()
+			p.v4 = n
+			if hostBits < 2 {
+				return nil, fmt.Errorf("fake ip range %s is too small", s)
+			}
+			size = 1<<hostBits - 2 // without the network and broadcast address
+		} else {
+			if p.v6 != nil {
+				return nil, fmt.Errorf("invalid fake ip range %s, only one ipv6 range is allowed", s)
+			}
+			p.v6 = n
+			if hostBits < 1 {
+				return nil, fmt.Errorf("fake ip range %s is too small", s)
+			}
+			size = fakeIPMaxPool
+			if hostBits < 32 {
+				size = 1<<hostBits - 1 // without the network address
+			}
+		}
+		if size < uint64(p.size) {
+			p.size = uint32(size)
+		}
+	}
+	return p, nil
+}
+
+// get returns the offset that is assigned to name.
+func (p *fakeIPPool) get(name string) uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.byName[name]; ok {
+		p.lru.MoveToFront(e)
+		return e.Value.(*fakeIPEntry).off
+	}
+	var off uint32
+	if p.next <= p.size {
+		off = p.next
+		p.next++
+	} else {
+		e := p.lru.Back()
+		old := e.Value.(*fakeIPEntry)
+		p.lru.Remove(e)
+		delete(p.byName, old.name)
+		delete(p.byOff, old.off)
+		off = old.off
+	}
+	p.add(name, off)
+	return off
+}
+
+// add assigns off to name. p.mu must be held.
+func (p *fakeIPPool) add(name string, off uint32) {
+	e := p.lru.PushFront(&fakeIPEntry{name: name, off: off})
+	p.byName[name] = e
+	p.byOff[off] = e
+}
+
+// lookup returns the domain that ip is assigned to.
+func (p *fakeIPPool) lookup(ip net.IP) (string, bool) {
+	off, ok := p.offsetOf(ip)
+	if !ok {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.byOff[off]
+	if !ok {
+		return "", false
+	}
+	return e.Value.(*fakeIPEntry).name, true
+}
+
+// contains reports whether ip is in one of the fake ip ranges.
+func (p *fakeIPPool) contains(ip net.IP) bool {
+	return (p.v4 != nil && p.v4.Contains(ip)) || (p.v6 != nil && p.v6.Contains(ip))
+}
+
+// ipOf returns the address of off in n.
+func ipOf(n *net.IPNet, off uint32) net.IP {
+	ip := make(net.IP, len(n.IP))
+	copy(ip, n.IP)
+	low := ip[len(ip)-4:]
+	binary.BigEndian.PutUint32(low, binary.BigEndian.Uint32(low)+off)
+	return ip
+}
+
+// offsetOf returns the offset of ip in the fake ip range that contains it.
+func (p *fakeIPPool) offsetOf(ip net.IP) (uint32, bool) {
+	var n *net.IPNet
+	if ip4 := ip.To4(); ip4 != nil {
+		n, ip = p.v4, ip4
+	} else {
+		n = p.v6
+	}
+	if n == nil || !n.Contains(ip) {
+		return 0, false
+	}
+	l := len(ip)
+	if !ip[:l-4].Equal(n.IP[:l-4]) {
+		return 0, false
+	}
+	off := binary.BigEndian.Uint32(ip[l-4:]) - binary.BigEndian.Uint32(n.IP[l-4:])
+	return off, off >= 1 && off <= p.size
+}
+
+// load reads the assignments saved by save. Addresses that are not in
+// the current ranges are skipped, e.g. after the ranges were changed.
+func (p *fakeIPPool) load(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		ipStr, name, ok := strings.Cut(strings.TrimSpace(s.Text()), " ")
+		if !ok {
+			continue
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			continue
+		}
+		off, ok := p.offsetOf(ip)
+		if !ok {
+			continue
+		}
+		if _, dup := p.byName[name]; dup {
+			continue
+		}
+		if _, dup := p.byOff[off]; dup {
+			continue
+		}
+		// The file is saved from the least recently used entry.
+		p.add(name, off)
+		if off >= p.next {
+			p.next = off + 1
+		}
+		n++
+	}
+	return n, s.Err()
+}
+
+// save writes the assignments to file, one "ip domain" per line, from
+// the least recently used one.
+func (p *fakeIPPool) save(file string) error {
+	n := p.v4
+	if n == nil {
+		n = p.v6
+	}
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	p.mu.Lock()
+	for e := p.lru.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*fakeIPEntry)
+		w.WriteString(ipOf(n, entry.off).String() + " " + entry.name + "\n")
+	}
+	p.mu.Unlock()
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// fakeIPExec answers A and AAAA queries of the remote domains with
+// addresses from the fake ip pool, and PTR queries of these addresses
+// with their domains. Other queries go on to the rest of the chain.
+type fakeIPExec struct {
+	m      *msg_matcher.QNameMatcher
+	pool   *fakeIPPool
+	file   string // empty if the assignments are not saved
+	logger *zap.Logger
+}
+
+func (e *fakeIPExec) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	question := q.Question[0]
+	switch question.Qtype {
+	case dns.TypePTR:
+		ip := reverseAddr(question.Name)
+		if ip == nil || !e.pool.contains(ip) {
+			break
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if name, ok := e.pool.lookup(ip); ok {
+			r.Answer = []dns.RR{&dns.PTR{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: fakeIPTTL},
+				Ptr: name,
+			}}
+		} else {
+			r.Rcode = dns.RcodeNameError
+		}
+		qCtx.SetResponse(r, handler.ContextStatusResponded)
+		return nil
+	case dns.TypeA, dns.TypeAAAA:
+		if !e.m.MatchMsg(q) {
+			break
+		}
+		name := strings.ToLower(question.Name)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: fakeIPTTL}
+		// A family without a range gets an empty answer, the real
+		// address won't be leaked.
+		switch {
+		case question.Qtype == dns.TypeA && e.pool.v4 != nil:
+			r.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ipOf(e.pool.v4, e.pool.get(name))}}
+		case question.Qtype == dns.TypeAAAA && e.pool.v6 != nil:
+			r.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ipOf(e.pool.v6, e.pool.get(name))}}
+		}
+		e.logger.Debug("fake ip", qCtx.InfoField())
+		qCtx.SetResponse(r, handler.ContextStatusResponded)
+		return nil
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+// Close saves the assignments if a file is configured.
+func (e *fakeIPExec) Close() error {
+	if len(e.file) == 0 {
+		return nil
+	}
+	if err := e.pool.save(e.file); err != nil {
+		return fmt.Errorf("failed to save fake ip file, %w", err)
+	}
+	return nil
+}
+
+// reverseAddr returns the address of a complete in-addr.arpa or
+// ip6.arpa name. It returns nil if name is not one.
+func reverseAddr(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, l := range labels {
+			b, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(b)
+		}
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, l := range labels {
+			b, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return nil
+			}
+			j := len(labels) - 1 - i // nibble index from the most significant one
+			if j%2 == 0 {
+				ip[j/2] |= byte(b) << 4
+			} else {
+				ip[j/2] |= byte(b)
+			}
+		}
+		return ip
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"go.uber.org/zap"
+)
+
+// forcedClients are the clients whose queries are always sent to the
+// local or remote upstream, regardless of other routing rules. A nil
+// *forcedClients has no client.
+type forcedClients struct {
+	local  netlist.Matcher // nil if not set
+	remote netlist.Matcher // nil if not set
+}
+
+// routeOf returns "local" or "remote" if the client of qCtx is forced
+// to that route, or "" otherwise. Local has higher priority.
+func (f *forcedClients) routeOf(qCtx *handler.Context) (string, error) {
+	if f == nil {
+		return "", nil
+	}
+	ip := qCtx.ReqMeta().ClientIP
+	if ip == nil {
+		return "", nil
+	}
+	for _, r := range [...]struct {
+		route string
+		l     netlist.Matcher
+	}{{"local", f.local}, {"remote", f.remote}} {
+		if r.l == nil {
+			continue
+		}
+		ok, err := r.l.Match(ip)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return r.route, nil
+		}
+	}
+	return "", nil
+}
+
+// keyPrefix returns the cache key prefix of qCtx. Forced clients don't
+// share cached or in-flight responses with others, because they are
+// resolved by a different route.
+func (f *forcedClients) keyPrefix(qCtx *handler.Context) (string, error) {
+	route, err := f.routeOf(qCtx)
+	if err != nil || len(route) == 0 {
+		return "", err
+	}
+	return "force_" + route + ":", nil
+}
+
+// forcedClientRoute forwards the queries of forced clients to the
+// upstream of their route. Other queries go on to the routing rules.
+type forcedClientRoute struct {
+	clients *forcedClients
+	local   handler.ExecutableChainNode
+	remote  handler.ExecutableChainNode
+	logger  *zap.Logger
+}
+
+func (f *forcedClientRoute) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	route, err := f.clients.routeOf(qCtx)
+	if err != nil {
+		return err
+	}
+	var node handler.ExecutableChainNode
+	switch route {
+	case "local":
+		node = f.local
+	case "remote":
+		node = f.remote
+	default:
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	f.logger.Debug("forced client", qCtx.InfoField(), zap.String("route", route))
+	queryInfoFrom(ctx).setForcedRoute(route)
+	return handler.ExecChainNode(ctx, qCtx, node)
+}
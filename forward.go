@@ -0,0 +1,601 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// upstreamFallbackDelay is how long to wait for the selected weighted
+// upstream before also querying the next one.
+const upstreamFallbackDelay = time.Second
+
+type upstreamConfig struct {
+	Addr               string
+	DialAddr           string
+	Trusted            bool
+	TrustedArg         bool // Trusted is set by the trusted arg
+	Socks5             string
+	IdleTimeout        int
+	MaxConns           int
+	EnablePipeline     bool
+	EnableHTTP3        bool
+	InsecureSkipVerify bool
+	ServerName         string
+	Bootstrap          []string
+	BootstrapTTL       int
+	Enable0x20         bool
+	EnablePadding      bool
+	EnableCookie       bool
+	EnableQNameMin     bool
+	EDNSOptions        []*dns.EDNS0_LOCAL
+	MaxConcurrent      int
+	Weight             int // 0 if the weight arg is not set
+	BogusIP            netlist.Matcher
+	EnableTFO          bool
+	UDPSize            int
+	MaxResponseSize    int
+	Retries            int
+	Reconnect          bool
+	RetryBackoff       time.Duration
+	MaxCNAMEDepth      int
+	UDPRandomPort      bool
+	Bind               *bindConfig
+}
+
+// upstreamOpt is upstream.Opt with the extra options of mosdns-cn.
+type upstreamOpt struct {
+	upstream.Opt
+
+	// EnableTFO enables TCP Fast Open for TCP, DoT and DoH upstreams.
+	EnableTFO bool
+
+	// Bind binds the connections to a local address and/or interface.
+	// Nil means no binding.
+	Bind *bindConfig
+
+	// UDPRandomPort sends udp queries from short-lived sockets with
+	// random source ports.
+	UDPRandomPort bool
+}
+
+// forwarder forwards queries to its upstreams. It is similar to the
+// fast_forward plugin from mosdns but allows us to observe every upstream.
+type forwarder struct {
+	name   string // "upstream", "local" or "remote"
+	logger *zap.Logger
+
+	// race disables the trusted upstream. The first NOERROR or NXDOMAIN
+	// response from any upstream will be accepted.
+	race bool
+
+	us      []*observedUpstream
+	closers []io.Closer
+
+	healthChecked bool // health checks are running
+}
+
+func newForwarder(name string, cs []*upstreamConfig, ca []string, race bool, logger *zap.Logger) (*forwarder, error) {
+	if len(cs) == 0 {
+		return nil, errors.New("no upstream is configured")
+	}
+
+	var rootCAs *x509.CertPool
+	if len(ca) != 0 {
+		var err error
+		rootCAs, err = utils.LoadCertPool(ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ca, %w", err)
+		}
+	}
+
+	us := make([]*observedUpstream, 0, len(cs))
+	var closers []io.Closer
+	for _, c := range cs {
+		var u bundled_upstream.Upstream
+		if strings.HasPrefix(c.Addr, "udpme://") {
+			u = newUDPME(c.Addr[8:], c.Trusted, c.Bind)
+		} else {
+			opt := &upstreamOpt{
+				Opt: upstream.Opt{
+					DialAddr:       c.DialAddr,
+					Socks5:         c.Socks5,
+					IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
+					MaxConns:       c.MaxConns,
+					EnablePipeline: c.EnablePipeline,
+					EnableHTTP3:    c.EnableHTTP3,
+					TLSConfig: &tls.Config{
+						ServerName:         c.ServerName,
+						InsecureSkipVerify: c.InsecureSkipVerify,
+						RootCAs:            rootCAs,
+						ClientSessionCache: tls.NewLRUClientSessionCache(64),
+					},
+					Logger: logger,
+				},
+				EnableTFO:     c.EnableTFO,
+				Bind:          c.Bind,
+				UDPRandomPort: c.UDPRandomPort,
+			}
+			var uu upstream.Upstream
+			var err error
+			if len(c.Bootstrap) > 0 && len(c.DialAddr) == 0 && needBootstrap(c.Addr) {
+				uu, err = newBootstrapUpstream(c.Addr, opt, c.Bootstrap, time.Duration(c.BootstrapTTL)*time.Second, logger)
+			} else {
+				uu, err = newUpstream(c.Addr, opt)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to init upstream %s, %w", c.Addr, err)
+			}
+			if c.Reconnect && isReconnectApplicable(c.Addr) {
+				uu = &reconnectUpstream{Upstream: uu, address: c.Addr, logger: logger}
+			}
+			closers = append(closers, uu)
+			u = &upstreamWrapper{address: c.Addr, trusted: c.Trusted, u: uu}
+		}
+		if c.MaxResponseSize > 0 {
+			u = &responseSizeUpstream{Upstream: u, max: c.MaxResponseSize, logger: logger}
+		}
+		if c.UDPSize > 0 && isUDPSizeApplicable(c.Addr) {
+			u = &udpSizeUpstream{Upstream: u, size: uint16(c.UDPSize)}
+		}
+		if c.EnableCookie && is0x20Applicable(c.Addr) {
+			u = newCookieUpstream(u, logger)
+		}
+		if c.Enable0x20 && is0x20Applicable(c.Addr) {
+			u = &case0x20Upstream{Upstream: u}
+		}
+		if c.EnablePadding && isPaddingApplicable(c.Addr) {
+			u = &paddingUpstream{Upstream: u}
+		}
+		// Added before padding, so they are counted in the padded length.
+		if len(c.EDNSOptions) > 0 {
+			u = &ednsOptionUpstream{Upstream: u, opts: c.EDNSOptions}
+		}
+		if c.EnableQNameMin {
+			u = newQminUpstream(u, logger)
+		}
+		if c.BogusIP != nil {
+			u = &bogusIPUpstream{Upstream: u, l: c.BogusIP, logger: logger}
+		}
+		if c.MaxCNAMEDepth > 0 {
+			u = &cnameCheckUpstream{Upstream: u, maxDepth: c.MaxCNAMEDepth, logger: logger}
+		}
+		if c.Retries > 0 {
+			u = &retryUpstream{Upstream: u, retries: c.Retries, backoff: c.RetryBackoff, logger: logger}
+		}
+		ou := newObservedUpstream(u, c.MaxConcurrent)
+		ou.weight = c.Weight
+		us = append(us, ou)
+	}
+
+	return &forwarder{
+		name:    name,
+		logger:  logger,
+		race:    race,
+		us:      us,
+		closers: closers,
+	}, nil
+}
+
+// Close closes all upstreams.
+func (f *forwarder) Close() error {
+	for _, c := range f.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// newUpstream is upstream.NewUpstream with DoQ (quic:// or doq://),
+// authenticated socks5 proxy, TCP Fast Open, source address binding and
+// random udp source port support.
+func newUpstream(addr string, opt *upstreamOpt) (upstream.Upstream, error) {
+	if strings.HasPrefix(addr, "quic://") || strings.HasPrefix(addr, "doq://") {
+		if opt.Bind != nil {
+			return nil, errors.New("bindaddr and bindif are not supported by doq upstreams")
+		}
+		return newDoQUpstream(addr, &opt.Opt)
+	}
+	if isSocks5URL(opt.Socks5) {
+		return newSocks5Upstream(addr, &opt.Opt, opt.Bind)
+	}
+	if opt.UDPRandomPort && strings.HasPrefix(addr, "udp://") {
+		return newRandomPortUpstream(addr, opt)
+	}
+	if opt.Bind != nil {
+		return newBoundUpstream(addr, opt)
+	}
+	if opt.EnableTFO && len(opt.Socks5) == 0 && isTFOApplicable(addr, opt.EnableHTTP3) {
+		d := &net.Dialer{Control: tfoControl}
+		return newStreamUpstream(addr, &opt.Opt, func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		})
+	}
+	return upstream.NewUpstream(addr, &opt.Opt)
+}
+
+// isTFOApplicable reports whether addr is a TCP, DoT or DoH (not HTTP/3)
+// upstream.
+func isTFOApplicable(addr string, http3 bool) bool {
+	scheme, _, _ := strings.Cut(addr, "://")
+	switch scheme {
+	case "tcp", "tls":
+		return true
+	case "https":
+		return !http3
+	default:
+		return false
+	}
+}
+
+// Exec forwards qCtx.Q() to upstreams, and sets qCtx.R().
+// qCtx.Status() will be set as
+// - handler.ContextStatusResponded: if it received a response.
+// - handler.ContextStatusServerFailed: if all upstreams failed.
+func (f *forwarder) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if dryRun != nil {
+		return f.execDryRun(ctx, qCtx, next)
+	}
+	metrics.observeRoute(f.name)
+	r, from, err := f.exchangeParallel(ctx, qCtx)
+	if err != nil {
+		queryInfoFrom(ctx).setUpstreamFailed()
+		qCtx.SetResponse(nil, handler.ContextStatusServerFailed)
+		return err
+	}
+	queryInfoFrom(ctx).addAnswer(f.name, from.Address(), r)
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+type parallelResult struct {
+	r    *dns.Msg
+	err  error
+	from bundled_upstream.Upstream
+}
+
+// exchangeParallel sends the query to all upstreams and returns the first
+// valid response and the upstream it came from. Error rcodes from untrusted
+// upstreams are only accepted if no other upstream responded.
+// If any upstream has a weight, upstreams are queried one by one in
+// a weighted random order. The next upstream is only queried if the
+// previous ones failed or did not respond in upstreamFallbackDelay.
+func (f *forwarder) exchangeParallel(ctx context.Context, qCtx *handler.Context) (*dns.Msg, bundled_upstream.Upstream, error) {
+	q := qCtx.Q()
+	us, trusted := f.healthyUpstreams()
+	t := len(us)
+	if t == 1 {
+		u := us[0]
+		r, err := u.Exchange(ctx, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				f.logger.Warn("query timeout", qCtx.InfoField(), zap.Strings("pending", []string{u.Address()}))
+			}
+			return nil, nil, err
+		}
+		f.logger.Debug("response received", qCtx.InfoField(), zap.String("from", u.Address()))
+		return r, u, nil
+	}
+
+	// Cancel the remaining exchanges once we got a response.
+	exchangeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := make(chan *parallelResult, t) // use buf chan to avoid blocking.
+	qCopy := q.Copy()                  // qCtx is not safe for concurrent use.
+	pending := make(map[bundled_upstream.Upstream]struct{}, t)
+	groups := groupByWeight(us)
+	fallbackTimer := time.NewTimer(upstreamFallbackDelay)
+	defer fallbackTimer.Stop()
+	queryNextGroup := func() {
+		for _, u := range groups[0] {
+			u := u
+			pending[u] = struct{}{}
+			go func() {
+				r, err := u.Exchange(exchangeCtx, qCopy)
+				c <- &parallelResult{r: r, err: err, from: u}
+			}()
+		}
+		groups = groups[1:]
+		if len(groups) > 0 {
+			if !fallbackTimer.Stop() {
+				select {
+				case <-fallbackTimer.C:
+				default:
+				}
+			}
+			fallbackTimer.Reset(upstreamFallbackDelay)
+		}
+	}
+	queryNextGroup()
+
+	var candidateErrReply *parallelResult
+	for len(pending) > 0 || len(groups) > 0 {
+		if len(pending) == 0 { // all queried upstreams failed.
+			queryNextGroup()
+		}
+		var fallback <-chan time.Time
+		if len(groups) > 0 {
+			fallback = fallbackTimer.C
+		}
+		select {
+		case res := <-c:
+			delete(pending, res.from)
+			if res.err != nil {
+				f.logger.Warn("upstream failed", qCtx.InfoField(), zap.String("from", res.from.Address()), zap.Error(res.err))
+				continue
+			}
+
+			if f.accept(res, trusted) {
+				f.logger.Debug("response accepted", qCtx.InfoField(), zap.String("from", res.from.Address()))
+				return res.r, res.from, nil
+			}
+
+			if candidateErrReply == nil {
+				candidateErrReply = res
+			}
+			f.logger.Debug("untrusted upstream returned an err rcode", qCtx.InfoField(), zap.String("from", res.from.Address()), zap.Int("rcode", res.r.Rcode))
+		case <-fallback:
+			f.logger.Debug("upstreams did not respond in time, querying the next upstream", qCtx.InfoField())
+			queryNextGroup()
+		case <-ctx.Done():
+			addrs := make([]string, 0, len(pending))
+			for u := range pending {
+				addrs = append(addrs, u.Address())
+			}
+			f.logger.Warn("query timeout", qCtx.InfoField(), zap.Strings("pending", addrs))
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	// all upstreams failed or returned an error rcode.
+	if candidateErrReply != nil {
+		f.logger.Debug("candidate error response accepted", qCtx.InfoField(), zap.String("from", candidateErrReply.from.Address()))
+		return candidateErrReply.r, candidateErrReply.from, nil
+	}
+	return nil, nil, errors.New("no response")
+}
+
+// accept reports whether res can be returned without waiting for
+// other upstreams.
+func (f *forwarder) accept(res *parallelResult, trusted []*observedUpstream) bool {
+	switch {
+	case res.r.Rcode == dns.RcodeSuccess:
+		return true
+	case f.race:
+		return res.r.Rcode == dns.RcodeNameError
+	}
+	for _, u := range trusted {
+		if res.from == u {
+			return true
+		}
+	}
+	return false
+}
+
+// groupByWeight returns the groups of upstreams in the order they
+// should be queried. If no upstream has a weight, all upstreams are
+// in one group and are queried in parallel. Otherwise, each group has
+// one upstream and the order is picked randomly in proportion to the
+// weights. Upstreams without a weight have a weight of 1.
+func groupByWeight(us []*observedUpstream) [][]*observedUpstream {
+	total := 0
+	for _, u := range us {
+		total += u.weight
+	}
+	if total == 0 {
+		return [][]*observedUpstream{us}
+	}
+
+	remain := make([]*observedUpstream, len(us))
+	copy(remain, us)
+	total = 0
+	for _, u := range remain {
+		total += upstreamWeight(u)
+	}
+	groups := make([][]*observedUpstream, 0, len(us))
+	for len(remain) > 0 {
+		n := rand.Intn(total)
+		i := 0
+		for ; n >= upstreamWeight(remain[i]); i++ {
+			n -= upstreamWeight(remain[i])
+		}
+		u := remain[i]
+		total -= upstreamWeight(u)
+		remain = append(remain[:i], remain[i+1:]...)
+		groups = append(groups, []*observedUpstream{u})
+	}
+	return groups
+}
+
+func upstreamWeight(u *observedUpstream) int {
+	if u.weight > 0 {
+		return u.weight
+	}
+	return 1
+}
+
+type upstreamWrapper struct {
+	address string
+	trusted bool
+	u       upstream.Upstream
+}
+
+func (u *upstreamWrapper) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return u.u.ExchangeContext(ctx, q)
+}
+
+func (u *upstreamWrapper) Address() string {
+	return u.address
+}
+
+func (u *upstreamWrapper) Trusted() bool {
+	return u.trusted
+}
+
+// observedUpstream records the response time and the health
+// of its Upstream. It also limits the concurrent queries.
+type observedUpstream struct {
+	bundled_upstream.Upstream
+
+	sem      chan struct{} // nil if concurrent queries are unlimited
+	failures uint32        // atomic, consecutive health check failures
+	weight   int           // 0 if not set, see groupByWeight
+}
+
+func newObservedUpstream(u bundled_upstream.Upstream, maxConcurrent int) *observedUpstream {
+	ou := &observedUpstream{Upstream: u}
+	if maxConcurrent > 0 {
+		ou.sem = make(chan struct{}, maxConcurrent)
+	}
+	return ou
+}
+
+func (u *observedUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.sem != nil {
+		select {
+		case u.sem <- struct{}{}:
+			defer func() { <-u.sem }()
+		case <-ctx.Done(): // waited too long
+			return nil, ctx.Err()
+		}
+	}
+
+	metrics.upstreamInflight(u.Address(), 1)
+	defer metrics.upstreamInflight(u.Address(), -1)
+	start := time.Now()
+	r, err := u.Upstream.Exchange(ctx, q)
+	if !errors.Is(err, context.Canceled) { // canceled by us, not an upstream failure.
+		d := time.Since(start)
+		metrics.observeUpstream(u.Address(), q, d, err)
+		rttStats.observe(u.Address(), d, err)
+	}
+	return r, err
+}
+
+// udpmeUpstream is a udp upstream that ignores responses without edns0.
+// Most of the fake responses injected by dns poisoners have no edns0.
+// Truncated responses will be retried over tcp.
+type udpmeUpstream struct {
+	addr    string
+	trusted bool
+	bind    *bindConfig // nil if not bound
+}
+
+func newUDPME(addr string, trusted bool, bind *bindConfig) *udpmeUpstream {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &udpmeUpstream{addr: addr, trusted: trusted, bind: bind}
+}
+
+func (u *udpmeUpstream) Address() string {
+	return u.addr
+}
+
+func (u *udpmeUpstream) Trusted() bool {
+	return u.trusted
+}
+
+func (u *udpmeUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		ddl = time.Now().Add(time.Second * 3)
+	}
+
+	if m.IsEdns0() != nil {
+		return u.exchangeOPTM(m, ddl)
+	}
+	mc := m.Copy()
+	mc.SetEdns0(512, false)
+	r, err := u.exchangeOPTM(mc, ddl)
+	if err != nil {
+		return nil, err
+	}
+	dnsutils.RemoveEDNS0(r)
+	return r, nil
+}
+
+func (u *udpmeUpstream) exchangeOPTM(m *dns.Msg, ddl time.Time) (*dns.Msg, error) {
+	c, err := u.dial("udp")
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(ddl)
+	if opt := m.IsEdns0(); opt != nil {
+		c.UDPSize = opt.UDPSize()
+	}
+
+	if err := c.WriteMsg(m); err != nil {
+		return nil, err
+	}
+
+	for {
+		r, err := c.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if r.IsEdns0() == nil {
+			continue
+		}
+		if r.Truncated {
+			return u.exchangeTCP(m, ddl)
+		}
+		return r, nil
+	}
+}
+
+// exchangeTCP retries a truncated query over tcp.
+func (u *udpmeUpstream) exchangeTCP(m *dns.Msg, ddl time.Time) (*dns.Msg, error) {
+	c, err := u.dial("tcp")
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(ddl)
+
+	if err := c.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	return c.ReadMsg()
+}
+
+func (u *udpmeUpstream) dial(network string) (*dns.Conn, error) {
+	c, err := u.bind.dialer(network, nil).Dial(network, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: c}, nil
+}
@@ -0,0 +1,80 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+// testUpstream is a bundled_upstream.Upstream that answers queries
+// with f.
+type testUpstream struct {
+	addr string
+	f    func(q *dns.Msg) (*dns.Msg, error)
+}
+
+func (u *testUpstream) Exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return u.f(q)
+}
+
+func (u *testUpstream) Address() string {
+	return u.addr
+}
+
+func (u *testUpstream) Trusted() bool {
+	return false
+}
+
+func Test_groupByWeight(t *testing.T) {
+	newUpstreams := func(weights ...int) []*observedUpstream {
+		us := make([]*observedUpstream, 0, len(weights))
+		for _, w := range weights {
+			ou := newObservedUpstream(&testUpstream{}, 0)
+			ou.weight = w
+			us = append(us, ou)
+		}
+		return us
+	}
+
+	us := newUpstreams(0, 0, 0)
+	if groups := groupByWeight(us); len(groups) != 1 || len(groups[0]) != 3 {
+		t.Fatalf("upstreams without weights should be in one group, got %d groups", len(groups))
+	}
+
+	us = newUpstreams(3, 0)
+	const n = 10000
+	first := 0
+	for i := 0; i < n; i++ {
+		groups := groupByWeight(us)
+		if len(groups) != 2 || len(groups[0]) != 1 || len(groups[1]) != 1 {
+			t.Fatalf("weighted upstreams should be in groups of one, got %v", groups)
+		}
+		if groups[0][0] == groups[1][0] {
+			t.Fatal("upstream selected twice")
+		}
+		if groups[0][0] == us[0] {
+			first++
+		}
+	}
+	// us[0] should be selected first with the probability of 3/4.
+	if first < n*70/100 || first > n*80/100 {
+		t.Fatalf("upstream of weight 3 selected first %d times in %d", first, n)
+	}
+}
@@ -0,0 +1,84 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"strings"
+)
+
+// splitDATEntry splits a "file.dat:tag" entry. ok is false if s
+// is a plain text file.
+func splitDATEntry(s string) (file, tag string, ok bool) {
+	tmp := strings.SplitN(s, ":", 2)
+	if len(tmp) != 2 {
+		return "", "", false
+	}
+	return tmp[0], tmp[1], true
+}
+
+// geoSiteTagError returns err, the error of loading the
+// "geosite.dat:tag[@attr]" entry s. If the tag doesn't exist, it
+// returns an error that lists the available tags instead. The loader
+// keeps the parsed file for a while, so it isn't parsed again.
+func geoSiteTagError(s string, err error) error {
+	file, tag, _ := splitDATEntry(s)
+	l, lerr := domain.LoadGeoSiteList(file)
+	if lerr != nil {
+		return err
+	}
+	tags := make([]string, 0, len(l.GetEntry()))
+	for _, e := range l.GetEntry() {
+		tags = append(tags, e.CountryCode)
+	}
+	if terr := checkTag(file, strings.SplitN(tag, "@", 2)[0], tags); terr != nil {
+		return terr
+	}
+	return err
+}
+
+// geoIPTagError is geoSiteTagError for "geoip.dat:tag" entries.
+func geoIPTagError(s string, err error) error {
+	file, tag, _ := splitDATEntry(s)
+	l, lerr := netlist.LoadGeoIPListFromDAT(file)
+	if lerr != nil {
+		return err
+	}
+	tags := make([]string, 0, len(l.GetEntry()))
+	for _, e := range l.GetEntry() {
+		tags = append(tags, e.CountryCode)
+	}
+	if terr := checkTag(file, tag, tags); terr != nil {
+		return terr
+	}
+	return err
+}
+
+func checkTag(file, tag string, tags []string) error {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return nil
+		}
+	}
+	for i := range tags {
+		tags[i] = strings.ToLower(tags[i])
+	}
+	return fmt.Errorf("can not find tag %s in %s, available tags: %s", tag, file, strings.Join(tags, ", "))
+}
@@ -0,0 +1,104 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/v2data"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestGeoSite writes a geosite.dat with a "cn" category that has
+// the domain "example.cn" and returns its path.
+func writeTestGeoSite(t *testing.T) string {
+	t.Helper()
+	l := &v2data.GeoSiteList{Entry: []*v2data.GeoSite{{
+		CountryCode: "CN",
+		Domain:      []*v2data.Domain{{Type: v2data.Domain_Domain, Value: "example.cn"}},
+	}}}
+	b, err := proto.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(t.TempDir(), "geosite.dat")
+	if err := os.WriteFile(f, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func Test_loadDomainMatcher_geosite(t *testing.T) {
+	m, err := loadDomainMatcher([]string{writeTestGeoSite(t) + ":cn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"example.cn.": true, "www.example.cn.": true, "example.com.": false} {
+		if _, ok := m.Match(name); ok != want {
+			t.Fatalf("%s matched = %v, want %v", name, ok, want)
+		}
+	}
+}
+
+// writeTestGeoIP writes a geoip.dat with a "cn" tag that has
+// 1.2.3.0/24 and returns its path.
+func writeTestGeoIP(t *testing.T) string {
+	t.Helper()
+	l := &v2data.GeoIPList{Entry: []*v2data.GeoIP{{
+		CountryCode: "CN",
+		Cidr:        []*v2data.CIDR{{Ip: []byte{1, 2, 3, 0}, Prefix: 24}},
+	}}}
+	b, err := proto.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(f, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func Test_geoTagError(t *testing.T) {
+	geosite, geoip := writeTestGeoSite(t), writeTestGeoIP(t)
+	if _, err := newIPList([]string{geoip + ":cn"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		load func() error
+	}{
+		{"geosite", func() error { _, err := loadDomainMatcher([]string{geosite + ":nope"}); return err }},
+		{"geosite attr", func() error { _, err := loadDomainMatcher([]string{geosite + ":nope@ads"}); return err }},
+		{"geoip", func() error { _, err := newIPList([]string{geoip + ":nope"}); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.load()
+			if err == nil {
+				t.Fatal("unknown tag should be rejected")
+			}
+			if !strings.Contains(err.Error(), "can not find tag nope") || !strings.Contains(err.Error(), "available tags: cn") {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/concurrent_lru"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	geoIPCacheShards       = 16
+	geoIPCacheSizePerShard = 1024
+)
+
+// geoIPDB is a netlist.Matcher that matches the ips located in some
+// countries by a MaxMind mmdb database, e.g. GeoLite2-Country.mmdb. The
+// results are cached per ip. An ip that is not in the database doesn't
+// match. It can be reloaded.
+type geoIPDB struct {
+	file      string
+	countries map[string]struct{} // upper case ISO 3166-1 codes
+
+	mu    sync.RWMutex
+	db    *maxminddb.Reader
+	cache *concurrent_lru.ConcurrentLRU
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+func newGeoIPDB(file string, countries []string) (*geoIPDB, error) {
+	g := &geoIPDB{file: file, countries: make(map[string]struct{})}
+	for _, c := range countries {
+		if len(c) != 2 {
+			return nil, fmt.Errorf("invalid country code %s", c)
+		}
+		g.countries[strings.ToUpper(c)] = struct{}{}
+	}
+	if err := g.reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *geoIPDB) reload() error {
+	db, err := maxminddb.Open(g.file)
+	if err != nil {
+		return fmt.Errorf("failed to open geoip database %s, %w", g.file, err)
+	}
+	mlog.S().Infof("geoip database %s loaded, type: %s, nodes: %d", g.file, db.Metadata.DatabaseType, db.Metadata.NodeCount)
+	g.mu.Lock()
+	old := g.db
+	g.db = db
+	g.cache = concurrent_lru.NewConcurrentLRU(geoIPCacheShards, geoIPCacheSizePerShard, nil, nil)
+	g.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (g *geoIPDB) sourceFiles() []string {
+	return []string{g.file}
+}
+
+func (g *geoIPDB) Match(ip net.IP) (bool, error) {
+	key := string(ip.To16())
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if v, ok := g.cache.Get(key); ok {
+		return v.(bool), nil
+	}
+	var rec geoIPRecord
+	if err := g.db.Lookup(ip, &rec); err != nil {
+		// Not likely, the database may be broken. Treat the ip as unknown.
+		mlog.L().Debug("geoip lookup failed", zap.Stringer("ip", ip), zap.Error(err))
+		return false, nil
+	}
+	code := rec.Country.ISOCode
+	if len(code) == 0 {
+		code = rec.RegisteredCountry.ISOCode
+	}
+	_, ok := g.countries[code]
+	g.cache.Add(key, ok)
+	return ok, nil
+}
+
+// anyIPMatcher matches an ip if any of its matchers matches it.
+type anyIPMatcher []netlist.Matcher
+
+func (m anyIPMatcher) Match(ip net.IP) (bool, error) {
+	for _, l := range m {
+		ok, err := l.Match(ip)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// localCountries returns the countries of --local-country, CN by default.
+func localCountries() []string {
+	if len(opt.LocalCountry) == 0 {
+		return []string{"CN"}
+	}
+	return opt.LocalCountry
+}
@@ -0,0 +1,195 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// upstreamGroup is a named group of upstreams. Queries of its domains
+// are forwarded to its upstreams.
+type upstreamGroup struct {
+	name      string
+	upstreams []string
+	domains   []string
+}
+
+// parseGroups parses the "name=upstream" args of --group and the
+// "name=file" args of --group-domain. Groups are returned in the order
+// of their first --group-domain, which is the order they are matched.
+func parseGroups(groups, groupDomains []string) ([]*upstreamGroup, error) {
+	m := make(map[string]*upstreamGroup)
+	for _, s := range groups {
+		name, u, ok := strings.Cut(s, "=")
+		if !ok || len(name) == 0 || len(u) == 0 {
+			return nil, fmt.Errorf("invalid group %s, want name=upstream", s)
+		}
+		switch name {
+		case "upstream", "local", "remote":
+			return nil, fmt.Errorf("invalid group %s, %s is a reserved name", s, name)
+		}
+		g := m[name]
+		if g == nil {
+			g = &upstreamGroup{name: name}
+			m[name] = g
+		}
+		g.upstreams = append(g.upstreams, u)
+	}
+
+	var ordered []*upstreamGroup
+	for _, s := range groupDomains {
+		name, f, ok := strings.Cut(s, "=")
+		if !ok || len(name) == 0 || len(f) == 0 {
+			return nil, fmt.Errorf("invalid group domain %s, want name=file", s)
+		}
+		g := m[name]
+		if g == nil {
+			return nil, fmt.Errorf("invalid group domain %s, group %s is not defined by --group", s, name)
+		}
+		if len(g.domains) == 0 {
+			ordered = append(ordered, g)
+		}
+		g.domains = append(g.domains, f)
+	}
+	for name, g := range m {
+		if len(g.domains) == 0 {
+			return nil, fmt.Errorf("group %s has no domain list, use --group-domain to set it", name)
+		}
+	}
+	return ordered, nil
+}
+
+// initGroups returns the routing nodes of the groups. A query that
+// matched the domain list of a group is forwarded to its upstreams and
+// won't be matched by later groups or routing rules. The forwarders of
+// the groups are also returned by their names.
+func initGroups(groups []*upstreamGroup, bogusIP netlist.Matcher) ([]handler.Executable, map[string]handler.Executable, error) {
+	nodes := make([]handler.Executable, 0, len(groups))
+	forwarders := make(map[string]handler.Executable, len(groups))
+	for _, g := range groups {
+		if len(g.upstreams) == 0 {
+			return nil, nil, errors.New("inner err, group has no upstream")
+		}
+		f, err := initForwarder(g.name, g.upstreams, false, bogusIP)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to init upstream of group %s, %w", g.name, err)
+		}
+		forwarders[g.name] = f
+		l, err := newDomainList(g.domains)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load domain file of group %s, %w", g.name, err)
+		}
+		registerReloadable("group "+g.name+" domain", l)
+		mlog.S().Infof("group %s domain files loaded, total length: %d", g.name, l.Len())
+
+		innerNode := handler.WrapExecutable(f)
+		innerNode.LinkNext(handler.WrapExecutable(&end{}))
+		nodes = append(nodes, &executable_seq.IfNode{
+			ConditionMatcher: traceMatcher("matched group "+g.name, msg_matcher.NewQNameMatcher(l)),
+			ExecutableNode:   innerNode,
+		})
+	}
+	return nodes, forwarders, nil
+}
+
+// domainPin forwards queries of a domain and its subdomains to its
+// upstreams, e.g. an internal zone to an internal dns server.
+type domainPin struct {
+	domain    string
+	upstreams []string
+}
+
+// parseDomainPins parses the "domain=upstream" args of --domain-upstream.
+// Pins are returned with the most specific domain first, so a pin of
+// a subdomain wins over the pin of its parent domain.
+func parseDomainPins(ss []string) ([]*domainPin, error) {
+	m := make(map[string]*domainPin)
+	var pins []*domainPin
+	for _, s := range ss {
+		d, u, ok := strings.Cut(s, "=")
+		if !ok || len(d) == 0 || len(u) == 0 {
+			return nil, fmt.Errorf("invalid domain upstream %s, want domain=upstream", s)
+		}
+		d, err := ruleToASCII(strings.ToLower(strings.TrimSuffix(d, ".")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain upstream %s, %w", s, err)
+		}
+		if _, ok := dns.IsDomainName(d); !ok {
+			return nil, fmt.Errorf("invalid domain upstream %s, %s is not a valid domain", s, d)
+		}
+		p := m[d]
+		if p == nil {
+			p = &domainPin{domain: d}
+			m[d] = p
+			pins = append(pins, p)
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+	sort.SliceStable(pins, func(i, j int) bool {
+		return dns.CountLabel(pins[i].domain) > dns.CountLabel(pins[j].domain)
+	})
+	return pins, nil
+}
+
+func (p *domainPin) name() string {
+	return "pin:" + p.domain
+}
+
+func (p *domainPin) matcher() (domain.Matcher[struct{}], error) {
+	m := newRulesMatcher()
+	if err := m.Add("domain:"+p.domain, struct{}{}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// initDomainPins returns the routing nodes of the pins. A query that
+// matched a pin is forwarded to its upstreams and won't be matched by
+// any other routing rule.
+func initDomainPins(pins []*domainPin, bogusIP netlist.Matcher) ([]handler.Executable, error) {
+	nodes := make([]handler.Executable, 0, len(pins))
+	for _, p := range pins {
+		f, err := initForwarder(p.name(), p.upstreams, false, bogusIP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init upstream of %s, %w", p.domain, err)
+		}
+		m, err := p.matcher()
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned domain %s, %w", p.domain, err)
+		}
+		mlog.S().Infof("queries of %s are forwarded to %s", p.domain, strings.Join(p.upstreams, ", "))
+
+		innerNode := handler.WrapExecutable(f)
+		innerNode.LinkNext(handler.WrapExecutable(&end{}))
+		nodes = append(nodes, &executable_seq.IfNode{
+			ConditionMatcher: traceMatcher("matched --domain-upstream "+p.domain, msg_matcher.NewQNameMatcher(m)),
+			ExecutableNode:   innerNode,
+		})
+	}
+	return nodes, nil
+}
@@ -0,0 +1,207 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"net"
+	"sync"
+)
+
+// grpcServer serves the DnsService in proto/dns.proto.
+type grpcServer struct {
+	handler       dns_handler.Handler
+	maxConcurrent int // of each stream
+	logger        *zap.Logger
+	s             *grpc.Server
+}
+
+// newGRPCServer returns a grpc server. tlsConfig can be nil.
+func newGRPCServer(h dns_handler.Handler, tlsConfig *tls.Config, maxConcurrent int, logger *zap.Logger) (*grpcServer, error) {
+	gs := &grpcServer{handler: h, maxConcurrent: maxConcurrent, logger: logger}
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(dnsMessageCodec{})}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	gs.s = grpc.NewServer(opts...)
+	gs.s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "mosdns_cn.DnsService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Query",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(dnsMessage)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return gs.query(ctx, req)
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "QueryStream",
+			Handler:       func(_ interface{}, stream grpc.ServerStream) error { return gs.queryStream(stream) },
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+		Metadata: "proto/dns.proto",
+	}, gs)
+	return gs, nil
+}
+
+func (gs *grpcServer) serve(l net.Listener) error {
+	return gs.s.Serve(l)
+}
+
+// Close stops the server and closes all connections.
+func (gs *grpcServer) Close() error {
+	gs.s.Stop()
+	return nil
+}
+
+func (gs *grpcServer) query(ctx context.Context, req *dnsMessage) (*dnsMessage, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(req.msg); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid dns message, %v", err)
+	}
+
+	meta := new(handler.RequestMeta)
+	if p, ok := peer.FromContext(ctx); ok {
+		meta.ClientIP = utils.GetIPFromAddr(p.Addr)
+	}
+	w := new(grpcResponseWriter)
+	if err := gs.handler.ServeDNS(ctx, q, w, meta); err != nil {
+		gs.logger.Warn("handler err", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if w.b == nil {
+		return nil, status.Error(codes.Unavailable, "query is dropped")
+	}
+	return &dnsMessage{msg: w.b}, nil
+}
+
+func (gs *grpcServer) queryStream(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	sem := make(chan struct{}, gs.maxConcurrent)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var sendMu sync.Mutex
+	for {
+		req := new(dnsMessage)
+		if err := stream.RecvMsg(req); err != nil {
+			return nil // io.EOF or the stream is broken
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r, err := gs.query(ctx, req)
+			if err != nil {
+				return // the client will time out
+			}
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			if err := stream.SendMsg(r); err != nil {
+				gs.logger.Debug("failed to send response", zap.Error(err))
+			}
+		}()
+	}
+}
+
+type grpcResponseWriter struct {
+	b []byte
+}
+
+func (w *grpcResponseWriter) Write(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.b = b
+	return nil
+}
+
+// dnsMessage is the DnsMessage in proto/dns.proto. It only has one bytes
+// field, so it is encoded by dnsMessageCodec instead of generated code.
+type dnsMessage struct {
+	msg []byte
+}
+
+type dnsMessageCodec struct{}
+
+func (dnsMessageCodec) Name() string {
+	return "proto"
+}
+
+func (dnsMessageCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(*dnsMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, m.msg), nil
+}
+
+func (dnsMessageCodec) Unmarshal(b []byte, v interface{}) error {
+	m, ok := v.(*dnsMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == 1 && typ == protowire.BytesType {
+			msg, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			m.msg = append(m.msg[:0], msg...)
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b) // skip unknown fields
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
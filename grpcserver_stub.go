@@ -0,0 +1,44 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !grpc
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"go.uber.org/zap"
+	"net"
+)
+
+// grpcServer is not available. The grpc server is only built with
+// `-tags grpc`, so the binary stays small when it is not used.
+type grpcServer struct{}
+
+func newGRPCServer(_ dns_handler.Handler, _ *tls.Config, _ int, _ *zap.Logger) (*grpcServer, error) {
+	return nil, errors.New("grpc server is not supported by this build, rebuild it with `-tags grpc`")
+}
+
+func (gs *grpcServer) serve(_ net.Listener) error {
+	return nil
+}
+
+func (gs *grpcServer) Close() error {
+	return nil
+}
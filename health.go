@@ -0,0 +1,150 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// An upstream is unhealthy after healthCheckMaxFailures
+	// consecutive failed health checks.
+	healthCheckMaxFailures = 3
+	healthCheckTimeout     = time.Second * 5
+)
+
+var errServerFailure = errors.New("server failure")
+
+func (u *observedUpstream) healthy() bool {
+	return atomic.LoadUint32(&u.failures) < healthCheckMaxFailures
+}
+
+// healthyUpstreams returns the healthy upstreams and the trusted ones
+// among them. If all trusted upstreams are unhealthy, the first healthy
+// upstream will be trusted instead. If all upstreams are unhealthy,
+// all of them will be returned.
+func (f *forwarder) healthyUpstreams() ([]*observedUpstream, []*observedUpstream) {
+	us := make([]*observedUpstream, 0, len(f.us))
+	hasTrusted := false
+	var trusted []*observedUpstream
+	for _, u := range f.us {
+		if u.Trusted() {
+			hasTrusted = true
+		}
+		if !u.healthy() {
+			continue
+		}
+		if u.Trusted() {
+			trusted = append(trusted, u)
+		}
+		us = append(us, u)
+	}
+	if len(us) == 0 {
+		us = f.us
+	}
+	if hasTrusted && len(trusted) == 0 {
+		trusted = us[:1]
+	}
+	return us, trusted
+}
+
+// startHealthCheck sends a query of domain to all upstreams every interval.
+// Upstreams that failed the check healthCheckMaxFailures times in a row
+// will be skipped until they pass a check again.
+func (f *forwarder) startHealthCheck(interval time.Duration, domain string) {
+	if len(f.us) < 2 { // nothing to fall back to
+		return
+	}
+	timeout := healthCheckTimeout
+	if interval < timeout {
+		timeout = interval
+	}
+	f.healthChecked = true
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, u := range f.us {
+				go f.checkHealth(u, domain, timeout)
+			}
+		}
+	}()
+}
+
+func (f *forwarder) checkHealth(u *observedUpstream, domain string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	r, err := u.Upstream.Exchange(ctx, q) // don't observe health check queries.
+	if err == nil && r.Rcode == dns.RcodeServerFailure {
+		err = errServerFailure
+	}
+
+	if err != nil {
+		if atomic.AddUint32(&u.failures, 1) == healthCheckMaxFailures {
+			f.logger.Warn("upstream is unhealthy", zap.String("upstream", u.Address()), zap.Error(err))
+		}
+		return
+	}
+	if atomic.SwapUint32(&u.failures, 0) >= healthCheckMaxFailures {
+		f.logger.Info("upstream is healthy again", zap.String("upstream", u.Address()))
+	}
+}
+
+// reachable returns an error if no upstream of f is usable. If health
+// checks are running, their results are used. Otherwise all upstreams
+// are queried and it returns nil once any of them responded.
+func (f *forwarder) reachable(domain string) error {
+	if f.healthChecked {
+		for _, u := range f.us {
+			if u.healthy() {
+				return nil
+			}
+		}
+		return errors.New("all upstreams are unhealthy")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	errs := make(chan error, len(f.us))
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	for _, u := range f.us {
+		u := u
+		go func() {
+			r, err := u.Upstream.Exchange(ctx, q.Copy())
+			if err == nil && r.Rcode == dns.RcodeServerFailure {
+				err = errServerFailure
+			}
+			errs <- err
+		}()
+	}
+	var err error
+	for range f.us {
+		if err = <-errs; err == nil {
+			return nil
+		}
+	}
+	return err
+}
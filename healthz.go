@@ -0,0 +1,97 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthzCheckTTL is how long the result of a readiness check is reused,
+// so frequent probes won't flood the upstreams.
+const healthzCheckTTL = time.Second * 10
+
+var healthzAPI = new(healthzHandler)
+
+// healthzHandler serves /healthz. It returns 200 if the server is started
+// and the upstream, local and remote forwarders each have at least one
+// reachable upstream. Otherwise it returns 503. Forwarders of --group and
+// --domain-upstream are not checked.
+type healthzHandler struct {
+	domain string
+
+	mu         sync.Mutex
+	h          *gracefulHandler // nil until all servers are started
+	forwarders []*forwarder
+	checkedAt  time.Time
+	lastErr    error
+}
+
+func (z *healthzHandler) addForwarder(f *forwarder) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.forwarders = append(z.forwarders, f)
+}
+
+// setReady marks the server as started. h is used to tell
+// whether the server is shutting down.
+func (z *healthzHandler) setReady(h *gracefulHandler) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.h = h
+}
+
+func (z *healthzHandler) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", z)
+	return mux
+}
+
+func (z *healthzHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := z.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (z *healthzHandler) check() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.h == nil {
+		return fmt.Errorf("server is starting")
+	}
+	if z.h.isClosing() {
+		return errShuttingDown
+	}
+	if time.Since(z.checkedAt) < healthzCheckTTL {
+		return z.lastErr
+	}
+
+	z.lastErr = nil
+	for _, f := range z.forwarders {
+		if err := f.reachable(z.domain); err != nil {
+			z.lastErr = fmt.Errorf("%s upstreams are unreachable, %w", f.name, err)
+			break
+		}
+	}
+	z.checkedAt = time.Now()
+	return z.lastErr
+}
@@ -0,0 +1,122 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"golang.org/x/net/idna"
+	"strings"
+	"unicode/utf8"
+)
+
+// idnaMatcher is a domain.Matcher that converts internationalized domain
+// names in rules and queries to punycode (e.g. "xn--fiqs8s"), so the
+// unicode and punycode forms of a name match the same rules.
+type idnaMatcher[T any] struct {
+	domain.Matcher[T]
+}
+
+func (m idnaMatcher[T]) Add(s string, v T) error {
+	s, err := ruleToASCII(s)
+	if err != nil {
+		return err
+	}
+	return m.Matcher.Add(s, v)
+}
+
+func (m idnaMatcher[T]) Match(s string) (v T, ok bool) {
+	return m.Matcher.Match(nameToASCII(s))
+}
+
+// ruleToASCII converts the domain of a full or domain rule, which may
+// be a wildcard "*.example", to punycode. Keyword and regexp rules
+// are matched against the punycode form as is.
+func ruleToASCII(s string) (string, error) {
+	typ, pattern := "", s
+	if i := strings.IndexByte(s, ':'); i > 0 {
+		typ, pattern = s[:i+1], s[i+1:]
+	}
+	if typ != "" && typ != "full:" && typ != "domain:" {
+		return s, nil
+	}
+	wildcard := ""
+	if strings.HasPrefix(pattern, "*.") {
+		wildcard, pattern = "*.", pattern[2:]
+	}
+	if isASCII(pattern) {
+		return s, nil
+	}
+	a, err := idna.Lookup.ToASCII(strings.TrimSuffix(pattern, "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %s, %w", pattern, err)
+	}
+	return typ + wildcard + a, nil
+}
+
+// nameToASCII converts the qname s to punycode. Non-ascii bytes in qnames
+// are escaped as "\DDD" by the dns package. s is returned as is if it is
+// not a valid internationalized domain name.
+func nameToASCII(s string) string {
+	if isASCII(s) && strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	u := unescapeName(s)
+	if isASCII(u) || !utf8.ValidString(u) {
+		return s
+	}
+	a, err := idna.Lookup.ToASCII(strings.TrimSuffix(u, "."))
+	if err != nil {
+		return s
+	}
+	return a
+}
+
+// unescapeName decodes the "\DDD" and "\X" escapes in s.
+func unescapeName(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			if n := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0'); n <= 255 {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return string(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_idnaMatcher(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "list.txt")
+	rules := "例子.中国\nfull:测试\n"
+	if err := os.WriteFile(file, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadDomainMatcher([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		qname string
+		want  bool
+	}{
+		{"xn--fsqu00a.xn--fiqs8s.", true},
+		{"XN--FSQU00A.xn--fiqs8s.", true},
+		{"www.xn--fsqu00a.xn--fiqs8s.", true},
+		{"xn--0zwm56d.", true},
+		{"www.xn--0zwm56d.", false},
+		{"xn--fiqs8s.", false},
+		{"example.com.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			if _, ok := m.Match(dns.CanonicalName(tt.qname)); ok != tt.want {
+				t.Fatalf("Match(%s) = %v, want %v", tt.qname, ok, tt.want)
+			}
+		})
+	}
+
+	// Unicode qnames are escaped by the dns package.
+	q := new(dns.Msg)
+	q.SetQuestion("例子.中国.", dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Match(q.Question[0].Name); !ok {
+		t.Fatalf("Match(%s) = false, want true", q.Question[0].Name)
+	}
+}
+
+func Test_ruleToASCII(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"例子.中国", "xn--fsqu00a.xn--fiqs8s"},
+		{"full:例子.中国", "full:xn--fsqu00a.xn--fiqs8s"},
+		{"domain:*.中国", "domain:*.xn--fiqs8s"},
+		{"keyword:中国", "keyword:中国"},
+		{"example.com", "example.com"},
+	}
+	for _, tt := range tests {
+		got, err := ruleToASCII(tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Fatalf("ruleToASCII(%s) = %s, want %s", tt.rule, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+)
+
+// queryValidator answers NOTIMP to queries of opcodes other than QUERY,
+// and FORMERR to queries without exactly one question. If drop is set,
+// they are dropped instead. Responses sent to the server are always
+// dropped, replying them may cause loops.
+type queryValidator struct {
+	drop   bool
+	logger *zap.Logger
+}
+
+func (v *queryValidator) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	rcode := dns.RcodeSuccess
+	switch {
+	case q.Response:
+		v.logger.Debug("response dropped", qCtx.InfoField())
+		qCtx.SetResponse(nil, handler.ContextStatusDropped)
+		return nil
+	case q.Opcode != dns.OpcodeQuery:
+		rcode = dns.RcodeNotImplemented
+	case len(q.Question) != 1:
+		rcode = dns.RcodeFormatError
+	default:
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+
+	v.logger.Debug("invalid query", qCtx.InfoField(), zap.Int("opcode", q.Opcode), zap.Int("questions", len(q.Question)))
+	if v.drop {
+		qCtx.SetResponse(nil, handler.ContextStatusDropped)
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, rcode)
+	qCtx.SetResponse(r, handler.ContextStatusRejected)
+	return nil
+}
+
+// malformedQueryReply returns a FORMERR response to b, a query that
+// cannot be unpacked. The id, opcode and RD flag are copied from its
+// header, as far as it has one. It returns nil if b has no id or is
+// a response.
+func malformedQueryReply(b []byte) []byte {
+	if len(b) < 2 || len(b) > 2 && b[2]&0x80 != 0 {
+		return nil
+	}
+	r := make([]byte, 12)
+	copy(r, b[:2])
+	r[2] = 0x80 // QR
+	if len(b) > 2 {
+		r[2] |= b[2] & 0x79 // opcode and RD
+	}
+	r[3] = dns.RcodeFormatError
+	return r
+}
+
+// malformedReplyPacketConn answers FORMERR to the malformed queries read
+// from it. Udp servers drop them silently. Each query is unpacked here
+// once more, so it is only used when FORMERR is wanted.
+type malformedReplyPacketConn struct {
+	net.PacketConn
+	logger *zap.Logger
+}
+
+func (c *malformedReplyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		unpackErr := new(dns.Msg).Unpack(b[:n])
+		if unpackErr == nil {
+			return n, addr, nil
+		}
+		c.logger.Debug("malformed query", zap.Stringer("from", addr), zap.Error(unpackErr))
+		if r := malformedQueryReply(b[:n]); r != nil {
+			c.PacketConn.WriteTo(r, addr)
+		}
+	}
+}
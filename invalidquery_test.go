@@ -0,0 +1,151 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+	"time"
+)
+
+// malformedPackets are queries that must be answered with FORMERR.
+var malformedPackets = []struct {
+	name string
+	b    []byte
+}{
+	{"id only", []byte{0x12, 0x34}},
+	{"truncated header", []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01}},
+	{"truncated question", []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 'c', 'o'}},
+	{"pointer out of range", []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0xff, 0x00, 0x01, 0x00, 0x01}},
+	{"pointer loop", []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01}},
+	{"label too long", append(append([]byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40}, make([]byte, 64)...), 0x00, 0x00, 0x01, 0x00, 0x01)},
+	{"qdcount 0", []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	{"qdcount 2", func() []byte {
+		q := new(dns.Msg)
+		q.Id = 0x1234
+		q.Question = []dns.Question{{Name: "a.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, {Name: "b.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+		b, _ := q.Pack()
+		return b
+	}()},
+}
+
+// newTestServerHandler returns the dns handler of the servers with the
+// queryValidator in front of a testResponder.
+func newTestServerHandler() dns_handler.Handler {
+	return &dns_handler.DefaultHandler{
+		Logger:       zap.NewNop(),
+		Entry:        linkChain(&queryValidator{logger: zap.NewNop()}, &testResponder{}),
+		QueryTimeout: time.Second,
+	}
+}
+
+func checkFormErr(t *testing.T, b []byte) {
+	t.Helper()
+	if len(b) < 12 {
+		t.Fatalf("reply is too short, %x", b)
+	}
+	if id := uint16(b[0])<<8 | uint16(b[1]); id != 0x1234 {
+		t.Fatalf("reply id = %x, want 1234", id)
+	}
+	if b[2]&0x80 == 0 {
+		t.Fatal("QR is not set")
+	}
+	if rcode := b[3] & 0x0f; rcode != dns.RcodeFormatError {
+		t.Fatalf("rcode = %s, want FORMERR", dns.RcodeToString[int(rcode)])
+	}
+}
+
+func Test_malformedQuery_udp(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server.Server{DNSHandler: newTestServerHandler(), Logger: zap.NewNop()}
+	defer s.Close()
+	go s.ServeUDP(&malformedReplyPacketConn{PacketConn: c, logger: zap.NewNop()})
+
+	for _, p := range malformedPackets {
+		t.Run(p.name, func(t *testing.T) {
+			cc, err := net.Dial("udp", c.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cc.Close()
+			if _, err := cc.Write(p.b); err != nil {
+				t.Fatal(err)
+			}
+			cc.SetReadDeadline(time.Now().Add(time.Second))
+			b := make([]byte, dns.MaxMsgSize)
+			n, err := cc.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFormErr(t, b[:n])
+		})
+	}
+}
+
+func Test_malformedQuery_tcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTCPServer(newTestServerHandler(), 8, zap.NewNop())
+	s.replyMalformed = true
+	defer s.Close()
+	go s.serve(l)
+
+	// All packets are sent on one connection, which must survive them.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, p := range malformedPackets {
+		t.Run(p.name, func(t *testing.T) {
+			if _, err := dnsutils.WriteRawMsgToTCP(c, p.b); err != nil {
+				t.Fatal(err)
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			b, _, err := dnsutils.ReadRawMsgFromTCP(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Release()
+			checkFormErr(t, b.Bytes())
+		})
+	}
+}
+
+func Test_malformedQueryReply(t *testing.T) {
+	for _, b := range [][]byte{nil, {0x12}, {0x12, 0x34, 0x80}} {
+		if r := malformedQueryReply(b); r != nil {
+			t.Fatalf("malformedQueryReply(%x) = %x, want nil", b, r)
+		}
+	}
+	r := malformedQueryReply([]byte{0x12, 0x34, 0x29, 0x00, 0x00})
+	checkFormErr(t, r)
+	if r[2] != 0x80|0x29 {
+		t.Fatalf("flags = %x, want opcode and RD copied", r[2])
+	}
+}
@@ -0,0 +1,220 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyProbeTTL is how long a probe result is used before the
+	// address is probed again.
+	latencyProbeTTL = time.Minute * 10
+	// latencyProbeTimeout is the timeout of a probe. Addresses that
+	// failed the probe are sorted last.
+	latencyProbeTimeout = time.Second
+	// maxLatencyProbes limits the number of concurrent probes. New
+	// addresses are not probed while it is reached, they will be probed
+	// when they are seen in a later response.
+	maxLatencyProbes = 16
+	// maxLatencyResults limits the number of cached probe results.
+	maxLatencyResults = 65536
+)
+
+// latencySorter sorts the A and AAAA records in responses by the tcp
+// connect latency of their addresses, fastest first. Addresses are
+// probed in the background, so responses are never delayed. Addresses
+// that are not probed yet are sorted after the probed ones that are
+// reachable, in their original order. If keep > 0, only the first keep
+// records of each type are returned.
+// Like rrRotator, it runs after the cache, so the cached entry is
+// never changed.
+type latencySorter struct {
+	port   string
+	keep   int
+	logger *zap.Logger
+
+	probeSem chan struct{}
+
+	mu      sync.Mutex
+	results map[string]latencyResult // key is the ip string
+	probing map[string]struct{}
+}
+
+type latencyResult struct {
+	latency time.Duration
+	failed  bool
+	expire  time.Time
+}
+
+func newLatencySorter(port, keep int, logger *zap.Logger) *latencySorter {
+	return &latencySorter{
+		port:     strconv.Itoa(port),
+		keep:     keep,
+		logger:   logger,
+		probeSem: make(chan struct{}, maxLatencyProbes),
+		results:  make(map[string]latencyResult),
+		probing:  make(map[string]struct{}),
+	}
+}
+
+func (s *latencySorter) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	err := handler.ExecChainNode(ctx, qCtx, next)
+	if r := qCtx.R(); r != nil && r.Rcode == dns.RcodeSuccess {
+		r.Answer = s.sortRRs(r.Answer, dns.TypeA)
+		r.Answer = s.sortRRs(r.Answer, dns.TypeAAAA)
+	}
+	return err
+}
+
+// sortRRs sorts the records of type t in rrs by latency. Records of
+// other types are not moved.
+func (s *latencySorter) sortRRs(rrs []dns.RR, t uint16) []dns.RR {
+	var idx []int
+	for i, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < 2 {
+		return rrs
+	}
+
+	type rankedRR struct {
+		rr   dns.RR
+		rank time.Duration
+	}
+	ranked := make([]rankedRR, len(idx))
+	for i, j := range idx {
+		ranked[i] = rankedRR{rr: rrs[j], rank: s.rankOf(rrIP(rrs[j]))}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].rank < ranked[j].rank })
+	for i, j := range idx {
+		rrs[j] = ranked[i].rr
+	}
+
+	if s.keep <= 0 || len(idx) <= s.keep {
+		return rrs
+	}
+	drop := make(map[int]struct{}, len(idx)-s.keep)
+	for _, j := range idx[s.keep:] {
+		drop[j] = struct{}{}
+	}
+	o := rrs[:0]
+	for i, rr := range rrs {
+		if _, ok := drop[i]; !ok {
+			o = append(o, rr)
+		}
+	}
+	return o
+}
+
+// rankOf returns the sort key of ip. Unknown addresses rank as
+// latencyProbeTimeout and failed ones rank after them. It starts a
+// probe if ip is unknown or its result expired.
+func (s *latencySorter) rankOf(ip net.IP) time.Duration {
+	if ip == nil {
+		return latencyProbeTimeout
+	}
+	key := ip.String()
+	s.mu.Lock()
+	res, ok := s.results[key]
+	s.mu.Unlock()
+	if !ok || time.Now().After(res.expire) {
+		s.probe(key)
+	}
+	switch {
+	case !ok:
+		return latencyProbeTimeout
+	case res.failed:
+		return latencyProbeTimeout + 1
+	default:
+		return res.latency
+	}
+}
+
+// probe measures the tcp connect latency of ip in the background.
+func (s *latencySorter) probe(ip string) {
+	s.mu.Lock()
+	if _, ok := s.probing[ip]; ok {
+		s.mu.Unlock()
+		return
+	}
+	select {
+	case s.probeSem <- struct{}{}:
+	default:
+		s.mu.Unlock()
+		return
+	}
+	s.probing[ip] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		defer func() { <-s.probeSem }()
+		start := time.Now()
+		c, err := net.DialTimeout("tcp", net.JoinHostPort(ip, s.port), latencyProbeTimeout)
+		res := latencyResult{latency: time.Since(start), expire: time.Now().Add(latencyProbeTTL)}
+		if err != nil {
+			res.failed = true
+			s.logger.Debug("latency probe failed", zap.String("ip", ip), zap.Error(err))
+		} else {
+			c.Close()
+			s.logger.Debug("latency probed", zap.String("ip", ip), zap.Duration("latency", res.latency))
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.probing, ip)
+		if len(s.results) >= maxLatencyResults {
+			s.removeExpired()
+		}
+		if _, ok := s.results[ip]; ok || len(s.results) < maxLatencyResults {
+			s.results[ip] = res
+		}
+	}()
+}
+
+// removeExpired removes expired results. s.mu must be held.
+func (s *latencySorter) removeExpired() {
+	now := time.Now()
+	for ip, res := range s.results {
+		if now.After(res.expire) {
+			delete(s.results, ip)
+		}
+	}
+}
+
+// rrIP returns the address of an A or AAAA record.
+func rrIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// loadListFile reads a domain or ip list file and calls add with the
+// value of each line.
+//
+// "#" starts a comment, which can also follow a value. Blank lines are
+// ignored. A value can be followed by "@tag" attributes, e.g.
+// "example.com @ads". Tags are validated but not used for now.
+//
+// Malformed lines are logged with the file name and line number and
+// skipped, so they don't fail the whole file.
+//
+// file "-" reads the list from stdin, see readStdinList.
+func loadListFile(file string, add func(v string) error) error {
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = readStdinList()
+	} else {
+		b, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	lineNum := 0
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		lineNum++
+		s, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(fields[0], "@") {
+			mlog.S().Warnf("%s:%d: invalid line %q, missing value", file, lineNum, s)
+			continue
+		}
+		if _, err := parseListTags(fields[1:]); err != nil {
+			mlog.S().Warnf("%s:%d: invalid line %q, %v", file, lineNum, s, err)
+			continue
+		}
+		if err := add(fields[0]); err != nil {
+			mlog.S().Warnf("%s:%d: invalid line %q, %v", file, lineNum, s, err)
+		}
+	}
+	return scanner.Err()
+}
+
+var stdinList struct {
+	once sync.Once
+	b    []byte
+	err  error
+}
+
+// readStdinList reads stdin until EOF. It is only read once, later
+// calls (e.g. reloading the list) return the same data.
+func readStdinList() ([]byte, error) {
+	stdinList.once.Do(func() {
+		stdinList.b, stdinList.err = io.ReadAll(os.Stdin)
+		if stdinList.err == nil && len(bytes.TrimSpace(stdinList.b)) == 0 {
+			mlog.S().Warn("the list from stdin is empty")
+		}
+	})
+	return stdinList.b, stdinList.err
+}
+
+// checkStdinList checks that at most one list is read from stdin.
+func checkStdinList() error {
+	var flags []string
+	for _, fl := range [...]struct {
+		flag  string
+		files []string
+	}{
+		{"blacklist-domain", opt.BlacklistDomain},
+		{"block-domain", opt.BlockDomain},
+		{"local-domain", opt.LocalDomain},
+		{"remote-domain", opt.RemoteDomain},
+		{"no-cache-domain", opt.NoCacheDomain},
+		{"warmup-domain", opt.WarmupDomain},
+		{"local-ip", opt.LocalIP},
+		{"bogus-ip", opt.BogusIP},
+	} {
+		for _, f := range fl.files {
+			if f == "-" {
+				flags = append(flags, "--"+fl.flag)
+			}
+		}
+	}
+	for _, s := range opt.GroupDomain {
+		if _, f, _ := strings.Cut(s, "="); f == "-" {
+			flags = append(flags, "--group-domain")
+		}
+	}
+	if len(flags) > 1 {
+		return fmt.Errorf("stdin can only be read by one list, but it is used by %s", strings.Join(flags, ", "))
+	}
+	return nil
+}
+
+// parseListTags parses the "@tag" attributes of a list file line.
+func parseListTags(fields []string) ([]string, error) {
+	tags := make([]string, 0, len(fields))
+	for _, f := range fields {
+		tag := strings.TrimPrefix(f, "@")
+		if tag == f {
+			return nil, fmt.Errorf("unexpected %q, attributes must start with @", f)
+		}
+		if len(tag) == 0 {
+			return nil, errors.New("empty attribute")
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
@@ -0,0 +1,88 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// localPTR answers PTR queries of private, loopback and link-local
+// addresses without contacting any upstream. Addresses with a configured
+// name get that name, others get NXDOMAIN.
+type localPTR struct {
+	names map[string]string // ip string -> fqdn
+	ttl   uint32
+}
+
+func newLocalPTR(names []string, ttl uint32) (*localPTR, error) {
+	p := &localPTR{names: make(map[string]string), ttl: ttl}
+	for _, s := range names {
+		ipStr, name, ok := strings.Cut(s, "=")
+		if !ok || len(ipStr) == 0 || len(name) == 0 {
+			return nil, fmt.Errorf("invalid local ptr name %s, want ip=name", s)
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local ptr name %s, invalid ip %s", s, ipStr)
+		}
+		if !isLocalAddr(ip) {
+			return nil, fmt.Errorf("invalid local ptr name %s, %s is not a private, loopback or link-local address", s, ipStr)
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid local ptr name %s, %s is not a valid domain", s, name)
+		}
+		p.names[ip.String()] = dns.Fqdn(name)
+	}
+	return p, nil
+}
+
+// isLocalAddr reports whether ip is a private (RFC 1918, RFC 4193),
+// loopback or link-local address.
+func isLocalAddr(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+func (p *localPTR) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypePTR || q.Question[0].Qclass != dns.ClassINET {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	question := q.Question[0]
+	ip := reverseAddr(question.Name)
+	if ip == nil || !isLocalAddr(ip) {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if name, ok := p.names[ip.String()]; ok {
+		r.Answer = []dns.RR{&dns.PTR{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: p.ttl},
+			Ptr: name,
+		}}
+	} else {
+		r.Rcode = dns.RcodeNameError
+	}
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	return nil
+}
@@ -18,11 +18,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/hosts"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/load_cache"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/elem"
@@ -31,16 +34,18 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/v2data"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
-	"github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/cache"
-	fastforward "github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/fast_forward"
-	"github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/hosts"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/ecs"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/ttl"
 	"github.com/jessevdk/go-flags"
 	"github.com/kardianos/service"
+	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v3"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
@@ -50,36 +55,159 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var version = "dev/unknown"
 
 type Opt struct {
 	ConfigFile        string   `long:"config" description:"Load settings from the yaml file" yaml:"-"`
-	ServerAddr        string   `short:"s" long:"server" description:"Server address" yaml:"server_addr"`
+	ServerAddr        []string `short:"s" long:"server" description:"Server address" yaml:"server_addr"`
+	DoHServerAddr     string   `long:"doh-server" description:"DoH server address" yaml:"doh_server_addr"`
+	DoHPath           string   `long:"doh-path" description:"DoH server url path" default:"/dns-query" yaml:"doh_path"`
+	DoHH3             bool     `long:"doh-h3" description:"Also serve DoH over HTTP/3 on the udp port of the DoH server address" yaml:"doh_h3"`
+	DoTServerAddr     string   `long:"dot-server" description:"DoT server address" yaml:"dot_server_addr"`
+	GRPCServerAddr    string   `long:"grpc-server" description:"gRPC server address, requires a build with the grpc tag" yaml:"grpc_server_addr"`
+	GRPCClientCA      string   `long:"grpc-client-ca" description:"Require grpc clients to present a certificate signed by the CA in this file" yaml:"grpc_client_ca"`
+	UnixSocket        string   `long:"unix-socket" description:"Unix socket path" yaml:"unix_socket"`
+	UnixSocketMode    string   `long:"unix-socket-mode" description:"Permission of the unix socket" default:"0666" yaml:"unix_socket_mode"`
+	TCPMaxConcurrent  int      `long:"tcp-max-concurrent" description:"Maximum concurrent queries of each tcp, dot and unix socket connection" default:"64" yaml:"tcp_max_concurrent"`
+	TLSCert           string   `long:"tls-cert" description:"TLS certificate file for DoH/DoT servers" yaml:"tls_cert"`
+	TLSKey            string   `long:"tls-key" description:"TLS key file for DoH/DoT servers" yaml:"tls_key"`
+	AllowClient       []string `long:"allow-client" description:"Only accept queries from these client ip/cidr" yaml:"allow_client"`
+	ForceLocalClient  []string `long:"force-local-client" description:"Always send queries from these client ip/cidr to the local upstream" yaml:"force_local_client"`
+	ForceRemoteClient []string `long:"force-remote-client" description:"Always send queries from these client ip/cidr to the remote upstream" yaml:"force_remote_client"`
+	ClientQPS         int      `long:"client-qps" description:"Maximum queries per second of each client" yaml:"client_qps"`
+	MaxQuerySize      int      `long:"max-query-size" description:"Reply FORMERR to queries that are larger than this size in bytes" yaml:"max_query_size"`
+	NoCompression     bool     `long:"no-compression" description:"Never compress names in responses" yaml:"no_compression"`
+	ForceCompression  bool     `long:"force-compression" description:"Always compress names in responses" yaml:"force_compression"`
+	EDNSEDE           bool     `long:"edns-ede" description:"Add extended dns errors to blocked, filtered, stale and failed responses of edns0 clients" yaml:"edns_ede"`
 	CacheSize         int      `short:"c" long:"cache" description:"Cache size"  yaml:"cache_size"`
 	LazyCacheTTL      int      `long:"lazy-cache-ttl" description:"Responses will stay in the cache for configured seconds." yaml:"lazy_cache_ttl"`
 	LazyCacheReplyTTL int      `long:"lazy-cache-reply-ttl" description:"TTL value to use when replying with expired data." yaml:"lazy_cache_reply_ttl"`
 	RedisCache        string   `long:"redis-cache" description:"Redis cache backend." yaml:"redis_cache"`
+	CacheStaleTTL     int      `long:"cache-stale-ttl" description:"Keep expired responses for configured seconds and serve them if upstreams failed" yaml:"cache_stale_ttl"`
+	CachePrefetch     bool     `long:"cache-prefetch" description:"Refresh popular cache entries before they expire" yaml:"cache_prefetch"`
+	PrefetchThreshold int      `long:"cache-prefetch-threshold" description:"Prefetch entries whose remaining TTL is less than this percentage" default:"10" yaml:"cache_prefetch_threshold"`
+	CacheMinTTL       uint32   `long:"cache-min-ttl" description:"Minimum TTL value for cached responses" yaml:"cache_min_ttl"`
+	CacheMaxTTL       uint32   `long:"cache-max-ttl" description:"Maximum TTL value for cached responses" yaml:"cache_max_ttl"`
+	NegativeTTLCap    uint32   `long:"negative-ttl-cap" description:"Maximum TTL value for cached NXDOMAIN and NODATA responses" default:"3600" yaml:"negative_ttl_cap"`
+	CacheShards       int      `long:"cache-shards" description:"Number of shards of the memory cache" yaml:"cache_shards"`
+	CacheCleanup      int      `long:"cache-cleanup-interval" description:"Remove expired entries from the memory cache every configured seconds" default:"60" yaml:"cache_cleanup_interval"`
+	CachePolicy       string   `long:"cache-policy" description:"Eviction policy of the memory cache" choice:"lru" choice:"lfu" choice:"random" default:"lru" yaml:"cache_policy"`
+	NoCacheDomain     []string `long:"no-cache-domain" description:"Never cache responses of domains in the file" yaml:"no_cache_domain"`
+	CacheECSSubnets   int      `long:"cache-ecs-max-subnets" description:"Maximum number of ecs network blocks cached for each query" default:"16" yaml:"cache_ecs_max_subnets"`
+	CacheStats        int      `long:"cache-stats-interval" description:"Log cache statistics every configured seconds" yaml:"cache_stats_interval"`
+	WarmupDomain      []string `long:"warmup-domain" description:"Resolve domains in the file at startup to populate the cache" yaml:"warmup_domain"`
+	WarmupConcurrent  int      `long:"warmup-concurrency" description:"Maximum number of concurrent warm-up queries" default:"8" yaml:"warmup_concurrency"`
+	CoalesceWindow    int      `long:"coalesce-window" description:"Share a response with identical queries that arrive within configured milliseconds after it" yaml:"coalesce_window"`
 	MinTTL            uint32   `long:"min-ttl" description:"Minimum TTL value for DNS responses" yaml:"min_ttl"`
 	MaxTTL            uint32   `long:"max-ttl" description:"Maximum TTL value for DNS responses" yaml:"max_ttl"`
+	TTLOverride       []string `long:"ttl-override" description:"Set the TTL of records of a type in upstream responses, e.g. A=300,HTTPS=3600" yaml:"ttl_override"`
 	Hosts             []string `long:"hosts" description:"Hosts" yaml:"hosts"`
+	HostsTTL          uint32   `long:"hosts-ttl" description:"TTL value of the responses from hosts" default:"3600" yaml:"hosts_ttl"`
+	Rewrite           []string `long:"rewrite" description:"Answer A/AAAA queries of the domain and cname targets with the ip, e.g. dns.msftncsi.com=131.107.255.255" yaml:"rewrite"`
+	RewriteCNAME      []string `long:"rewrite-cname" description:"Make the domain an alias of another domain, e.g. *.cdn.example=cdn.example.net" yaml:"rewrite_cname"`
+	LocalPTR          bool     `long:"local-ptr" description:"Answer PTR queries of private, loopback and link-local addresses locally" yaml:"local_ptr"`
+	LocalPTRName      []string `long:"local-ptr-name" description:"Answer PTR queries of the ip with the name, e.g. 192.168.1.1=router.lan" yaml:"local_ptr_name"`
 	BlacklistDomain   []string `long:"blacklist-domain" description:"Blacklist domain" yaml:"blacklist_domain"`
+	BlockDomain       []string `long:"block-domain" description:"Block domain, an alias of --blacklist-domain" yaml:"block_domain"`
+	Rules             string   `long:"rules" description:"Load local/remote/blacklist domains and local/bogus ips from a combined rules file" yaml:"rules"`
+	BlockMode         string   `long:"block-mode" description:"How to reply blocked queries" choice:"nxdomain" choice:"zero-ip" choice:"sinkhole" default:"nxdomain" yaml:"block_mode"`
+	BlockIP           []string `long:"block-ip" description:"Sinkhole ip addresses for the sinkhole block mode" yaml:"block_ip"`
+	BogusIP           []string `long:"bogus-ip" description:"Discard upstream responses that contain these ips" yaml:"bogus_ip"`
+	MaxCNAMEDepth     int      `long:"max-cname-depth" description:"Discard upstream responses whose cname chain is longer than this or loops" default:"16" yaml:"max_cname_depth"`
+	NoIPv6            bool     `long:"no-ipv6" description:"Reply empty responses to AAAA queries and remove AAAA records from other responses" yaml:"no_ipv6"`
+	Prefer            string   `long:"prefer" description:"Remove addresses of the other family from responses if the name has addresses of this family" choice:"ipv4" choice:"ipv6" yaml:"prefer"`
+	AnyMode           string   `long:"any-mode" description:"How to reply ANY queries" choice:"minimal" choice:"refuse" choice:"passthrough" default:"minimal" yaml:"any_mode"`
+	InvalidQuery      string   `long:"invalid-query" description:"How to handle malformed queries, queries of unsupported opcodes and queries without exactly one question" choice:"reply" choice:"drop" default:"reply" yaml:"invalid_query"`
+	RRRotate          bool     `long:"rr-rotate" description:"Rotate the order of A/AAAA records in responses" yaml:"rr_rotate"`
+	SortByLatency     bool     `long:"sort-answers-by-latency" description:"Sort A/AAAA records in responses by the tcp connect latency of their addresses" yaml:"sort_answers_by_latency"`
+	SortAnswersKeep   int      `long:"sort-answers-keep" description:"Only return this many fastest A/AAAA records of each type, 0 keeps all" yaml:"sort_answers_keep"`
+	LatencyProbePort  int      `long:"latency-probe-port" description:"Tcp port to probe the latency of addresses" default:"443" yaml:"latency_probe_port"`
+	MinimalResponses  bool     `long:"minimal-responses" description:"Remove authority and additional records that are not needed from responses" yaml:"minimal_responses"`
+	DNS64Prefix       string   `long:"dns64-prefix" description:"Synthesize AAAA records from A records with this prefix" yaml:"dns64_prefix"`
+	Bootstrap         []string `long:"bootstrap" description:"Resolve upstream hostnames by these dns servers" yaml:"bootstrap"`
+	BootstrapTTL      int      `long:"bootstrap-ttl" description:"Resolved upstream addresses will be used for configured seconds" default:"3600" yaml:"bootstrap_ttl"`
+	QName0x20         bool     `long:"0x20" description:"Randomize the letter case of query names sent to plaintext upstreams" yaml:"0x20"`
+	EDNSPadding       bool     `long:"edns-padding" description:"Pad queries sent to encrypted upstreams" yaml:"edns_padding"`
+	EDNSCookie        bool     `long:"edns-cookie" description:"Send DNS cookies to plaintext upstreams" yaml:"edns_cookie"`
+	QNameMinimize     bool     `long:"qname-minimize" description:"Send minimized query names to authoritative upstreams" yaml:"qname_minimize"`
+	EDNSOption        []string `long:"edns-option" description:"Attach an EDNS0 option to upstream queries, e.g. 65001:abcd" yaml:"edns_option"`
 	Insecure          bool     `long:"insecure" description:"Disable TLS certificate validation" yaml:"insecure"`
 	CA                []string `long:"ca" description:"CA files" yaml:"ca"`
 	Debug             bool     `short:"v" long:"debug" description:"Verbose log" yaml:"debug"`
 	LogFile           string   `long:"log-file" description:"Write logs to a file" yaml:"log_file"`
+	QueryLog          string   `long:"query-log" description:"Write a json record for every query to a file" yaml:"query_log"`
+	QueryLogMaxSize   int      `long:"query-log-max-size" description:"Rotate the query log when it is larger than this size in MB" yaml:"query_log_max_size"`
+	AnswerDump        string   `long:"answer-dump" description:"Append the domain to ip mappings in upstream responses to a file" yaml:"answer_dump"`
+	AnswerDumpMaxSize int      `long:"answer-dump-max-size" description:"Rotate the answer dump file when it is larger than this size in MB" yaml:"answer_dump_max_size"`
+	LogUpstream       bool     `long:"log-upstream" description:"Log which upstream answered each query" yaml:"log_upstream"`
+	QueryTimeout      int      `long:"query-timeout" description:"Timeout of each query in seconds" default:"5" yaml:"query_timeout"`
+	StartupMode       string   `long:"startup-mode" description:"How to answer queries that arrive before startup is completed" choice:"wait" choice:"queue" choice:"servfail" choice:"refused" default:"wait" yaml:"startup_mode"`
+	MetricsAddr       string   `long:"metrics-addr" description:"Serve prometheus metrics on this address" yaml:"metrics_addr"`
+	HealthAddr        string   `long:"health-addr" description:"Serve the /healthz endpoint on this address" yaml:"health_addr"`
+	AdminAddr         string   `long:"admin-addr" description:"Serve the admin api on this address" yaml:"admin_addr"`
+	AdminToken        string   `long:"admin-token" description:"Bearer token of the admin api" yaml:"admin_token"`
+	PprofAddr         string   `long:"pprof-addr" description:"Serve pprof handlers on this address" yaml:"pprof_addr"`
+	ShutdownTimeout   int      `long:"shutdown-timeout" description:"Wait for in-flight queries for configured seconds before exiting" default:"5" yaml:"shutdown_timeout"`
+	WatchFiles        bool     `long:"watch-files" description:"Reload domain and ip lists automatically when their files change" yaml:"watch_files"`
+	WatchDebounce     int      `long:"watch-debounce" description:"Wait until files are not changed for configured seconds before reloading" default:"2" yaml:"watch_debounce"`
+	DownloadTimeout   int      `long:"download-timeout" description:"Timeout of downloading domain and ip lists from urls in seconds" default:"30" yaml:"download_timeout"`
+	ListCacheDir      string   `long:"list-cache-dir" description:"Where to keep the domain and ip lists downloaded from urls" default:"list_cache" yaml:"list_cache_dir"`
+
+	// upstream options
+	UpstreamMaxConcurrent int    `long:"upstream-max-concurrent" description:"Maximum concurrent queries of each upstream" yaml:"upstream_max_concurrent"`
+	UpstreamIdleTimeout   int    `long:"upstream-idle-timeout" description:"Idle timeout of upstream connections in seconds" yaml:"upstream_idle_timeout"`
+	UpstreamMaxConns      int    `long:"upstream-max-conns" description:"Maximum connections of each upstream" default:"4" yaml:"upstream_max_conns"`
+	UpstreamTFO           bool   `long:"upstream-tfo" description:"Enable TCP Fast Open for TCP, DoT and DoH upstreams" yaml:"upstream_tfo"`
+	UDPSize               int    `long:"udp-size" description:"EDNS0 udp payload size advertised to udp upstreams" default:"1232" yaml:"udp_size"`
+	MaxResponseSize       int    `long:"max-response-size" description:"Discard upstream responses that are larger than this size in bytes" yaml:"max_response_size"`
+	UpstreamRetries       int    `long:"upstream-retries" description:"Retry failed queries and SERVFAIL responses of each upstream for configured times" yaml:"upstream_retries"`
+	UpstreamRetryBackoff  int    `long:"upstream-retry-backoff" description:"Wait for configured milliseconds before the first retry, doubled after every retry" yaml:"upstream_retry_backoff"`
+	UpstreamReconnect     bool   `long:"upstream-reconnect" description:"Retry a query once over a new connection if the TCP, DoT or DoH connection was dropped" yaml:"upstream_reconnect"`
+	UDPRandomPort         bool   `long:"udp-random-port" description:"Send queries to udp upstreams from short-lived sockets with random source ports" yaml:"udp_random_port"`
+	HealthCheckInterval   int    `long:"health-check-interval" description:"Check the health of upstreams every configured seconds" yaml:"health_check_interval"`
+	HealthCheckDomain     string `long:"health-check-domain" description:"Domain to query in health checks" default:"www.example.com" yaml:"health_check_domain"`
+	RTTReportInterval     int    `long:"rtt-report-interval" description:"Log the round-trip time percentiles of each upstream every configured seconds" yaml:"rtt_report_interval"`
 
 	// simple forwarder
 	Upstream []string `long:"upstream" description:"Upstream" yaml:"upstream"`
 
 	// local/remote forwarder
-	LocalUpstream  []string `long:"local-upstream" description:"Local upstream" yaml:"local_upstream"` // required if Upstream is empty
-	LocalIP        []string `long:"local-ip" description:"Local ip" yaml:"local_ip"`
-	LocalDomain    []string `long:"local-domain" description:"Local domain" yaml:"local_domain"`
-	LocalLatency   int      `long:"local-latency" description:"Local latency in milliseconds" default:"50" yaml:"local_latency"`
-	RemoteUpstream []string `long:"remote-upstream" description:"Remote upstream" yaml:"remote_upstream"` // required if Upstream is empty
-	RemoteDomain   []string `long:"remote-domain" description:"Remote domain" yaml:"remote_domain"`
+	LocalUpstream    []string `long:"local-upstream" description:"Local upstream" yaml:"local_upstream"` // required if Upstream is empty
+	LocalIP          []string `long:"local-ip" description:"Local ip" yaml:"local_ip"`
+	GeoIPDB          string   `long:"geoip-db" description:"MaxMind mmdb database, ips located in --local-country are local ips" yaml:"geoip_db"`
+	LocalCountry     []string `long:"local-country" description:"ISO country code of local ips in --geoip-db, default is CN" yaml:"local_country"`
+	TrustLocalIPOnly bool     `long:"trust-local-ip-only" description:"Only accept local responses whose ips are all local ip" yaml:"trust_local_ip_only"`
+	VerifyLocalIP    string   `long:"verify-local-ip" description:"How the local response is verified by local ip, default is any" choice:"any" choice:"all" choice:"off" yaml:"verify_local_ip"`
+	LocalIPMatch     string   `long:"local-ip-match" description:"How many ips of the local response must be local ip, default is any" choice:"strict" choice:"any" yaml:"local_ip_match"`
+	LocalNoIP        string   `long:"local-no-ip" description:"Whether to trust the local response without any ip, default is remote" choice:"remote" choice:"local" choice:"local-nxdomain" yaml:"local_no_ip"`
+	LocalDomain      []string `long:"local-domain" description:"Local domain" yaml:"local_domain"`
+	LocalLatency     int      `long:"local-latency" description:"Local latency in milliseconds" default:"50" yaml:"local_latency"`
+	DispatchMode     string   `long:"dispatch-mode" description:"How to query local and remote upstreams when local ip is used" choice:"standby" choice:"delay" choice:"parallel" choice:"adaptive" default:"standby" yaml:"dispatch_mode"`
+	RemoteDelay      int      `long:"remote-delay" description:"Delay of remote queries in milliseconds in the delay dispatch mode" default:"50" yaml:"remote_delay"`
+	AdaptiveTTL      int      `long:"adaptive-ttl" description:"How long a learned route is kept in seconds in the adaptive dispatch mode" default:"3600" yaml:"adaptive_ttl"`
+	LocalRace        bool     `long:"local-race" description:"Accept the first valid response from any local upstream" yaml:"local_race"`
+	RemoteOnNXDomain bool     `long:"retry-remote-on-nxdomain" description:"Use the remote response if local upstream answered NXDOMAIN but remote upstream did not" yaml:"retry_remote_on_nxdomain"`
+	RemoteUpstream   []string `long:"remote-upstream" description:"Remote upstream" yaml:"remote_upstream"` // required if Upstream is empty
+	RemoteDomain     []string `long:"remote-domain" description:"Remote domain" yaml:"remote_domain"`
+	FakeIPRange      []string `long:"fake-ip-range" description:"Answer A/AAAA queries of remote domains with addresses from this cidr" yaml:"fake_ip_range"`
+	FakeIPFile       string   `long:"fake-ip-file" description:"Keep the fake ip assignments in this file across restarts" yaml:"fake_ip_file"`
+	Group            []string `long:"group" description:"Add an upstream to a named group, e.g. proxy=tls://8.8.8.8" yaml:"group"`
+	DomainUpstream   []string `long:"domain-upstream" description:"Forward the domain and its subdomains to the upstream, e.g. corp.internal=udp://10.0.0.1" yaml:"domain_upstream"`
+	GroupDomain      []string `long:"group-domain" description:"Forward domains in the file to the named group, e.g. proxy=streaming.txt" yaml:"group_domain"`
+	ScheduleRule     []string `long:"schedule-rule" description:"Forward domains in the file to local or remote upstream during some hours, e.g. \"domain=streaming.txt route=remote hours=18-23\"" yaml:"schedule_rule"`
+	RemoteECS        string   `long:"remote-ecs" description:"Attach this EDNS0 client subnet to queries sent to remote upstream" yaml:"remote_ecs"`
+	ECSFromClient    bool     `long:"ecs-from-client" description:"Attach the network of the client ip as EDNS0 client subnet to queries" yaml:"ecs_from_client"`
+	ECSClientMask4   int      `long:"ecs-client-mask4" description:"Prefix length of the ipv4 client subnet of --ecs-from-client" default:"24" yaml:"ecs_client_mask4"`
+	ECSClientMask6   int      `long:"ecs-client-mask6" description:"Prefix length of the ipv6 client subnet of --ecs-from-client" default:"56" yaml:"ecs_client_mask6"`
+	KeepClientECS    bool     `long:"keep-client-ecs" description:"Don't overwrite the client subnet that is already in the query" yaml:"keep_client_ecs"`
+	StripECS         bool     `long:"strip-ecs" description:"Remove EDNS0 client subnet from queries sent to local upstream" yaml:"strip_ecs"`
+	LocalQType       []string `long:"local-qtype" description:"Forward queries of these types to local upstream" yaml:"local_qtype"`
+	RemoteQType      []string `long:"remote-qtype" description:"Forward queries of these types to remote upstream" yaml:"remote_qtype"`
+	IPv6RemoteOnly   bool     `long:"ipv6-remote-only" description:"Send AAAA queries to remote upstream only" yaml:"ipv6_remote_only"`
+	DefaultRoute     string   `long:"default-route" description:"Where to forward queries that match no domain list" choice:"local" choice:"remote" yaml:"default_route"`
 
 	WorkingDir   string `long:"dir" description:"Working dir" yaml:"working_dir"`
 	CD2Exe       bool   `long:"cd2exe" description:"Change working dir to executable automatically" yaml:"cd2exe"`
@@ -87,6 +215,10 @@ type Opt struct {
 	RunAsService bool   `short:"S" description:"Run as a system service" hidden:"true" yaml:"-"`
 
 	GenConfig    string `long:"gen-config" description:"Generate a configuration file to the given path" yaml:"-"`
+	TestDomain   string `long:"test-domain" description:"Print how a query of this domain would be routed and exit" yaml:"-"`
+	TestQType    string `long:"test-qtype" description:"Query type of --test-domain" default:"A" yaml:"-"`
+	TestClient   string `long:"test-client" description:"Client ip of --test-domain" default:"127.0.0.1" yaml:"-"`
+	CheckConfig  bool   `long:"check-config" description:"Check the options, upstreams and list files, print all problems and exit" yaml:"-"`
 	PrintVersion bool   `long:"version" description:"Print the program version" yaml:"-"`
 }
 
@@ -123,16 +255,27 @@ func main() {
 	}
 
 	if cf := opt.ConfigFile; len(cf) > 0 {
-		b, err := os.ReadFile(cf)
-		if err != nil {
+		if err := loadConfig(cf); err != nil {
 			mlog.S().Fatalf("failed to load configuration file: %v", err)
 		}
-		if err := yaml.Unmarshal(b, opt); err != nil {
-			mlog.S().Fatalf("failed to parse configuration file: %v", err)
-		}
 	}
 	cd() // change wd for config arguments
 
+	if len(opt.TestDomain) > 0 {
+		if err := testRoute(opt.TestDomain, opt.TestQType, opt.TestClient); err != nil {
+			mlog.S().Fatalf("failed to test route: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if opt.CheckConfig {
+		mlog.Level().SetLevel(zap.WarnLevel)
+		if checkConfig() > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if opt.Debug {
 		mlog.Level().SetLevel(zap.DebugLevel)
 	} else {
@@ -145,6 +288,7 @@ func main() {
 		signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 		s := <-c
 		mlog.S().Infof("%s, exiting", s)
+		shutdown(time.Duration(opt.ShutdownTimeout) * time.Second)
 		os.Exit(0)
 	}
 
@@ -200,6 +344,31 @@ func main() {
 	}
 }
 
+// loadConfig loads opt from the yaml file. Unknown keys are rejected.
+// Command line arguments have higher priority than the file, so they
+// will be parsed again after the file is loaded.
+func loadConfig(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(opt); err != nil && err != io.EOF { // io.EOF: empty file
+		return fmt.Errorf("failed to parse %s, %w", file, err)
+	}
+
+	// Don't let go-flags reset the values loaded from the file to their defaults.
+	p := flags.NewParser(opt, flags.Default)
+	for _, o := range p.Command.Options() {
+		o.Default = nil
+	}
+	if _, err := p.Parse(); err != nil {
+		return err
+	}
+	return nil
+}
+
 func cd() {
 	var d string
 	switch {
@@ -229,6 +398,7 @@ func (m *svc) Start(s service.Service) error {
 }
 
 func (m *svc) Stop(s service.Service) error {
+	shutdown(time.Duration(opt.ShutdownTimeout) * time.Second)
 	return nil
 }
 
@@ -246,49 +416,303 @@ func run() {
 	mlog.S().Infof("mosdns-cn ver: %s", version)
 	mlog.S().Infof("arch: %s, os: %s, go: %s", runtime.GOARCH, runtime.GOOS, runtime.Version())
 
+	if err := checkServerOpt(); err != nil {
+		mlog.S().Fatal(err)
+	}
+
+	if len(opt.MetricsAddr) > 0 {
+		metrics = newDNSMetrics()
+		metrics.pprof = opt.PprofAddr == opt.MetricsAddr
+		if metrics.pprof {
+			if err := checkSharedPprofAddr(opt.MetricsAddr); err != nil {
+				mlog.S().Fatalf("invalid pprof addr, %v", err)
+			}
+		}
+		l, err := net.Listen("tcp", opt.MetricsAddr)
+		if err != nil {
+			mlog.S().Fatalf("failed to listen on metrics socket, %v", err)
+		}
+		mlog.S().Infof("serving metrics on %s/metrics", l.Addr())
+		go func() {
+			err := http.Serve(l, metrics.httpHandler())
+			if err != nil {
+				mlog.S().Fatalf("metrics server exited: %v", err)
+			}
+		}()
+	}
+
+	startPprof()
+
+	if opt.RTTReportInterval > 0 {
+		rttStats = newUpstreamRTTStats(mlog.L().Named("upstream_rtt"))
+		rttStats.start(time.Duration(opt.RTTReportInterval) * time.Second)
+	}
+
+	if len(opt.HealthAddr) > 0 {
+		healthzAPI.domain = opt.HealthCheckDomain
+		l, err := net.Listen("tcp", opt.HealthAddr)
+		if err != nil {
+			mlog.S().Fatalf("failed to listen on health socket, %v", err)
+		}
+		mlog.S().Infof("serving health endpoint on %s/healthz", l.Addr())
+		go func() {
+			err := http.Serve(l, healthzAPI.httpHandler())
+			if err != nil {
+				mlog.S().Fatalf("health server exited: %v", err)
+			}
+		}()
+	}
+
+	queryTimeout := time.Duration(opt.QueryTimeout) * time.Second
+	if queryTimeout <= 0 {
+		queryTimeout = time.Second * 5 // default query timeout of dns_handler
+	}
+	sh := newStartupHandler(opt.StartupMode, queryTimeout)
+	h := &gracefulHandler{Handler: sh}
+	// In the wait mode, servers are started after the entry is ready.
+	// Otherwise they are started now and sh answers the queries until then.
+	startEarly := opt.StartupMode != "" && opt.StartupMode != "wait"
+	if startEarly {
+		startServers(h)
+	}
+
 	entry, err := initEntry()
 	if err != nil {
 		mlog.S().Fatalf("failed to init entry, %v", err)
 	}
-	h := &dns_handler.DefaultHandler{
-		Logger: mlog.L().Named("dns_handler"),
-		Entry:  entry,
+
+	if len(opt.AdminAddr) > 0 {
+		adminAPI.token = opt.AdminToken
+		adminAPI.pprof = opt.PprofAddr == opt.AdminAddr
+		l, err := net.Listen("tcp", opt.AdminAddr)
+		if err != nil {
+			mlog.S().Fatalf("failed to listen on admin socket, %v", err)
+		}
+		mlog.S().Infof("serving admin api on %s", l.Addr())
+		go func() {
+			err := http.Serve(l, adminAPI.httpHandler())
+			if err != nil {
+				mlog.S().Fatalf("admin server exited: %v", err)
+			}
+		}()
+	}
+	var dh dns_handler.Handler = &dns_handler.DefaultHandler{
+		Logger:       mlog.L().Named("dns_handler"),
+		Entry:        entry,
+		QueryTimeout: queryTimeout,
+	}
+	if opt.EDNSEDE {
+		dh = &edeHandler{Handler: dh}
+	}
+	if opt.NoCompression || opt.ForceCompression {
+		dh = &compressionHandler{Handler: dh, compress: opt.ForceCompression}
+	}
+	if len(opt.WarmupDomain) > 0 {
+		domains, err := loadWarmupDomains(opt.WarmupDomain)
+		if err != nil {
+			mlog.S().Fatal(err)
+		}
+		warmUp(entry, domains, opt.WarmupConcurrent, queryTimeout)
+	}
+	sh.setReady(dh)
+	if !startEarly {
+		startServers(h)
 	}
 
-	// start servers
+	mlog.S().Info("server started")
+	healthzAPI.setReady(h)
 
-	if len(opt.ServerAddr) == 0 {
-		mlog.S().Fatal("missing server address")
+	if opt.WatchFiles {
+		go watchLists(time.Duration(opt.WatchDebounce) * time.Second)
 	}
-	s := server.Server{
+
+	// reload domain and ip lists on SIGHUP
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		mlog.S().Info("SIGHUP received, reloading domain and ip lists")
+		reloadLists()
+	}
+}
+
+// startServers listens on all server addresses and serves h.
+func startServers(h *gracefulHandler) {
+	s := &server.Server{
 		DNSHandler: h,
 		Logger:     mlog.L().Named("server"),
 	}
-	udpConn, err := net.ListenPacket("udp", opt.ServerAddr)
-	if err != nil {
-		mlog.S().Fatalf("failed to listen on udp socket, %v", err)
+	setServer(h, s)
+	tcpSrv := newTCPServer(h, opt.TCPMaxConcurrent, mlog.L().Named("server"))
+	tcpSrv.replyMalformed = opt.InvalidQuery != "drop"
+	registerCloser(tcpSrv)
+	if len(opt.TLSCert) > 0 || len(opt.TLSKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(opt.TLSCert, opt.TLSKey)
+		if err != nil {
+			mlog.S().Fatalf("failed to load tls certificate, %v", err)
+		}
+		s.TLSConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}
 	}
-	mlog.S().Infof("listening on udp socket %s", udpConn.LocalAddr())
-	l, err := net.Listen("tcp", opt.ServerAddr)
-	if err != nil {
-		mlog.S().Fatalf("failed to listen on tcp socket, %v", err)
+	// Bind all addresses before serving, so a bad address fails the startup
+	// instead of leaving the server partially listening.
+	udpConns := make([]net.PacketConn, 0, len(opt.ServerAddr))
+	tcpListeners := make([]net.Listener, 0, len(opt.ServerAddr))
+	for _, addr := range opt.ServerAddr {
+		udpConn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			mlog.S().Fatalf("failed to listen on udp socket %s, %v", addr, err)
+		}
+		mlog.S().Infof("listening on udp socket %s", udpConn.LocalAddr())
+		if opt.ForceCompression {
+			udpConn = &compressedPacketConn{PacketConn: udpConn}
+		}
+		if opt.InvalidQuery != "drop" {
+			udpConn = &malformedReplyPacketConn{PacketConn: udpConn, logger: mlog.L().Named("server")}
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			mlog.S().Fatalf("failed to listen on tcp socket %s, %v", addr, err)
+		}
+		mlog.S().Infof("listening on tcp socket %s", l.Addr())
+		udpConns = append(udpConns, udpConn)
+		tcpListeners = append(tcpListeners, l)
+	}
+	for _, udpConn := range udpConns {
+		udpConn := udpConn
+		go func() {
+			err := s.ServeUDP(udpConn)
+			if err != nil && err != server.ErrServerClosed {
+				mlog.S().Fatalf("udp server %s exited: %v", udpConn.LocalAddr(), err)
+			}
+		}()
+	}
+	for _, l := range tcpListeners {
+		l := l
+		go func() {
+			err := tcpSrv.serve(l)
+			if err != nil && err != errTCPServerClosed {
+				mlog.S().Fatalf("tcp server %s exited: %v", l.Addr(), err)
+			}
+		}()
+	}
+
+	if len(opt.UnixSocket) > 0 {
+		l, err := listenUnix(opt.UnixSocket, opt.UnixSocketMode)
+		if err != nil {
+			mlog.S().Fatalf("failed to listen on unix socket, %v", err)
+		}
+		mlog.S().Infof("listening on unix socket %s", l.Addr())
+		go func() {
+			err := tcpSrv.serve(l)
+			if err != nil && err != errTCPServerClosed {
+				mlog.S().Fatalf("unix socket server exited: %v", err)
+			}
+		}()
 	}
-	mlog.S().Infof("listening on tcp socket %s", l.Addr())
-	go func() {
-		err := s.ServeUDP(udpConn)
+
+	if len(opt.DoTServerAddr) > 0 {
+		l, err := net.Listen("tcp", opt.DoTServerAddr)
 		if err != nil {
-			mlog.S().Fatalf("udp server exited: %v", err)
+			mlog.S().Fatalf("failed to listen on dot socket, %v", err)
 		}
-	}()
-	go func() {
-		err := s.ServeTCP(l)
+		mlog.S().Infof("listening on dot socket %s", l.Addr())
+		go func() {
+			err := tcpSrv.serve(tls.NewListener(l, s.TLSConfig))
+			if err != nil && err != errTCPServerClosed {
+				mlog.S().Fatalf("dot server exited: %v", err)
+			}
+		}()
+	}
+
+	if len(opt.DoHServerAddr) > 0 {
+		dh := &dohHandler{
+			dnsHandler: h,
+			path:       opt.DoHPath,
+			logger:     mlog.L().Named("doh_server"),
+		}
+		s.HttpHandler = dh
+		if opt.DoHH3 {
+			h3, err := startDoH3Server(opt.DoHServerAddr, dh, s.TLSConfig)
+			if err != nil {
+				mlog.S().Fatalf("failed to start doh http/3 server, %v", err)
+			}
+			s.HttpHandler = &altSvcHandler{Handler: dh, h3: h3}
+		}
+		l, err := net.Listen("tcp", opt.DoHServerAddr)
 		if err != nil {
-			mlog.S().Fatalf("tcp server exited: %v", err)
+			mlog.S().Fatalf("failed to listen on doh socket, %v", err)
 		}
-	}()
+		mlog.S().Infof("listening on doh socket %s", l.Addr())
+		go func() {
+			var err error
+			if s.TLSConfig != nil {
+				err = s.ServeHTTPS(l)
+			} else {
+				mlog.S().Warn("no tls certificate is configured, doh server is serving plain http")
+				err = s.ServeHTTP(l)
+			}
+			if err != nil && err != server.ErrServerClosed {
+				mlog.S().Fatalf("doh server exited: %v", err)
+			}
+		}()
+	}
 
-	mlog.S().Info("server started")
-	select {}
+	if len(opt.GRPCServerAddr) > 0 {
+		tlsConfig, err := grpcTLSConfig(s.TLSConfig, opt.GRPCClientCA)
+		if err != nil {
+			mlog.S().Fatalf("failed to init grpc server, %v", err)
+		}
+		gs, err := newGRPCServer(h, tlsConfig, opt.TCPMaxConcurrent, mlog.L().Named("grpc_server"))
+		if err != nil {
+			mlog.S().Fatalf("failed to init grpc server, %v", err)
+		}
+		registerCloser(gs)
+		l, err := net.Listen("tcp", opt.GRPCServerAddr)
+		if err != nil {
+			mlog.S().Fatalf("failed to listen on grpc socket, %v", err)
+		}
+		mlog.S().Infof("listening on grpc socket %s", l.Addr())
+		if tlsConfig == nil {
+			mlog.S().Warn("no tls certificate is configured, grpc server is serving plain http/2")
+		}
+		go func() {
+			if err := gs.serve(l); err != nil {
+				mlog.S().Fatalf("grpc server exited: %v", err)
+			}
+		}()
+	}
+}
+
+// grpcTLSConfig returns the tls config of the grpc server. If caFile is
+// not empty, clients must present a certificate signed by it (mTLS).
+// It returns nil if there is no server certificate.
+func grpcTLSConfig(serverConfig *tls.Config, caFile string) (*tls.Config, error) {
+	if serverConfig == nil {
+		if len(caFile) > 0 {
+			return nil, errors.New("grpc client ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+	c := serverConfig.Clone()
+	if len(caFile) > 0 {
+		pool, err := utils.LoadCertPool([]string{caFile})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load grpc client ca, %w", err)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// blockDomainFiles returns the files of --blacklist-domain and its
+// alias --block-domain.
+func blockDomainFiles() []string {
+	files := make([]string, 0, len(opt.BlacklistDomain)+len(opt.BlockDomain))
+	files = append(files, opt.BlacklistDomain...)
+	return append(files, opt.BlockDomain...)
 }
 
 // some plugin args require file name start with `ext:`
@@ -301,143 +725,506 @@ func addFilePrefix(ss []string) []string {
 }
 
 func initEntry() (handler.ExecutableChainNode, error) {
+	if err := checkStdinList(); err != nil {
+		return nil, err
+	}
+	var rules *ruleSet
+	if len(opt.Rules) > 0 {
+		rs, err := loadRules(opt.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load rules file, %w", err)
+		}
+		rules = rs
+	}
+	if err := checkEntryOpt(rules); err != nil {
+		return nil, err
+	}
 	route := make([]handler.Executable, 0)
 
+	if metrics != nil {
+		route = append(route, &queryCounter{})
+	}
+
+	if len(opt.QueryLog) > 0 {
+		l, err := newQueryLogger(opt.QueryLog, int64(opt.QueryLogMaxSize)<<20)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open query log, %w", err)
+		}
+		registerCloser(l)
+		route = append(route, l)
+	}
+
+	if len(opt.AnswerDump) > 0 {
+		d, err := newAnswerDumper(opt.AnswerDump, int64(opt.AnswerDumpMaxSize)<<20)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open answer dump file, %w", err)
+		}
+		registerCloser(d)
+		route = append(route, d)
+	}
+
+	if opt.LogUpstream {
+		route = append(route, &upstreamLogger{logger: mlog.S().Named("upstream_log")})
+	}
+
+	if len(opt.AllowClient) > 0 {
+		l := netlist.NewList()
+		if err := netlist.BatchLoad(l, opt.AllowClient); err != nil {
+			return nil, fmt.Errorf("failed to load allowed clients, %w", err)
+		}
+		l.Sort()
+		route = append(route, &clientFilter{allowed: l, logger: mlog.L().Named("client_filter")})
+	}
+
+	route = append(route, &queryValidator{drop: opt.InvalidQuery == "drop", logger: mlog.L().Named("query_validator")})
+
+	if opt.MaxQuerySize != 0 {
+		route = append(route, &querySizeLimiter{max: opt.MaxQuerySize, logger: mlog.L().Named("query_size_limiter")})
+	}
+
+	if opt.ClientQPS > 0 {
+		route = append(route, newRateLimiter(opt.ClientQPS, mlog.L().Named("rate_limiter")))
+	}
+
+	aq, err := newAnyQuery(opt.AnyMode, mlog.L().Named("any_query"))
+	if err != nil {
+		return nil, err
+	}
+	if aq != nil {
+		route = append(route, aq)
+	}
+
+	if opt.RRRotate {
+		route = append(route, &rrRotator{})
+	}
+
+	if opt.SortByLatency {
+		route = append(route, newLatencySorter(opt.LatencyProbePort, opt.SortAnswersKeep, mlog.L().Named("latency_sorter")))
+	}
+
+	if opt.MinimalResponses {
+		route = append(route, &minimalResponses{})
+	}
+
 	if len(opt.Hosts) > 0 {
-		p, err := hosts.Init(handler.NewBP("hosts", hosts.PluginType), &hosts.Args{Hosts: addFilePrefix(opt.Hosts)})
+		h, err := loadHosts(opt.Hosts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init hosts, %w", err)
 		}
-		route = append(route, p.(handler.Executable))
+		route = append(route, &hostsExec{h: h, ttl: opt.HostsTTL})
 	}
 
-	if len(opt.BlacklistDomain) > 0 {
-		mixMatcher, err := loadDomainMatcher(opt.BlacklistDomain)
+	if files := blockDomainFiles(); len(files) > 0 || rules.hasDomains(ruleBlock) {
+		l, err := newDomainListWithRules(files, opt.Rules, ruleBlock)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init blacklist, %w", err)
 		}
-		e := &blackList{m: msg_matcher.NewQNameMatcher(mixMatcher)}
-		mlog.S().Infof("black domain files loaded, total length: %d", mixMatcher.Len())
+		registerReloadable("blacklist domain", l)
+		e := &blackList{m: msg_matcher.NewQNameMatcher(l), logger: mlog.L().Named("blacklist")}
+		e.ipv4, e.ipv6, err = parseBlockMode(opt)
+		if err != nil {
+			return nil, err
+		}
+		mlog.S().Infof("black domain files loaded, total length: %d", l.Len())
 		route = append(route, e)
 	}
 
+	if opt.NoIPv6 {
+		route = append(route, &noIPv6{})
+	}
+
+	if len(opt.Prefer) > 0 {
+		p, err := newPreferFamily(opt.Prefer, mlog.L().Named("prefer"))
+		if err != nil {
+			return nil, err
+		}
+		route = append(route, p)
+	}
+
+	if len(opt.DNS64Prefix) > 0 {
+		d, err := newDNS64(opt.DNS64Prefix, mlog.L().Named("dns64"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns64 prefix, %w", err)
+		}
+		route = append(route, d)
+	}
+
+	// The remote domain list is loaded here if fake ip needs it, and
+	// shared with the routing rules.
+	var remoteDomains *domainList
+	if len(opt.FakeIPRange) > 0 {
+		l, err := loadRemoteDomains()
+		if err != nil {
+			return nil, err
+		}
+		remoteDomains = l
+		pool, err := newFakeIPPool(opt.FakeIPRange)
+		if err != nil {
+			return nil, err
+		}
+		e := &fakeIPExec{
+			m:      msg_matcher.NewQNameMatcher(l),
+			pool:   pool,
+			file:   opt.FakeIPFile,
+			logger: mlog.L().Named("fake_ip"),
+		}
+		if len(opt.FakeIPFile) > 0 {
+			n, err := pool.load(opt.FakeIPFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load fake ip file, %w", err)
+			}
+			mlog.S().Infof("fake ip assignments loaded, total length: %d", n)
+		}
+		registerCloser(e)
+		route = append(route, e)
+	}
+
+	if opt.LocalPTR {
+		p, err := newLocalPTR(opt.LocalPTRName, opt.HostsTTL)
+		if err != nil {
+			return nil, err
+		}
+		route = append(route, p)
+	}
+
+	var forced *forcedClients
+	if len(opt.ForceLocalClient) > 0 || len(opt.ForceRemoteClient) > 0 {
+		forced = new(forcedClients)
+		for _, fc := range [...]struct {
+			clients []string
+			l       *netlist.Matcher
+			route   string
+		}{{opt.ForceLocalClient, &forced.local, "local"}, {opt.ForceRemoteClient, &forced.remote, "remote"}} {
+			if len(fc.clients) == 0 {
+				continue
+			}
+			l := netlist.NewList()
+			if err := netlist.BatchLoad(l, fc.clients); err != nil {
+				return nil, fmt.Errorf("failed to load force %s clients, %w", fc.route, err)
+			}
+			l.Sort()
+			*fc.l = l
+		}
+	}
+
+	// add the client subnet before the cache, so responses are cached
+	// per client network.
+	if opt.ECSFromClient {
+		route = append(route, &clientECS{
+			mask4:     uint8(opt.ECSClientMask4),
+			mask6:     uint8(opt.ECSClientMask6),
+			overwrite: !opt.KeepClientECS,
+		})
+	}
+
 	if opt.CacheSize > 0 || len(opt.RedisCache) > 0 {
-		p, err := cache.Init(handler.NewBP("cache", cache.PluginType), &cache.Args{
+		c := &cacheConfig{
 			Size:              opt.CacheSize,
 			Redis:             opt.RedisCache,
 			LazyCacheTTL:      opt.LazyCacheTTL,
 			LazyCacheReplyTTL: opt.LazyCacheReplyTTL,
-			CacheEverything:   true,
-		})
+			StaleTTL:          opt.CacheStaleTTL,
+			MinTTL:            opt.CacheMinTTL,
+			MaxTTL:            opt.CacheMaxTTL,
+			NegativeTTLCap:    opt.NegativeTTLCap,
+			Shards:            opt.CacheShards,
+			Policy:            opt.CachePolicy,
+			CleanupInterval:   time.Duration(opt.CacheCleanup) * time.Second,
+			StatsInterval:     time.Duration(opt.CacheStats) * time.Second,
+			ECSMaxSubnets:     opt.CacheECSSubnets,
+		}
+		if opt.CachePrefetch {
+			c.PrefetchThreshold = opt.PrefetchThreshold
+		}
+		if opt.IPv6RemoteOnly {
+			// AAAA responses may come from a different upstream.
+			c.KeyPrefix = "ipv6_remote_only:"
+		}
+		if len(opt.NoCacheDomain) > 0 {
+			l, err := newDomainList(opt.NoCacheDomain)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load no cache domain file, %w", err)
+			}
+			registerReloadable("no cache domain", l)
+			mlog.S().Infof("no cache domain files loaded, total length: %d", l.Len())
+			c.NoCache = l
+		}
+		c.Forced = forced
+		dc, err := newDNSCache(c, mlog.L().Named("cache"))
 		if err != nil {
 			return nil, fmt.Errorf("failed to init cache, %w", err)
 		}
-		route = append(route, p.(handler.Executable))
+		registerCloser(dc)
+		adminAPI.setCache(dc)
+		route = append(route, dc)
 	}
 
-	// init upstream
-	if len(opt.Upstream) > 0 {
-		args, err := initFastForwardArgs(opt.Upstream)
+	// merge identical queries that missed the cache.
+	route = append(route, newQueryDeduplicator(forced, time.Duration(opt.CoalesceWindow)*time.Millisecond))
+
+	if len(opt.Rewrite) > 0 || len(opt.RewriteCNAME) > 0 {
+		w, err := newRewriter(opt.Rewrite, opt.RewriteCNAME, mlog.L().Named("rewrite"))
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse upstream, %w", err)
+			return nil, err
 		}
-		p, err := fastforward.Init(handler.NewBP("upstream", fastforward.PluginType), args)
+		route = append(route, w)
+	}
+
+	if len(opt.TTLOverride) > 0 {
+		o, err := parseTTLOverride(opt.TTLOverride)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init upstream, %w", err)
-		}
-		route = append(route, p.(handler.Executable))
-	} else {
-		if len(opt.LocalUpstream) == 0 {
-			return nil, errors.New("missing local upstream")
+			return nil, err
 		}
-		if len(opt.RemoteUpstream) == 0 {
-			return nil, errors.New("missing remote upstream")
+		route = append(route, o)
+	}
+
+	var bogusIP netlist.Matcher
+	if len(opt.BogusIP) > 0 || rules.hasIPs(ruleBogus) {
+		l, err := newIPListWithRules(opt.BogusIP, opt.Rules, ruleBogus)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load bogus ip file, %w", err)
 		}
+		registerReloadable("bogus ip", l)
+		mlog.S().Infof("bogus ip files loaded, total length: %d", l.Len())
+		bogusIP = l
+	}
+
+	// forward group domains to their groups.
+	groups, err := parseGroups(opt.Group, opt.GroupDomain)
+	if err != nil {
+		return nil, err
+	}
+	groupNodes, groupForwarders, err := initGroups(groups, bogusIP)
+	if err != nil {
+		return nil, err
+	}
+
+	// forward pinned domains to their upstreams, before all routing rules.
+	pins, err := parseDomainPins(opt.DomainUpstream)
+	if err != nil {
+		return nil, err
+	}
+	pinNodes, err := initDomainPins(pins, bogusIP)
+	if err != nil {
+		return nil, err
+	}
 
+	if len(opt.Upstream) > 0 {
+		f, err := initForwarder("upstream", opt.Upstream, false, bogusIP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init upstream, %w", err)
+		}
+		healthzAPI.addForwarder(f)
+		route = append(route, pinNodes...)
+		if hasCustomRouter() {
+			n, err := newRouterNode(f, f, groupForwarders, opt)
+			if err != nil {
+				return nil, err
+			}
+			route = append(route, n)
+		}
+		route = append(route, groupNodes...)
+		route = traceStep(route, "no routing rule matched")
+		route = append(route, f)
+	} else {
 		var localFastForward handler.Executable
 		var remoteFastForward handler.Executable
 
 		// init local upstream
-		args, err := initFastForwardArgs(opt.LocalUpstream)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse local upstream, %w", err)
-		}
-		p, err := fastforward.Init(handler.NewBP("local_upstream", fastforward.PluginType), args)
+		f, err := initForwarder("local", opt.LocalUpstream, opt.LocalRace, bogusIP)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init local upstream, %w", err)
 		}
-		localFastForward = p.(handler.Executable)
+		healthzAPI.addForwarder(f)
+		localFastForward = f
+		if opt.StripECS {
+			localFastForward = newSubChain(&stripECS{}, localFastForward)
+		}
 
 		// init remote upstream
-		args, err = initFastForwardArgs(opt.RemoteUpstream)
+		f, err = initForwarder("remote", opt.RemoteUpstream, false, bogusIP)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse remote upstream, %w", err)
+			return nil, fmt.Errorf("failed to init remote upstream, %w", err)
 		}
-		p, err = fastforward.Init(handler.NewBP("remote_upstream", fastforward.PluginType), args)
+		healthzAPI.addForwarder(f)
+		remoteFastForward = f
+		if len(opt.RemoteECS) > 0 {
+			args, err := parseECS(opt.RemoteECS)
+			if err != nil {
+				return nil, fmt.Errorf("invalid remote ecs, %w", err)
+			}
+			args.ForceOverwrite = !opt.KeepClientECS
+			p, err := ecs.Init(handler.NewBP("remote_ecs", ecs.PluginType), args)
+			if err != nil {
+				return nil, fmt.Errorf("failed to init remote ecs, %w", err)
+			}
+			remoteFastForward = newSubChain(p.(handler.Executable), remoteFastForward)
+		}
+
+		// Only the default local route is checked. The local response that
+		// is verified by local ip is not checked either, the remote upstream
+		// will be used anyway if it is not trusted.
+		defaultLocalForward := localFastForward
+		if opt.RemoteOnNXDomain {
+			defaultLocalForward = &nxdomainCheck{
+				local:              handler.WrapExecutable(localFastForward),
+				remote:             handler.WrapExecutable(remoteFastForward),
+				logger:             mlog.L().Named("nxdomain_check"),
+				localModifiesQuery: opt.StripECS,
+			}
+		}
+
+		route = append(route, pinNodes...)
+
+		// forward queries of forced clients, before all other routing rules.
+		if forced != nil {
+			route = append(route, &forcedClientRoute{
+				clients: forced,
+				local:   handler.WrapExecutable(localFastForward),
+				remote:  handler.WrapExecutable(remoteFastForward),
+				logger:  mlog.L().Named("forced_client"),
+			})
+		}
+
+		// let the custom router decide, see Router.
+		if hasCustomRouter() {
+			n, err := newRouterNode(localFastForward, remoteFastForward, groupForwarders, opt)
+			if err != nil {
+				return nil, err
+			}
+			route = append(route, n)
+		}
+
+		// forward scheduled domains during their hours.
+		scheduleNodes, err := initScheduleRules(opt.ScheduleRule, localFastForward, remoteFastForward)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init remote upstream, %w", err)
+			return nil, err
 		}
-		remoteFastForward = p.(handler.Executable)
+		route = append(route, scheduleNodes...)
+		route = append(route, groupNodes...)
 
 		var localIPMatcher handler.Matcher
 		var localDomainMatcher handler.Matcher
 		var remoteDomainMatcher handler.Matcher
 
-		if len(opt.LocalIP) > 0 {
-			nl := netlist.NewList()
-			if err := netlist.BatchLoadFromFiles(nl, opt.LocalIP); err != nil {
-				return nil, fmt.Errorf("failed to load local ip file, %w", err)
+		if len(opt.LocalIP) > 0 || rules.hasIPs(ruleLocal) || len(opt.GeoIPDB) > 0 {
+			var ipMatchers anyIPMatcher
+			if len(opt.LocalIP) > 0 || rules.hasIPs(ruleLocal) {
+				l, err := newIPListWithRules(opt.LocalIP, opt.Rules, ruleLocal)
+				if err != nil {
+					return nil, fmt.Errorf("failed to load local ip file, %w", err)
+				}
+				registerReloadable("local ip", l)
+				mlog.S().Infof("local ip files loaded, total length: %d", l.Len())
+				ipMatchers = append(ipMatchers, l)
+			}
+			if len(opt.GeoIPDB) > 0 {
+				g, err := newGeoIPDB(opt.GeoIPDB, localCountries())
+				if err != nil {
+					return nil, err
+				}
+				registerReloadable("geoip database", g)
+				ipMatchers = append(ipMatchers, g)
 			}
-			nl.Sort()
-			mlog.S().Infof("local ip files loaded, total length: %d", nl.Len())
-			localIPMatcher = msg_matcher.NewAAAAAIPMatcher(nl)
+			mode, err := localIPVerifyMode(opt)
+			if err != nil {
+				return nil, err
+			}
+			localIPMatcher = &localIPVerifier{l: ipMatchers, mode: mode, noIP: opt.LocalNoIP}
 		}
 
-		if len(opt.LocalDomain) > 0 {
-			matcher, err := loadDomainMatcher(opt.LocalDomain)
+		if len(opt.LocalDomain) > 0 || rules.hasDomains(ruleLocal) {
+			l, err := newDomainListWithRules(opt.LocalDomain, opt.Rules, ruleLocal)
 			if err != nil {
 				return nil, fmt.Errorf("failed to load local domain file, %w", err)
 			}
-			mlog.S().Infof("local domain files loaded, total length: %d", matcher.Len())
-			localDomainMatcher = msg_matcher.NewQNameMatcher(matcher)
+			registerReloadable("local domain", l)
+			mlog.S().Infof("local domain files loaded, total length: %d", l.Len())
+			localDomainMatcher = msg_matcher.NewQNameMatcher(l)
 		}
 
-		if len(opt.RemoteDomain) > 0 {
-			matcher, err := loadDomainMatcher(opt.RemoteDomain)
+		if remoteDomains == nil && (len(opt.RemoteDomain) > 0 || rules.hasDomains(ruleRemote)) {
+			remoteDomains, err = loadRemoteDomains()
 			if err != nil {
-				return nil, fmt.Errorf("failed to load remote domain file, %w", err)
+				return nil, err
 			}
-			mlog.S().Infof("remote domain files loaded, total length: %d", matcher.Len())
-			remoteDomainMatcher = msg_matcher.NewQNameMatcher(matcher)
+		}
+		if remoteDomains != nil {
+			remoteDomainMatcher = msg_matcher.NewQNameMatcher(remoteDomains)
 		}
 
-		switch {
-		case localIPMatcher != nil:
-			// forward local domain to local upstream.
-			if localDomainMatcher != nil {
-				innerNode := handler.WrapExecutable(localFastForward)
-				innerNode.LinkNext(handler.WrapExecutable(&end{}))
-				node := &executable_seq.IfNode{
-					ConditionMatcher: localDomainMatcher,
-					ExecutableNode:   innerNode,
-				}
-				route = append(route, node)
+		// forward AAAA query to remote upstream.
+		if opt.IPv6RemoteOnly {
+			innerNode := handler.WrapExecutable(remoteFastForward)
+			innerNode.LinkNext(handler.WrapExecutable(&end{}))
+			node := &executable_seq.IfNode{
+				ConditionMatcher: traceMatcher("AAAA query, matched --ipv6-remote-only", msg_matcher.NewQTypeMatcher(elem.NewIntMatcher([]int{int(dns.TypeAAAA)}))),
+				ExecutableNode:   innerNode,
 			}
+			route = append(route, node)
+		}
 
-			// forward remote domain to remote upstream.
-			if remoteDomainMatcher != nil {
-				innerNode := handler.WrapExecutable(remoteFastForward)
-				innerNode.LinkNext(handler.WrapExecutable(&end{}))
-				node := &executable_seq.IfNode{
-					ConditionMatcher: remoteDomainMatcher,
-					ExecutableNode:   innerNode,
-				}
-				route = append(route, node)
+		// forward queries by their types.
+		for _, qr := range [...]struct {
+			types []string
+			e     handler.Executable
+			flag  string
+		}{{opt.LocalQType, localFastForward, "--local-qtype"}, {opt.RemoteQType, remoteFastForward, "--remote-qtype"}} {
+			if len(qr.types) == 0 {
+				continue
 			}
+			types, err := parseQTypes(qr.types)
+			if err != nil {
+				return nil, err
+			}
+			innerNode := handler.WrapExecutable(qr.e)
+			innerNode.LinkNext(handler.WrapExecutable(&end{}))
+			node := &executable_seq.IfNode{
+				ConditionMatcher: traceMatcher("query type matched "+qr.flag, msg_matcher.NewQTypeMatcher(elem.NewIntMatcher(types))),
+				ExecutableNode:   innerNode,
+			}
+			route = append(route, node)
+		}
+
+		// forward local domain to local upstream.
+		if localDomainMatcher != nil {
+			innerNode := handler.WrapExecutable(localFastForward)
+			innerNode.LinkNext(handler.WrapExecutable(&end{}))
+			node := &executable_seq.IfNode{
+				ConditionMatcher: traceMatcher("matched local domain", localDomainMatcher),
+				ExecutableNode:   innerNode,
+			}
+			route = append(route, node)
+		}
 
+		// forward remote domain to remote upstream.
+		if remoteDomainMatcher != nil {
+			innerNode := handler.WrapExecutable(remoteFastForward)
+			innerNode.LinkNext(handler.WrapExecutable(&end{}))
+			node := &executable_seq.IfNode{
+				ConditionMatcher: traceMatcher("matched remote domain", remoteDomainMatcher),
+				ExecutableNode:   innerNode,
+			}
+			route = append(route, node)
+		}
+
+		// forward the rest.
+		defaultRoute, err := defaultRouteOf(opt.DefaultRoute, localIPMatcher != nil, localDomainMatcher != nil, remoteDomainMatcher != nil)
+		if err != nil {
+			return nil, err
+		}
+		if opt.DispatchMode == "adaptive" && (localIPMatcher == nil || defaultRoute == "remote") {
+			return nil, errors.New("adaptive dispatch mode requires local ip and local default route")
+		}
+		route = traceStep(route, "no routing rule matched, default route is "+defaultRoute)
+		switch {
+		case defaultRoute == "remote":
+			route = append(route, remoteFastForward)
+		case localIPMatcher != nil:
 			// forward non A/AAAA query to local upstream.
 			m := executable_seq.NagateMatcher(msg_matcher.NewQTypeMatcher(elem.NewIntMatcher([]int{1, 28})))
-			innerNode := handler.WrapExecutable(localFastForward)
+			m = traceMatcher("not an A/AAAA query, it can't be verified by local ip", m)
+			innerNode := handler.WrapExecutable(defaultLocalForward)
 			innerNode.LinkNext(handler.WrapExecutable(&end{}))
 			node := &executable_seq.IfNode{
 				ConditionMatcher: m,
@@ -453,45 +1240,28 @@ func initEntry() (handler.ExecutableChainNode, error) {
 			}
 			primaryRoot.LinkNext(primaryIf)
 
-			localLatency := opt.LocalLatency
-			if localLatency <= 0 {
-				localLatency = 50
+			if opt.DispatchMode == "adaptive" {
+				a := newAdaptiveRoute(primaryRoot, handler.WrapExecutable(remoteFastForward),
+					time.Duration(opt.AdaptiveTTL)*time.Second, mlog.L().Named("adaptive"))
+				registerCloser(a)
+				adminAPI.setAdaptive(a)
+				route = append(route, a)
+				break
 			}
 			c := &executable_seq.FallbackConfig{
-				Primary:       primaryRoot,
-				Secondary:     handler.WrapExecutable(remoteFastForward),
-				FastFallback:  localLatency,
-				AlwaysStandby: true,
+				Primary:   primaryRoot,
+				Secondary: handler.WrapExecutable(remoteFastForward),
+			}
+			if err := setDispatchMode(c, opt); err != nil {
+				return nil, err
 			}
 			fallbackNode, err := executable_seq.ParseFallbackNode(c, mlog.L())
 			if err != nil {
 				return nil, fmt.Errorf("inner err, failed to init fallback node, %w", err)
 			}
 			route = append(route, fallbackNode)
-		case localDomainMatcher != nil && remoteDomainMatcher == nil:
-			// forward local domain to local upstream.
-			innerNode := handler.WrapExecutable(localFastForward)
-			innerNode.LinkNext(handler.WrapExecutable(&end{}))
-			node := &executable_seq.IfNode{
-				ConditionMatcher: localDomainMatcher,
-				ExecutableNode:   innerNode,
-			}
-			route = append(route, node)
-			// forward others to remote upstream.
-			route = append(route, remoteFastForward)
-		case remoteDomainMatcher != nil && localDomainMatcher == nil:
-			// forward remote domain to remote upstream.
-			innerNode := handler.WrapExecutable(remoteFastForward)
-			innerNode.LinkNext(handler.WrapExecutable(&end{}))
-			node := &executable_seq.IfNode{
-				ConditionMatcher: remoteDomainMatcher,
-				ExecutableNode:   innerNode,
-			}
-			route = append(route, node)
-			// forward others to local upstream.
-			route = append(route, localFastForward)
 		default:
-			return nil, errors.New("unsupported diversion mode")
+			route = append(route, defaultLocalForward)
 		}
 
 	}
@@ -507,7 +1277,7 @@ func initEntry() (handler.ExecutableChainNode, error) {
 
 	ii := make([]interface{}, 0, len(route))
 	for _, node := range route {
-		ii = append(ii, node)
+		ii = append(ii, traceNode(node))
 	}
 	entry, err := executable_seq.ParseExecutableNode(ii, mlog.L())
 	if err != nil {
@@ -519,7 +1289,7 @@ func initEntry() (handler.ExecutableChainNode, error) {
 	return entry, nil
 }
 
-func parseFastUpstream(s string) (*fastforward.UpstreamConfig, error) {
+func parseUpstream(s string) (*upstreamConfig, error) {
 	if !strings.Contains(s, "://") {
 		s = "udp://" + s
 	}
@@ -529,48 +1299,409 @@ func parseFastUpstream(s string) (*fastforward.UpstreamConfig, error) {
 	}
 	v := u.Query()
 	u.RawQuery = ""
-	uc := &fastforward.UpstreamConfig{
+	uc := &upstreamConfig{
 		Addr:               u.String(),
 		DialAddr:           v.Get("netaddr"),
 		Socks5:             v.Get("socks5"),
 		EnableHTTP3:        v.Get("enable_http3") == "true",
 		EnablePipeline:     v.Get("enable_pipeline") == "true",
-		MaxConns:           4,
+		MaxConns:           opt.UpstreamMaxConns,
 		InsecureSkipVerify: opt.Insecure,
+		Bootstrap:          opt.Bootstrap,
+		BootstrapTTL:       opt.BootstrapTTL,
+		Enable0x20:         opt.QName0x20,
+		EnablePadding:      opt.EDNSPadding,
+		EnableCookie:       opt.EDNSCookie,
+		EnableQNameMin:     opt.QNameMinimize,
+		MaxConcurrent:      opt.UpstreamMaxConcurrent,
+		EnableTFO:          opt.UpstreamTFO,
+		UDPSize:            opt.UDPSize,
+		MaxResponseSize:    opt.MaxResponseSize,
+		Retries:            opt.UpstreamRetries,
+		Reconnect:          opt.UpstreamReconnect,
+		RetryBackoff:       time.Duration(opt.UpstreamRetryBackoff) * time.Millisecond,
+		MaxCNAMEDepth:      opt.MaxCNAMEDepth,
+		UDPRandomPort:      opt.UDPRandomPort,
 	}
-	idt := 0
-	if s := v.Get("keepalive"); len(s) != 0 {
-		i, err := strconv.Atoi(s)
+	ednsOpts, err := parseEDNSOptions(opt.EDNSOption)
+	if err != nil {
+		return nil, err
+	}
+	uc.EDNSOptions = ednsOpts
+	idt := opt.UpstreamIdleTimeout
+	keepalive := v.Get("keepalive")
+	if s := v.Get("idle"); len(s) != 0 {
+		if len(keepalive) != 0 {
+			return nil, errors.New("keepalive and idle args can't be used together")
+		}
+		keepalive = s
+	}
+	if len(keepalive) != 0 {
+		i, err := strconv.Atoi(keepalive)
 		if err != nil {
 			return nil, fmt.Errorf("invalid keepalive arg, %w", err)
 		}
 		idt = i
 	}
 	uc.IdleTimeout = idt
+	if s := v.Get("max_conns"); len(s) != 0 {
+		i, err := strconv.Atoi(s)
+		if err != nil || i <= 0 {
+			return nil, fmt.Errorf("invalid max_conns arg %s", s)
+		}
+		uc.MaxConns = i
+	}
+	switch s := v.Get("http"); s {
+	case "":
+	case "2", "3":
+		if u.Scheme != "https" {
+			return nil, fmt.Errorf("http arg is not supported by %s upstream", u.Scheme)
+		}
+		if s == "2" && uc.EnableHTTP3 {
+			return nil, errors.New("http=2 conflicts with enable_http3=true")
+		}
+		uc.EnableHTTP3 = s == "3"
+	default:
+		return nil, fmt.Errorf("invalid http arg %s, must be 2 or 3", s)
+	}
+	if s := v.Get("max_response_size"); len(s) != 0 {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_response_size arg, %w", err)
+		}
+		uc.MaxResponseSize = i
+	}
+	if err := checkMsgSizeLimit(uc.MaxResponseSize); err != nil {
+		return nil, fmt.Errorf("invalid max response size, %w", err)
+	}
+	switch s := v.Get("trusted"); s {
+	case "":
+	case "true", "false":
+		uc.Trusted = s == "true"
+		uc.TrustedArg = true
+	default:
+		return nil, fmt.Errorf("invalid trusted arg %s, must be true or false", s)
+	}
+	if s := v.Get("weight"); len(s) != 0 {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight arg, %w", err)
+		}
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid weight arg %d, must be a positive integer", i)
+		}
+		uc.Weight = i
+	}
+	var isTLS bool
+	switch u.Scheme {
+	case "tls", "https", "quic", "doq":
+		isTLS = true
+	}
+	if sni := v.Get("sni"); len(sni) != 0 {
+		if !isTLS {
+			return nil, fmt.Errorf("sni arg is not supported by %s upstream", u.Scheme)
+		}
+		uc.ServerName = sni
+	}
+	bind, err := parseBind(v.Get("bindaddr"), v.Get("bindif"))
+	if err != nil {
+		return nil, err
+	}
+	uc.Bind = bind
+	if v.Get("insecure") == "true" {
+		uc.InsecureSkipVerify = true
+	}
+	if uc.InsecureSkipVerify && isTLS {
+		mlog.S().Warnf("tls certificate verification of upstream %s is disabled, it is vulnerable to man-in-the-middle attacks", uc.Addr)
+	}
+	if u.Scheme == "https" {
+		logDoHSettings(uc)
+	}
 
 	return uc, nil
 }
 
-func initFastForwardArgs(upstreams []string) (*fastforward.Args, error) {
-	ua := new(fastforward.Args)
-	for i, s := range upstreams {
-		uc, err := parseFastUpstream(s)
+// setDispatchMode sets how c races the local upstream (primary) and
+// the remote upstream (secondary).
+//   - standby: both are queried at once, but the remote response is held
+//     for --local-latency ms unless the local upstream failed or its
+//     response has no local ip.
+//   - delay: the remote upstream is only queried if the local upstream
+//     failed, its response has no local ip or it didn't respond in
+//     --remote-delay ms.
+//   - parallel: both are queried at once. The remote response is only
+//     used if the local upstream failed or its response has no local ip,
+//     no matter how long the local upstream takes.
+//
+// The adaptive mode doesn't use the fallback node, see adaptiveRoute.
+func setDispatchMode(c *executable_seq.FallbackConfig, opt *Opt) error {
+	switch opt.DispatchMode {
+	case "", "standby":
+		c.FastFallback = opt.LocalLatency
+		if c.FastFallback <= 0 {
+			c.FastFallback = 50
+		}
+		c.AlwaysStandby = true
+	case "delay":
+		if opt.RemoteDelay <= 0 {
+			return fmt.Errorf("invalid remote delay %d", opt.RemoteDelay)
+		}
+		c.FastFallback = opt.RemoteDelay
+	case "parallel":
+		// Hold the remote response until the query times out.
+		c.FastFallback = opt.QueryTimeout * 1000
+		if c.FastFallback <= 0 {
+			c.FastFallback = 5000 // default query timeout of dns_handler
+		}
+		c.AlwaysStandby = true
+	default:
+		return fmt.Errorf("invalid dispatch mode %s", opt.DispatchMode)
+	}
+	return nil
+}
+
+// logDoHSettings logs the effective connection settings of a DoH
+// upstream. Zero or negative values fall back to the defaults.
+func logDoHSettings(uc *upstreamConfig) {
+	idleTimeout := defaultDoHIdleTimeout
+	if uc.IdleTimeout > 0 {
+		idleTimeout = time.Duration(uc.IdleTimeout) * time.Second
+	}
+	maxConns := 2
+	if uc.MaxConns > 0 {
+		maxConns = uc.MaxConns
+	}
+	version := "2"
+	if uc.EnableHTTP3 {
+		version = "3"
+	}
+	mlog.S().Debugf("doh upstream %s: http/%s, idle timeout %s, max conns %d", uc.Addr, version, idleTimeout, maxConns)
+}
+
+// defaultRouteOf returns where queries that match no domain list go,
+// "local" or "remote". If route is not set, it is "local" if local ip
+// or remote domain is configured, or "remote" if only local domain is
+// configured. In "local" route with local ip, the response of local
+// upstream is still checked by local ip.
+func defaultRouteOf(route string, hasLocalIP, hasLocalDomain, hasRemoteDomain bool) (string, error) {
+	switch route {
+	case "local", "remote":
+		return route, nil
+	case "":
+	default:
+		return "", fmt.Errorf("invalid default route %s", route)
+	}
+	switch {
+	case hasLocalIP:
+		return "local", nil
+	case hasLocalDomain && !hasRemoteDomain:
+		return "remote", nil
+	case hasRemoteDomain && !hasLocalDomain:
+		return "local", nil
+	case hasLocalDomain && hasRemoteDomain:
+		return "", errors.New("default route is required if both local and remote domain are configured without local ip")
+	default:
+		return "", errors.New("unsupported diversion mode")
+	}
+}
+
+// localIPVerifyMode returns the mode of localIPVerifier.
+// --trust-local-ip-only is the same as --verify-local-ip all.
+func localIPVerifyMode(opt *Opt) (string, error) {
+	mode := opt.VerifyLocalIP
+	if len(mode) == 0 {
+		mode = "any"
+	}
+	switch mode {
+	case "any", "all", "off":
+	default:
+		return "", fmt.Errorf("invalid verify local ip mode %s", mode)
+	}
+	// local-ip-match strict|any is another way to set verify-local-ip all|any.
+	if len(opt.LocalIPMatch) > 0 {
+		var m string
+		switch opt.LocalIPMatch {
+		case "strict":
+			m = "all"
+		case "any":
+			m = "any"
+		default:
+			return "", fmt.Errorf("invalid local ip match mode %s", opt.LocalIPMatch)
+		}
+		if len(opt.VerifyLocalIP) > 0 && opt.VerifyLocalIP != m {
+			return "", fmt.Errorf("local-ip-match %s conflicts with verify-local-ip %s", opt.LocalIPMatch, opt.VerifyLocalIP)
+		}
+		mode = m
+	}
+	if opt.TrustLocalIPOnly {
+		if opt.LocalIPMatch == "any" {
+			return "", errors.New("trust-local-ip-only conflicts with local-ip-match any")
+		}
+		if mode != "any" && mode != "all" {
+			return "", fmt.Errorf("trust-local-ip-only conflicts with verify-local-ip %s", mode)
+		}
+		mode = "all"
+	}
+	switch opt.LocalNoIP {
+	case "", "remote", "local", "local-nxdomain":
+	default:
+		return "", fmt.Errorf("invalid local no ip policy %s", opt.LocalNoIP)
+	}
+	return mode, nil
+}
+
+// checkMsgSizeLimit checks the size limit of queries or responses.
+// Zero means no limit.
+func checkMsgSizeLimit(n int) error {
+	if n != 0 && (n < dns.MinMsgSize || n > dns.MaxMsgSize) {
+		return fmt.Errorf("%d is not in [%d, %d]", n, dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	return nil
+}
+
+// parseQTypes parses query type names (e.g. "HTTPS") or numbers.
+func parseQTypes(ss []string) ([]int, error) {
+	types := make([]int, 0, len(ss))
+	for _, s := range ss {
+		if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+			types = append(types, int(t))
+			continue
+		}
+		t, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unknown query type %s", s)
+		}
+		types = append(types, int(t))
+	}
+	return types, nil
+}
+
+// parseECS parses a "ip/prefix" string. If prefix is omitted,
+// the default mask of the ecs plugin will be used.
+func parseECS(s string) (*ecs.Args, error) {
+	ipStr, maskStr, hasMask := strings.Cut(s, "/")
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %s", ipStr)
+	}
+	var mask int
+	if hasMask {
+		var err error
+		mask, err = strconv.Atoi(maskStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mask, %w", err)
+		}
+	}
+	args := new(ecs.Args)
+	if ip4 := ip.To4(); ip4 != nil {
+		if mask < 0 || mask > 32 {
+			return nil, fmt.Errorf("invalid ipv4 mask %d", mask)
+		}
+		args.IPv4 = ip4.String()
+		args.Mask4 = uint8(mask)
+	} else {
+		if mask < 0 || mask > 128 {
+			return nil, fmt.Errorf("invalid ipv6 mask %d", mask)
+		}
+		args.IPv6 = ip.String()
+		args.Mask6 = uint8(mask)
+	}
+	return args, nil
+}
+
+// initForwarder inits a forwarder from upstream addresses.
+// Upstreams with the trusted arg are trusted. If no upstream has the
+// arg, the first upstream is trusted unless race is set. Responses
+// containing ips in bogusIP will be discarded if it is not nil.
+func initForwarder(name string, upstreams []string, race bool, bogusIP netlist.Matcher) (*forwarder, error) {
+	cs := make([]*upstreamConfig, 0, len(upstreams))
+	hasTrustedArg := false
+	for _, s := range upstreams {
+		uc, err := parseUpstream(s)
 		if err != nil {
 			return nil, fmt.Errorf("invalid upstream address [%s], %w", s, err)
 		}
-		if i == 0 {
-			uc.Trusted = true
+		if uc.TrustedArg {
+			if race && uc.Trusted {
+				return nil, fmt.Errorf("invalid upstream address [%s], trusted upstream can't be used in race mode", s)
+			}
+			hasTrustedArg = true
 		}
-		ua.Upstream = append(ua.Upstream, uc)
+		uc.BogusIP = bogusIP
+		cs = append(cs, uc)
+	}
+	if !hasTrustedArg && !race && len(cs) > 0 {
+		cs[0].Trusted = true
+	}
+	f, err := newForwarder(name, cs, opt.CA, race, mlog.L().Named(name))
+	if err != nil {
+		return nil, err
+	}
+	registerCloser(f)
+	adminAPI.addForwarder(f)
+	if opt.HealthCheckInterval > 0 {
+		f.startHealthCheck(time.Duration(opt.HealthCheckInterval)*time.Second, opt.HealthCheckDomain)
 	}
-	ua.CA = opt.CA
-	return ua, nil
+	return f, nil
 }
 
-func loadDomainMatcher(files []string) (*domain.MixMatcher[struct{}], error) {
+// loadRemoteDomains loads the domains of --remote-domain and the
+// remote rules.
+func loadRemoteDomains() (*domainList, error) {
+	l, err := newDomainListWithRules(opt.RemoteDomain, opt.Rules, ruleRemote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load remote domain file, %w", err)
+	}
+	registerReloadable("remote domain", l)
+	mlog.S().Infof("remote domain files loaded, total length: %d", l.Len())
+	return l, nil
+}
+
+func loadDomainMatcher(files []string) (domain.Matcher[struct{}], error) {
+	files, err := downloadEntries(files)
+	if err != nil {
+		return nil, err
+	}
 	mixMatcher := domain.NewMixMatcher[struct{}]()
-	if err := domain.BatchLoad[struct{}](mixMatcher, addFilePrefix(files), nil); err != nil {
+	mixMatcher.SetDefaultMatcher(domain.MatcherDomain)
+	m := idnaMatcher[struct{}]{mixMatcher}
+	for _, f := range files {
+		var err error
+		if _, _, ok := splitDATEntry(f); ok {
+			// Only a MixMatcher can load a dat file. Its domains are
+			// already in punycode.
+			if err = domain.LoadFromFile[struct{}](mixMatcher, f, nil); err != nil {
+				err = geoSiteTagError(f, err)
+			}
+		} else {
+			err = loadListFile(f, func(v string) error { return m.Add(v, struct{}{}) })
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load entry %s: %w", f, err)
+		}
+	}
+	return m, nil
+}
+
+// wildcardMatcher is a domain.MixMatcher that also accepts wildcard
+// patterns. "*.lan" is equal to "domain:lan".
+type wildcardMatcher[T any] struct {
+	*domain.MixMatcher[T]
+}
+
+func (m wildcardMatcher[T]) Add(s string, v T) error {
+	if strings.HasPrefix(s, "*.") {
+		s = "domain:" + s[2:]
+	}
+	return m.MixMatcher.Add(s, v)
+}
+
+func loadHosts(files []string) (*hosts.Hosts, error) {
+	mixMatcher := domain.NewMixMatcher[*hosts.IPs]()
+	mixMatcher.SetDefaultMatcher(domain.MatcherFull)
+	m := idnaMatcher[*hosts.IPs]{wildcardMatcher[*hosts.IPs]{mixMatcher}}
+	if err := domain.BatchLoad[*hosts.IPs](m, addFilePrefix(files), hosts.ParseIPs); err != nil {
 		return nil, err
 	}
-	return mixMatcher, nil
+	return hosts.NewHosts(m), nil
 }
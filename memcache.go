@@ -0,0 +1,189 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Same as the mem_cache from mosdns.
+	defaultCacheShards       = 256
+	defaultCacheMinShardSize = 4
+)
+
+// memCache is an in-memory cache backend. Unlike mem_cache from mosdns,
+// its shard number, cleanup interval and eviction policy are configurable
+// and it counts evicted entries.
+// A shard evicts an entry as soon as a new entry is stored into it while
+// it is full, so the cache never grows over its size between cleanups.
+type memCache struct {
+	seed   maphash.Seed
+	shards []*memCacheShard
+
+	evicted uint64 // atomic, entries evicted because their shard was full
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+type memCacheShard struct {
+	mu   sync.Mutex
+	size int
+	m    map[string]*memCacheElem
+	p    evictionPolicy
+}
+
+type memCacheElem struct {
+	v              []byte
+	storedTime     time.Time
+	expirationTime time.Time
+}
+
+// memCacheShardSize returns the size of each shard. If shards is 0,
+// the default number of shards will be used and the shard size will be
+// at least defaultCacheMinShardSize, like mem_cache does.
+func memCacheShardSize(size, shards int) (n, shardSize int, err error) {
+	if shards == 0 {
+		shardSize = size / defaultCacheShards
+		if shardSize < defaultCacheMinShardSize {
+			shardSize = defaultCacheMinShardSize
+		}
+		return defaultCacheShards, shardSize, nil
+	}
+	if shards < 0 {
+		return 0, 0, fmt.Errorf("invalid number of cache shards %d", shards)
+	}
+	if size < shards {
+		return 0, 0, fmt.Errorf("cache size %d is smaller than the number of cache shards %d", size, shards)
+	}
+	return shards, size / shards, nil
+}
+
+func newMemCache(shards, shardSize int, policy string, cleanupInterval time.Duration) (*memCache, error) {
+	newPolicy, err := evictionPolicyOf(policy)
+	if err != nil {
+		return nil, err
+	}
+	c := &memCache{
+		seed:      maphash.MakeSeed(),
+		shards:    make([]*memCacheShard, shards),
+		closeChan: make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &memCacheShard{
+			size: shardSize,
+			m:    make(map[string]*memCacheElem),
+			p:    newPolicy(),
+		}
+	}
+	go c.cleanupLoop(cleanupInterval)
+	return c, nil
+}
+
+func (c *memCache) shardOf(key string) *memCacheShard {
+	h := new(maphash.Hash)
+	h.SetSeed(c.seed)
+	h.WriteString(key)
+	return c.shards[h.Sum64()%uint64(len(c.shards))]
+}
+
+func (c *memCache) Get(key string) (v []byte, storedTime, expirationTime time.Time) {
+	s := c.shardOf(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.m[key]; ok {
+		s.p.touch(key)
+		return e.v, e.storedTime, e.expirationTime
+	}
+	return nil, time.Time{}, time.Time{}
+}
+
+func (c *memCache) Store(key string, v []byte, storedTime, expirationTime time.Time) {
+	if time.Now().After(expirationTime) {
+		return
+	}
+	buf := make([]byte, len(v))
+	copy(buf, v)
+	e := &memCacheElem{v: buf, storedTime: storedTime, expirationTime: expirationTime}
+
+	s := c.shardOf(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[key]; ok {
+		s.m[key] = e
+		s.p.touch(key)
+		return
+	}
+	for len(s.m) >= s.size {
+		victim := s.p.victim()
+		delete(s.m, victim)
+		s.p.remove(victim)
+		atomic.AddUint64(&c.evicted, 1)
+		metrics.observeCacheEviction()
+	}
+	s.m[key] = e
+	s.p.add(key)
+}
+
+func (c *memCache) cleanupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case now := <-ticker.C:
+			for _, s := range c.shards {
+				s.mu.Lock()
+				for key, e := range s.m {
+					if e.expirationTime.Before(now) {
+						delete(s.m, key)
+						s.p.remove(key)
+					}
+				}
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// evictions returns the number of entries that were evicted
+// because the cache was full.
+func (c *memCache) evictions() uint64 {
+	return atomic.LoadUint64(&c.evicted)
+}
+
+func (c *memCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += len(s.m)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (c *memCache) Close() error {
+	c.closeOnce.Do(func() { close(c.closeChan) })
+	return nil
+}
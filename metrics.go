@@ -0,0 +1,200 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// metrics is nil if metrics are disabled. All dnsMetrics methods
+// are no-op on a nil receiver.
+var metrics *dnsMetrics
+
+type dnsMetrics struct {
+	reg   *prometheus.Registry
+	pprof bool // also serve the pprof handlers
+
+	queries          *prometheus.CounterVec
+	cacheHits        prometheus.Counter
+	cacheMisses      prometheus.Counter
+	cacheEvictions   prometheus.Counter
+	blocked          prometheus.Counter
+	routes           *prometheus.CounterVec
+	upstreamDuration *prometheus.HistogramVec
+	upstreamErrors   *prometheus.CounterVec
+	upstreamQueries  *prometheus.GaugeVec
+	reconnects       *prometheus.CounterVec
+}
+
+func newDNSMetrics() *dnsMetrics {
+	m := &dnsMetrics{
+		reg: prometheus.NewRegistry(),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mosdns_cn_queries_total",
+			Help: "The total number of queries.",
+		}, []string{"qtype"}),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mosdns_cn_cache_hits_total",
+			Help: "The total number of cache hits.",
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mosdns_cn_cache_misses_total",
+			Help: "The total number of cache misses.",
+		}),
+		cacheEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mosdns_cn_cache_evictions_total",
+			Help: "The total number of entries that were evicted because the memory cache was full.",
+		}),
+		blocked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mosdns_cn_blocked_total",
+			Help: "The total number of queries that were blocked by the blacklist.",
+		}),
+		routes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mosdns_cn_route_total",
+			Help: "The total number of queries that were sent to the upstream group.",
+		}, []string{"route"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mosdns_cn_upstream_response_seconds",
+			Help:    "The response time of upstreams.",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		}, []string{"upstream", "qtype"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mosdns_cn_upstream_errors_total",
+			Help: "The total number of failed upstream exchanges.",
+		}, []string{"upstream", "qtype"}),
+		upstreamQueries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mosdns_cn_upstream_inflight_queries",
+			Help: "The number of queries that are waiting for the upstream's response.",
+		}, []string{"upstream"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mosdns_cn_upstream_reconnects_total",
+			Help: "The total number of queries that were retried because the upstream connection was dropped.",
+		}, []string{"upstream"}),
+	}
+	m.reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.queries,
+		m.cacheHits,
+		m.cacheMisses,
+		m.cacheEvictions,
+		m.blocked,
+		m.routes,
+		m.upstreamDuration,
+		m.upstreamErrors,
+		m.upstreamQueries,
+		m.reconnects,
+	)
+	return m
+}
+
+func (m *dnsMetrics) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+	if m.pprof {
+		registerPprof(mux)
+	}
+	return mux
+}
+
+func qtypeLabel(q *dns.Msg) string {
+	if len(q.Question) == 0 {
+		return ""
+	}
+	return dns.TypeToString[q.Question[0].Qtype]
+}
+
+func (m *dnsMetrics) observeQuery(q *dns.Msg) {
+	if m == nil {
+		return
+	}
+	m.queries.WithLabelValues(qtypeLabel(q)).Inc()
+}
+
+func (m *dnsMetrics) observeCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheHits.Inc()
+	} else {
+		m.cacheMisses.Inc()
+	}
+}
+
+func (m *dnsMetrics) observeCacheEviction() {
+	if m == nil {
+		return
+	}
+	m.cacheEvictions.Inc()
+}
+
+func (m *dnsMetrics) observeBlocked() {
+	if m == nil {
+		return
+	}
+	m.blocked.Inc()
+}
+
+func (m *dnsMetrics) observeRoute(route string) {
+	if m == nil {
+		return
+	}
+	m.routes.WithLabelValues(route).Inc()
+}
+
+func (m *dnsMetrics) observeUpstream(addr string, q *dns.Msg, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	qtype := qtypeLabel(q)
+	if err != nil {
+		m.upstreamErrors.WithLabelValues(addr, qtype).Inc()
+		return
+	}
+	m.upstreamDuration.WithLabelValues(addr, qtype).Observe(d.Seconds())
+}
+
+func (m *dnsMetrics) upstreamInflight(addr string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.upstreamQueries.WithLabelValues(addr).Add(delta)
+}
+
+func (m *dnsMetrics) observeReconnect(addr string) {
+	if m == nil {
+		return
+	}
+	m.reconnects.WithLabelValues(addr).Inc()
+}
+
+// queryCounter counts all incoming queries.
+type queryCounter struct{}
+
+func (c *queryCounter) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	metrics.observeQuery(qCtx.Q())
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
@@ -0,0 +1,76 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+var errResponseTooLarge = errors.New("response is too large")
+
+// msgSize returns the wire size of m with name compression.
+func msgSize(m *dns.Msg) int {
+	compress := m.Compress
+	m.Compress = true
+	n := m.Len()
+	m.Compress = compress
+	return n
+}
+
+// responseSizeUpstream discards responses that are larger than max
+// bytes, so the forwarder will wait for other upstreams.
+type responseSizeUpstream struct {
+	bundled_upstream.Upstream
+	max    int
+	logger *zap.Logger
+}
+
+func (u *responseSizeUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, err := u.Upstream.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if n := msgSize(r); n > u.max {
+		u.logger.Debug("oversized response discarded", zap.String("from", u.Address()), zap.Int("size", n))
+		return nil, errResponseTooLarge
+	}
+	return r, nil
+}
+
+// querySizeLimiter replies FORMERR to queries that are larger than
+// max bytes.
+type querySizeLimiter struct {
+	max    int
+	logger *zap.Logger
+}
+
+func (l *querySizeLimiter) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if n := msgSize(qCtx.Q()); n > l.max {
+		l.logger.Debug("oversized query rejected", qCtx.InfoField(), zap.Int("size", n))
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeFormatError)
+		qCtx.SetResponse(r, handler.ContextStatusRejected)
+		return nil
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
@@ -0,0 +1,99 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func Test_responseSizeUpstream(t *testing.T) {
+	r := newTestResponse(60)
+	size := msgSize(r)
+	u := &testUpstream{addr: "large", f: func(q *dns.Msg) (*dns.Msg, error) {
+		return r.Copy(), nil
+	}}
+
+	tests := []struct {
+		name    string
+		max     int
+		wantErr error
+	}{
+		{name: "at limit", max: size},
+		{name: "over limit", max: size - 1, wantErr: errResponseTooLarge},
+		{name: "default limit", max: dns.MinMsgSize, wantErr: errResponseTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			su := &responseSizeUpstream{Upstream: u, max: tt.max, logger: zap.NewNop()}
+			got, err := su.Exchange(context.Background(), newTestQuery("example.com", dns.TypeA))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Exchange() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(got.Answer) != len(r.Answer) {
+				t.Fatalf("got %d answers, want %d", len(got.Answer), len(r.Answer))
+			}
+		})
+	}
+
+	// The forwarder uses other upstreams and fails if all responses
+	// are discarded.
+	small := &testUpstream{addr: "small", f: func(q *dns.Msg) (*dns.Msg, error) {
+		return newTestResponse(1), nil
+	}}
+	limited := newObservedUpstream(&responseSizeUpstream{Upstream: u, max: dns.MinMsgSize, logger: zap.NewNop()}, 0)
+	f := &forwarder{name: "test", logger: zap.NewNop(), us: []*observedUpstream{limited, newObservedUpstream(small, 0)}}
+	qCtx := handler.NewContext(newTestQuery("example.com", dns.TypeA), nil)
+	if err := f.Exec(context.Background(), qCtx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := qCtx.R(); got == nil || len(got.Answer) != 1 {
+		t.Fatalf("response of the small upstream is not used, got %v", got)
+	}
+
+	f = &forwarder{name: "test", logger: zap.NewNop(), us: []*observedUpstream{limited}}
+	qCtx = handler.NewContext(newTestQuery("example.com", dns.TypeA), nil)
+	if err := f.Exec(context.Background(), qCtx, nil); !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("Exec() error = %v, want %v", err, errResponseTooLarge)
+	}
+	if qCtx.Status() != handler.ContextStatusServerFailed {
+		t.Fatalf("status = %s, want %s", qCtx.Status(), handler.ContextStatusServerFailed)
+	}
+}
+
+func Test_querySizeLimiter(t *testing.T) {
+	q := newTestQuery("example.com", dns.TypeA)
+	size := msgSize(q)
+	for _, max := range []int{size, size - 1} {
+		l := &querySizeLimiter{max: max, logger: zap.NewNop()}
+		upstream := &testResponder{}
+		qCtx := handler.NewContext(q.Copy(), nil)
+		execChain(t, qCtx, l, upstream)
+		wantRcode := dns.RcodeSuccess
+		if size > max {
+			wantRcode = dns.RcodeFormatError
+		}
+		if r := qCtx.R(); r == nil || r.Rcode != wantRcode {
+			t.Fatalf("max %d: got response %v, want rcode %s", max, r, dns.RcodeToString[wantRcode])
+		}
+	}
+}
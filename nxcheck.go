@@ -0,0 +1,68 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// nxdomainCheck double-checks the NXDOMAIN responses of the local
+// upstream with the remote upstream, because some networks block domains
+// by answering NXDOMAIN. If the remote upstream answers NOERROR, its
+// response is used. Otherwise, e.g. both are NXDOMAIN, the local response
+// is kept. The remote response is never checked again, so a query can't
+// bounce between the upstreams.
+type nxdomainCheck struct {
+	local  handler.ExecutableChainNode
+	remote handler.ExecutableChainNode
+	logger *zap.Logger
+
+	// localModifiesQuery is set if the local chain modifies the query,
+	// e.g. strips its ecs. The remote check needs a copy of the original
+	// query then.
+	localModifiesQuery bool
+}
+
+func (c *nxdomainCheck) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	var rCtx *handler.Context
+	if c.localModifiesQuery {
+		rCtx = qCtx.Copy()
+	}
+	if err := handler.ExecChainNode(ctx, qCtx, c.local); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r != nil && r.Rcode == dns.RcodeNameError {
+		if rCtx == nil {
+			rCtx = qCtx.Copy()
+		}
+		err := handler.ExecChainNode(ctx, rCtx, c.remote)
+		switch rr := rCtx.R(); {
+		case err != nil:
+			c.logger.Debug("remote check failed, local NXDOMAIN is used", qCtx.InfoField(), zap.Error(err))
+		case rr != nil && rr.Rcode == dns.RcodeSuccess:
+			c.logger.Debug("local NXDOMAIN is overridden by remote response", qCtx.InfoField())
+			qCtx.SetResponse(rr, rCtx.Status())
+		default:
+			c.logger.Debug("local NXDOMAIN is confirmed by remote", qCtx.InfoField())
+		}
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
@@ -0,0 +1,96 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+)
+
+// rcodeResponder is a handler.Executable that replies rcode, and records
+// whether the queries it got have ecs.
+type rcodeResponder struct {
+	rcode   int
+	queries int
+	ecs     bool
+}
+
+func (r *rcodeResponder) Exec(_ context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	r.queries++
+	r.ecs = dnsutils.GetMsgECS(qCtx.Q()) != nil
+	m := new(dns.Msg)
+	m.SetRcode(qCtx.Q(), r.rcode)
+	qCtx.SetResponse(m, handler.ContextStatusResponded)
+	return nil
+}
+
+func Test_nxdomainCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		localRcode  int
+		remoteRcode int
+		wantRcode   int
+		wantRemote  bool
+	}{
+		{name: "local noerror", localRcode: dns.RcodeSuccess, remoteRcode: dns.RcodeSuccess, wantRcode: dns.RcodeSuccess},
+		{name: "remote overrides", localRcode: dns.RcodeNameError, remoteRcode: dns.RcodeSuccess, wantRcode: dns.RcodeSuccess, wantRemote: true},
+		{name: "remote confirms", localRcode: dns.RcodeNameError, remoteRcode: dns.RcodeNameError, wantRcode: dns.RcodeNameError, wantRemote: true},
+		{name: "remote fails", localRcode: dns.RcodeNameError, remoteRcode: dns.RcodeServerFailure, wantRcode: dns.RcodeNameError, wantRemote: true},
+	}
+	for _, tt := range tests {
+		for _, strip := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s, strip ecs %v", tt.name, strip), func(t *testing.T) {
+				local := &rcodeResponder{rcode: tt.localRcode}
+				remote := &rcodeResponder{rcode: tt.remoteRcode}
+				c := &nxdomainCheck{
+					local:              linkChain(local),
+					remote:             linkChain(remote),
+					logger:             zap.NewNop(),
+					localModifiesQuery: strip,
+				}
+				if strip {
+					c.local = linkChain(&stripECS{}, local)
+				}
+
+				q := newTestQuery("example.com", dns.TypeA)
+				dnsutils.AddECS(dnsutils.UpgradeEDNS0(q), dnsutils.NewEDNS0Subnet(net.IPv4(1, 2, 3, 0), 24, false), true)
+				qCtx := handler.NewContext(q, nil)
+				execChain(t, qCtx, c)
+
+				if r := qCtx.R(); r == nil || r.Rcode != tt.wantRcode {
+					t.Fatalf("got response %v, want rcode %s", r, dns.RcodeToString[tt.wantRcode])
+				}
+				if local.ecs == strip {
+					t.Fatalf("local query has ecs = %v, want %v", local.ecs, !strip)
+				}
+				if got := remote.queries > 0; got != tt.wantRemote {
+					t.Fatalf("remote queried = %v, want %v", got, tt.wantRemote)
+				}
+				if tt.wantRemote && !remote.ecs {
+					t.Fatal("remote check got the query modified by the local chain")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,85 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// RFC 8467 recommended block length for queries.
+const queryPaddingBlockSize = 128
+
+// paddingUpstream pads queries to a multiple of queryPaddingBlockSize
+// (RFC 7830, RFC 8467). The padding option in the query also asks the
+// server to pad its response. Padding that the client didn't ask for
+// will be removed from the response.
+type paddingUpstream struct {
+	bundled_upstream.Upstream
+}
+
+// isPaddingApplicable reports whether addr is an encrypted upstream.
+func isPaddingApplicable(addr string) bool {
+	scheme, _, _ := strings.Cut(addr, "://")
+	switch scheme {
+	case "tls", "https", "quic", "doq":
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *paddingUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	clientOpt := q.IsEdns0()
+	clientPadding := clientOpt != nil && dnsutils.GetEDNS0Option(clientOpt, dns.EDNS0PADDING) != nil
+
+	qCopy := q.Copy()
+	padQuery(qCopy)
+	r, err := u.Upstream.Exchange(ctx, qCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case clientOpt == nil:
+		dnsutils.RemoveEDNS0(r)
+	case !clientPadding:
+		if opt := r.IsEdns0(); opt != nil {
+			dnsutils.RemoveEDNS0Option(opt, dns.EDNS0PADDING)
+		}
+	}
+	return r, nil
+}
+
+// padQuery adds a padding option to q, so its length will be a multiple of
+// queryPaddingBlockSize. Other edns0 options are kept.
+func padQuery(q *dns.Msg) {
+	opt := q.IsEdns0()
+	if opt == nil {
+		opt = dnsutils.UpgradeEDNS0(q)
+	}
+	dnsutils.RemoveEDNS0Option(opt, dns.EDNS0PADDING)
+	padding := new(dns.EDNS0_PADDING)
+	opt.Option = append(opt.Option, padding)
+	if l := q.Len() % queryPaddingBlockSize; l != 0 {
+		padding.Padding = make([]byte, queryPaddingBlockSize-l)
+	}
+}
@@ -0,0 +1,95 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// registerPprof mounts the net/http/pprof handlers on mux.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// pprofListenAddr returns the address to listen on for addr. If addr has
+// no host, it is bound to the loopback address only.
+func pprofListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if len(host) == 0 {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if !isLoopbackHost(host) {
+		mlog.S().Warnf("pprof is exposed on %s, it is not a loopback address", addr)
+	}
+	return addr, nil
+}
+
+// checkSharedPprofAddr warns if the pprof handlers are mounted on the
+// server of addr and addr is not a loopback address. Unlike its own
+// address, a shared address without host can't be bound to the loopback
+// address only, since the other server listens on it too.
+func checkSharedPprofAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		mlog.S().Warnf("pprof is exposed on %s, it is not a loopback address", addr)
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// startPprof serves the pprof handlers on its own address. It does nothing
+// if they are served by the metrics or admin server.
+func startPprof() {
+	if len(opt.PprofAddr) == 0 || opt.PprofAddr == opt.MetricsAddr || opt.PprofAddr == opt.AdminAddr {
+		return
+	}
+	addr, err := pprofListenAddr(opt.PprofAddr)
+	if err != nil {
+		mlog.S().Fatalf("invalid pprof addr, %v", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		mlog.S().Fatalf("failed to listen on pprof socket, %v", err)
+	}
+	mlog.S().Infof("serving pprof on %s/debug/pprof/", l.Addr())
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	go func() {
+		err := http.Serve(l, mux)
+		if err != nil {
+			mlog.S().Fatalf("pprof server exited: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// preferFamily strips the records of the non-preferred address family
+// from responses if the name also has addresses of the preferred one.
+// A query of the non-preferred type gets an empty response in this
+// case. It runs before the cache, so cached responses are never changed
+// and the preference can be changed without flushing the cache.
+type preferFamily struct {
+	prefer uint16 // dns.TypeA or dns.TypeAAAA
+	other  uint16
+	logger *zap.Logger
+}
+
+// newPreferFamily creates a preferFamily from "ipv4" or "ipv6".
+func newPreferFamily(s string, logger *zap.Logger) (*preferFamily, error) {
+	switch s {
+	case "ipv4":
+		return &preferFamily{prefer: dns.TypeA, other: dns.TypeAAAA, logger: logger}, nil
+	case "ipv6":
+		return &preferFamily{prefer: dns.TypeAAAA, other: dns.TypeA, logger: logger}, nil
+	default:
+		return nil, fmt.Errorf("invalid prefer %s, must be one of ipv4 and ipv6", s)
+	}
+}
+
+func (p *preferFamily) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if err := handler.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	q := qCtx.Q()
+	r := qCtx.R()
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	// Removing a signed rrset breaks the validation of the client.
+	if q.CheckingDisabled && dnssecOK(q) {
+		return nil
+	}
+	if !hasRRType(r.Answer, p.other) {
+		return nil
+	}
+
+	if q.Question[0].Qtype != p.other {
+		// e.g. ANY responses that contain both families.
+		if hasRRType(r.Answer, p.prefer) {
+			p.strip(qCtx, r)
+		}
+		return nil
+	}
+
+	qp := q.Copy()
+	qp.Question[0].Qtype = p.prefer
+	pCtx := handler.NewContext(qp, qCtx.ReqMeta())
+	if err := handler.ExecChainNode(ctx, pCtx, next); err != nil {
+		p.logger.Warn("failed to query preferred records", qCtx.InfoField(), zap.Error(err))
+		return nil
+	}
+	if rp := pCtx.R(); rp != nil && rp.Rcode == dns.RcodeSuccess && hasRRType(rp.Answer, p.prefer) {
+		p.strip(qCtx, r)
+	}
+	return nil
+}
+
+// strip replaces the response of qCtx with a copy of r without the
+// records of the non-preferred family.
+func (p *preferFamily) strip(qCtx *handler.Context, r *dns.Msg) {
+	res := r.Copy()
+	res.Answer = removeRRType(res.Answer, p.other)
+	res.Extra = removeRRType(res.Extra, p.other)
+	p.logger.Debug("non-preferred records removed", qCtx.InfoField())
+	qCtx.SetResponse(res, handler.ContextStatusResponded)
+}
+
+func hasRRType(rrs []dns.RR, t uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
+
+// removeRRType removes records of type t and their signatures from rrs.
+func removeRRType(rrs []dns.RR, t uint16) []dns.RR {
+	o := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t {
+			continue
+		}
+		o = append(o, rr)
+	}
+	return o
+}
@@ -0,0 +1,174 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+)
+
+const (
+	// qminMaxSteps is the maximum number of minimized queries sent
+	// before the full query (MAX_MINIMISE_COUNT of RFC 9156).
+	qminMaxSteps = 10
+
+	// qminMaxZones limits the number of learned zones of an upstream.
+	// They are cleared when it is full.
+	qminMaxZones = 4096
+)
+
+// qminUpstream sends minimized queries (RFC 7816) to an authoritative
+// upstream. Before the full query, the name is revealed one label at a
+// time with NS queries. If the upstream answers a referral or NXDOMAIN,
+// it is returned as the response and the rest of the name is never sent.
+//
+// It is a no-op for recursive upstreams, which is detected by the RA
+// flag of their responses. Zones that the upstream is authoritative for
+// are learned from the SOA records of its responses, so their labels
+// are not queried again.
+type qminUpstream struct {
+	bundled_upstream.Upstream
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	recursive bool
+	zones     map[string]struct{}
+}
+
+func newQminUpstream(u bundled_upstream.Upstream, logger *zap.Logger) *qminUpstream {
+	return &qminUpstream{Upstream: u, logger: logger, zones: make(map[string]struct{})}
+}
+
+func (u *qminUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) == 1 && !u.isRecursive() {
+		if r, ok := u.exchangeMinimized(ctx, q); ok {
+			return r, nil
+		}
+	}
+	r, err := u.Upstream.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	u.learn(r)
+	return r, nil
+}
+
+// exchangeMinimized sends the minimized queries of q. It reports false
+// if the full query is needed.
+func (u *qminUpstream) exchangeMinimized(ctx context.Context, q *dns.Msg) (*dns.Msg, bool) {
+	question := q.Question[0]
+	for _, name := range u.minimizedNames(question.Name) {
+		mq := q.Copy()
+		mq.Question[0] = dns.Question{Name: name, Qtype: dns.TypeNS, Qclass: question.Qclass}
+		r, err := u.Upstream.Exchange(ctx, mq)
+		if err != nil || r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			// Some servers don't answer queries of intermediate names well.
+			return nil, false
+		}
+		u.learn(r)
+		if u.isRecursive() {
+			return nil, false
+		}
+		if r.Rcode == dns.RcodeNameError || isReferral(r) {
+			// Nothing exists under a non-existent name (RFC 8020), and
+			// a referral means the upstream knows nothing more.
+			u.logger.Debug("minimized query answered", zap.String("qname", question.Name), zap.String("name", name), zap.Int("rcode", r.Rcode))
+			r.Id = q.Id
+			r.Question = q.Question
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// minimizedNames returns the ancestors of qname to be queried, from the
+// shortest one below the longest learned zone. qname itself is excluded.
+func (u *qminUpstream) minimizedNames(qname string) []string {
+	labels := dns.SplitDomainName(qname)
+	start := 1
+	u.mu.Lock()
+	for n := len(labels) - 1; n > 0; n-- {
+		if _, ok := u.zones[joinLabels(labels[len(labels)-n:])]; ok {
+			start = n + 1
+			break
+		}
+	}
+	u.mu.Unlock()
+
+	var names []string
+	for n := start; n < len(labels) && len(names) < qminMaxSteps; n++ {
+		names = append(names, joinLabels(labels[len(labels)-n:]))
+	}
+	return names
+}
+
+func joinLabels(labels []string) string {
+	return strings.ToLower(strings.Join(labels, ".")) + "."
+}
+
+// learn checks whether the upstream is recursive, and learns the zones
+// from an authoritative response.
+func (u *qminUpstream) learn(r *dns.Msg) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if r.RecursionAvailable {
+		if !u.recursive {
+			u.recursive = true
+			u.logger.Debug("upstream is recursive, qname minimization is disabled", zap.String("upstream", u.Address()))
+		}
+		return
+	}
+	if !r.Authoritative {
+		return
+	}
+	for _, section := range [...][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				continue
+			}
+			if len(u.zones) >= qminMaxZones {
+				u.zones = make(map[string]struct{})
+			}
+			u.zones[strings.ToLower(rr.Header().Name)] = struct{}{}
+		}
+	}
+}
+
+func (u *qminUpstream) isRecursive() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.recursive
+}
+
+// isReferral reports whether r is a referral to the servers of a child
+// zone.
+func isReferral(r *dns.Msg) bool {
+	if r.Authoritative || r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 {
+		return false
+	}
+	for _, rr := range r.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_qminUpstream(t *testing.T) {
+	type reply func(q *dns.Msg) *dns.Msg
+	authoritative := func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Authoritative = true
+		return r
+	}
+	nxdomainAt := func(name string) reply {
+		return func(q *dns.Msg) *dns.Msg {
+			r := authoritative(q)
+			if q.Question[0].Name == name {
+				r.Rcode = dns.RcodeNameError
+			}
+			return r
+		}
+	}
+	referralAt := func(name string) reply {
+		return func(q *dns.Msg) *dns.Msg {
+			if q.Question[0].Name != name {
+				return authoritative(q)
+			}
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Ns = []dns.RR{&dns.NS{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+				Ns:  "ns." + name,
+			}}
+			return r
+		}
+	}
+	recursive := func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.RecursionAvailable = true
+		return r
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		zones     []string
+		reply     reply
+		want      []string // "name type" of queries sent to the upstream
+		wantRcode int
+	}{
+		{
+			name:  "minimized",
+			qname: "a.b.example.com.",
+			reply: authoritative,
+			want:  []string{"com. NS", "example.com. NS", "b.example.com. NS", "a.b.example.com. A"},
+		},
+		{
+			name:  "learned zone",
+			qname: "a.b.example.com.",
+			zones: []string{"example.com."},
+			reply: authoritative,
+			want:  []string{"b.example.com. NS", "a.b.example.com. A"},
+		},
+		{
+			name:  "case insensitive",
+			qname: "A.B.Example.COM.",
+			reply: authoritative,
+			want:  []string{"com. NS", "example.com. NS", "b.example.com. NS", "A.B.Example.COM. A"},
+		},
+		{
+			name:      "nxdomain",
+			qname:     "a.b.example.com.",
+			reply:     nxdomainAt("example.com."),
+			want:      []string{"com. NS", "example.com. NS"},
+			wantRcode: dns.RcodeNameError,
+		},
+		{
+			name:  "referral",
+			qname: "a.b.example.com.",
+			reply: referralAt("example.com."),
+			want:  []string{"com. NS", "example.com. NS"},
+		},
+		{
+			name:  "recursive",
+			qname: "a.b.example.com.",
+			reply: recursive,
+			want:  []string{"com. NS", "a.b.example.com. A"},
+		},
+		{
+			name:  "top level domain",
+			qname: "com.",
+			reply: authoritative,
+			want:  []string{"com. A"},
+		},
+		{
+			name:  "max steps",
+			qname: "1.2.3.4.5.6.7.8.9.10.11.12.",
+			reply: authoritative,
+			want: []string{
+				"12. NS", "11.12. NS", "10.11.12. NS", "9.10.11.12. NS", "8.9.10.11.12. NS",
+				"7.8.9.10.11.12. NS", "6.7.8.9.10.11.12. NS", "5.6.7.8.9.10.11.12. NS",
+				"4.5.6.7.8.9.10.11.12. NS", "3.4.5.6.7.8.9.10.11.12. NS", "1.2.3.4.5.6.7.8.9.10.11.12. A",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			u := newQminUpstream(&testUpstream{f: func(q *dns.Msg) (*dns.Msg, error) {
+				got = append(got, q.Question[0].Name+" "+dns.TypeToString[q.Question[0].Qtype])
+				return tt.reply(q), nil
+			}}, zap.NewNop())
+			for _, z := range tt.zones {
+				u.zones[z] = struct{}{}
+			}
+
+			q := newTestQuery(tt.qname, dns.TypeA)
+			r, err := u.Exchange(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("queries sent:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if r.Rcode != tt.wantRcode || r.Id != q.Id || r.Question[0] != q.Question[0] {
+				t.Fatalf("unexpected response %v", r)
+			}
+		})
+	}
+}
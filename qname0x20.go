@@ -0,0 +1,108 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Responses that failed the case check will be discarded. The query
+// will be sent again with a new case pattern at most case0x20Retries times.
+const case0x20Retries = 1
+
+var errCase0x20Mismatch = errors.New("qname case mismatch, possibly a spoofed response")
+
+// case0x20Upstream randomizes the letter case of the query name
+// (draft-vixie-dnsext-dns0x20) and checks that the response echoes it.
+type case0x20Upstream struct {
+	bundled_upstream.Upstream
+}
+
+// is0x20Applicable reports whether addr is a plaintext upstream. 0x20 is
+// pointless for encrypted upstreams.
+func is0x20Applicable(addr string) bool {
+	scheme, _, _ := strings.Cut(addr, "://")
+	switch scheme {
+	case "udp", "tcp", "udpme":
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *case0x20Upstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return u.Upstream.Exchange(ctx, q)
+	}
+	name := q.Question[0].Name
+
+	var err error
+	for i := 0; i <= case0x20Retries; i++ {
+		qCopy := q.Copy()
+		randomName := randomizeCase(name)
+		qCopy.Question[0].Name = randomName
+
+		var r *dns.Msg
+		r, err = u.Upstream.Exchange(ctx, qCopy)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Question) != 1 || r.Question[0].Name != randomName {
+			err = errCase0x20Mismatch
+			continue
+		}
+		restoreCase(r, name)
+		return r, nil
+	}
+	return nil, err
+}
+
+func randomizeCase(s string) string {
+	rb := make([]byte, len(s))
+	rand.Read(rb)
+	b := []byte(s)
+	for i, c := range b {
+		if rb[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// restoreCase restores the client's letter case of name in r.
+func restoreCase(r *dns.Msg, name string) {
+	r.Question[0].Name = name
+	for _, section := range [...][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); strings.EqualFold(hdr.Name, name) {
+				hdr.Name = name
+			}
+		}
+	}
+}
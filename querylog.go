@@ -0,0 +1,330 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"sync"
+	"time"
+)
+
+type queryInfoKey struct{}
+
+// queryInfo collects information about how a query was resolved.
+// It is carried by the context.Context of the query. It is safe for
+// concurrent use, because local and remote upstreams may run in parallel.
+type queryInfo struct {
+	mu          sync.Mutex
+	cacheHit    bool
+	forcedRoute string // route of a forced client, see forcedClientRoute.
+	answers     []answerInfo
+
+	// extended dns errors of the response, see edeHandler.
+	edes           []*dns.EDNS0_EDE
+	upstreamFailed bool
+}
+
+type answerInfo struct {
+	route    string
+	upstream string
+	r        *dns.Msg
+}
+
+// withQueryInfo returns the queryInfo in ctx, or attaches a new one
+// to ctx if there is none.
+func withQueryInfo(ctx context.Context) (context.Context, *queryInfo) {
+	if qi := queryInfoFrom(ctx); qi != nil {
+		return ctx, qi
+	}
+	qi := new(queryInfo)
+	return context.WithValue(ctx, queryInfoKey{}, qi), qi
+}
+
+// queryInfoFrom returns the queryInfo in ctx. It returns nil if there is
+// none. All queryInfo methods are no-op on a nil receiver.
+func queryInfoFrom(ctx context.Context) *queryInfo {
+	qi, _ := ctx.Value(queryInfoKey{}).(*queryInfo)
+	return qi
+}
+
+func (qi *queryInfo) setCacheHit() {
+	if qi == nil {
+		return
+	}
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	qi.cacheHit = true
+}
+
+func (qi *queryInfo) setForcedRoute(route string) {
+	if qi == nil {
+		return
+	}
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	qi.forcedRoute = route
+}
+
+func (qi *queryInfo) getForcedRoute() string {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	return qi.forcedRoute
+}
+
+// addEDE records an extended dns error of the query. Errors of the
+// same code are only recorded once.
+func (qi *queryInfo) addEDE(code uint16, text string) {
+	if qi == nil {
+		return
+	}
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	for _, e := range qi.edes {
+		if e.InfoCode == code {
+			return
+		}
+	}
+	qi.edes = append(qi.edes, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+func (qi *queryInfo) getEDEs() []*dns.EDNS0_EDE {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	return append([]*dns.EDNS0_EDE(nil), qi.edes...)
+}
+
+func (qi *queryInfo) setUpstreamFailed() {
+	if qi == nil {
+		return
+	}
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	qi.upstreamFailed = true
+}
+
+func (qi *queryInfo) isUpstreamFailed() bool {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	return qi.upstreamFailed
+}
+
+func (qi *queryInfo) addAnswer(route, upstream string, r *dns.Msg) {
+	if qi == nil {
+		return
+	}
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	qi.answers = append(qi.answers, answerInfo{route: route, upstream: upstream, r: r})
+}
+
+func (qi *queryInfo) isCacheHit() bool {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	return qi.cacheHit
+}
+
+// answerOf returns the answerInfo whose response is r.
+func (qi *queryInfo) answerOf(r *dns.Msg) (answerInfo, bool) {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	if r == nil {
+		return answerInfo{}, false
+	}
+	for _, a := range qi.answers {
+		if a.r == r {
+			return a, true
+		}
+	}
+	return answerInfo{}, false
+}
+
+// queryLogger writes a json record for every query.
+type queryLogger struct {
+	logger *zap.Logger
+	w      *rotateFile
+}
+
+func newQueryLogger(file string, maxSize int64) (*queryLogger, error) {
+	w, err := newRotateFile(file, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	ec := zap.NewProductionEncoderConfig()
+	ec.EncodeTime = zapcore.ISO8601TimeEncoder
+	ec.MessageKey = zapcore.OmitKey
+	ec.LevelKey = zapcore.OmitKey
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(ec), zapcore.Lock(w), zap.InfoLevel)
+	return &queryLogger{logger: zap.New(core), w: w}, nil
+}
+
+// Close flushes and closes the log file.
+func (l *queryLogger) Close() error {
+	l.logger.Sync()
+	return l.w.Close()
+}
+
+func (l *queryLogger) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	ctx, qi := withQueryInfo(ctx)
+	err := handler.ExecChainNode(ctx, qCtx, next)
+
+	q := qCtx.Q()
+	fields := make([]zap.Field, 0, 10)
+	if ip := qCtx.ReqMeta().ClientIP; ip != nil {
+		fields = append(fields, zap.String("client", ip.String()))
+	}
+	if len(q.Question) > 0 {
+		question := q.Question[0]
+		fields = append(fields,
+			zap.String("qname", question.Name),
+			zap.String("qtype", dns.TypeToString[question.Qtype]),
+		)
+	}
+	r := qCtx.R()
+	if r != nil {
+		fields = append(fields, zap.String("rcode", dns.RcodeToString[r.Rcode]))
+	}
+	cacheHit := qi.isCacheHit()
+	fields = append(fields, zap.Bool("cache_hit", cacheHit))
+	if a, ok := qi.answerOf(r); ok && !cacheHit {
+		fields = append(fields, zap.String("route", a.route), zap.String("upstream", a.upstream))
+		if qi.getForcedRoute() == a.route {
+			fields = append(fields, zap.Bool("forced_client", true))
+		}
+	}
+	fields = append(fields, zap.Duration("latency", time.Since(qCtx.StartTime())))
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	l.logger.Info("", fields...)
+	return err
+}
+
+// upstreamLogger logs a one-line summary of how each query was answered.
+// Cache hits are logged at debug level, so they won't flood the log.
+type upstreamLogger struct {
+	logger *zap.SugaredLogger
+}
+
+func (l *upstreamLogger) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	ctx, qi := withQueryInfo(ctx)
+	err := handler.ExecChainNode(ctx, qCtx, next)
+
+	q := qCtx.Q()
+	if len(q.Question) == 0 {
+		return err
+	}
+	question := q.Question[0]
+	name := question.Name + " " + dns.TypeToString[question.Qtype]
+	latency := time.Since(qCtx.StartTime()).Milliseconds()
+	r := qCtx.R()
+	if r == nil {
+		l.logger.Infof("%s: no response, %dms, %v", name, latency, err)
+		return err
+	}
+	rcode := dns.RcodeToString[r.Rcode]
+
+	if qi.isCacheHit() {
+		l.logger.Debugf("%s: cache, %s, %dms", name, rcode, latency)
+		return err
+	}
+	if a, ok := qi.answerOf(r); ok {
+		route := a.route
+		if qi.getForcedRoute() == a.route {
+			route += " (forced client)"
+		}
+		l.logger.Infof("%s: %s upstream %s, %s, %dms", name, route, a.upstream, rcode, latency)
+		return err
+	}
+	from := "local rules" // e.g. hosts, no-ipv6
+	if qCtx.Status() == handler.ContextStatusRejected {
+		from = "blacklist"
+	}
+	l.logger.Infof("%s: %s, %s, %dms", name, from, rcode, latency)
+	return err
+}
+
+// rotateFile is an io.Writer that writes to a file. If the file is
+// larger than maxSize, it will be renamed to file.1 and a new file
+// will be created. Zero maxSize disables rotation.
+type rotateFile struct {
+	path    string
+	maxSize int64
+
+	f    *os.File
+	size int64
+}
+
+func newRotateFile(path string, maxSize int64) (*rotateFile, error) {
+	rf := &rotateFile{path: path, maxSize: maxSize}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotateFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+// Write is not safe for concurrent use.
+func (rf *rotateFile) Write(b []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s, %w", rf.path, err)
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotateFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(rf.path, rf.path+".1")
+	if err := rf.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (rf *rotateFile) Sync() error {
+	return rf.f.Sync()
+}
+
+func (rf *rotateFile) Close() error {
+	return rf.f.Close()
+}
@@ -0,0 +1,114 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/concurrent_map"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	rateLimiterShards          = 64
+	rateLimiterCleanupInterval = time.Minute
+)
+
+// rateLimiter is a token bucket rate limiter keyed by client ip.
+// Each client can send qps queries per second with a burst of qps.
+// Idle buckets will be removed periodically, so spoofed source
+// addresses won't use up the memory.
+type rateLimiter struct {
+	qps    float64
+	logger *zap.Logger
+
+	m *concurrent_map.ConcurrentMap // *tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(qps int, logger *zap.Logger) *rateLimiter {
+	l := &rateLimiter{
+		qps:    float64(qps),
+		logger: logger,
+		m:      concurrent_map.NewConcurrentMap(rateLimiterShards),
+	}
+	go l.cleanupLoop()
+	return l
+}
+
+// allow reports whether the client can send a query now.
+func (l *rateLimiter) allow(key string) bool {
+	now := time.Now()
+	return l.m.TestAndSet(key, func(v interface{}, ok bool) (interface{}, bool, bool) {
+		if !ok {
+			return &tokenBucket{tokens: l.qps - 1, last: now}, true, true
+		}
+		b := v.(*tokenBucket)
+		b.tokens += now.Sub(b.last).Seconds() * l.qps
+		if b.tokens > l.qps {
+			b.tokens = l.qps
+		}
+		b.last = now
+		if b.tokens < 1 {
+			return nil, false, false
+		}
+		b.tokens--
+		return nil, false, true
+	})
+}
+
+// isFull reports whether b has been refilled. A full bucket
+// is equal to no bucket.
+func (l *rateLimiter) isFull(b *tokenBucket, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*l.qps >= l.qps
+}
+
+func (l *rateLimiter) cleanupLoop() {
+	ticker := time.NewTicker(rateLimiterCleanupInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		var idle []string
+		l.m.RangeDo(func(key string, v interface{}) {
+			if l.isFull(v.(*tokenBucket), now) {
+				idle = append(idle, key)
+			}
+		})
+		for _, key := range idle {
+			l.m.TestAndSet(key, func(v interface{}, ok bool) (interface{}, bool, bool) {
+				return nil, ok && l.isFull(v.(*tokenBucket), now), true
+			})
+		}
+	}
+}
+
+func (l *rateLimiter) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if ip := qCtx.ReqMeta().ClientIP; ip != nil && !l.allow(string(ip.To16())) {
+		l.logger.Debug("client exceeded the rate limit, query refused", qCtx.InfoField(), zap.Stringer("client", ip))
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeRefused)
+		qCtx.SetResponse(r, handler.ContextStatusRejected)
+		return nil
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
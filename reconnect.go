@@ -0,0 +1,91 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// reconnectUpstream retries a query once if it failed because the
+// connection was dropped by the peer or a middlebox (reset, EOF, etc.).
+// The idle connections are closed before the retry, they were likely
+// dropped as well, so the retry is sent over a new connection.
+//
+// Dial errors and timeouts are returned as is, so an upstream that is
+// really down is not hidden by the retry.
+type reconnectUpstream struct {
+	upstream.Upstream
+	address string
+	logger  *zap.Logger
+}
+
+func (u *reconnectUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, err := u.Upstream.ExchangeContext(ctx, q)
+	if err == nil || ctx.Err() != nil || !isConnDropped(err) {
+		return r, err
+	}
+	u.logger.Info("upstream connection was dropped, reconnecting", zap.String("upstream", u.address), zap.Error(err))
+	metrics.observeReconnect(u.address)
+	u.Upstream.CloseIdleConnections()
+	return u.Upstream.ExchangeContext(ctx, q)
+}
+
+// isConnDropped reports whether err means that an established
+// connection was closed by the other side.
+func isConnDropped(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// Errors of the transports that are not exported.
+	s := err.Error()
+	for _, e := range [...]string{"dead connection", "connection lost", "GOAWAY", "connection reset"} {
+		if strings.Contains(s, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReconnectApplicable reports whether addr is a TCP, DoT or DoH
+// upstream, which keep connections open between queries.
+func isReconnectApplicable(addr string) bool {
+	scheme, _, _ := strings.Cut(addr, "://")
+	switch scheme {
+	case "tcp", "tls", "https":
+		return true
+	default:
+		return false
+	}
+}
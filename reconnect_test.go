@@ -0,0 +1,148 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingUpstream counts the queries sent to its upstream.
+type countingUpstream struct {
+	upstream.Upstream
+	queries int32
+}
+
+func (u *countingUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.queries, 1)
+	return u.Upstream.ExchangeContext(ctx, q)
+}
+
+// errUpstream fails every query with err.
+type errUpstream struct {
+	err error
+}
+
+func (u *errUpstream) ExchangeContext(context.Context, *dns.Msg) (*dns.Msg, error) {
+	return nil, u.err
+}
+
+func (u *errUpstream) CloseIdleConnections() {}
+
+func (u *errUpstream) Close() error { return nil }
+
+// startDroppingServer starts a tcp dns server that closes its first
+// connection after reading a query, and answers the queries of the
+// other connections. It returns the server address.
+func startDroppingServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for i := 0; ; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c *dns.Conn, drop bool) {
+				defer c.Close()
+				for {
+					q, err := c.ReadMsg()
+					if err != nil || drop {
+						return
+					}
+					r := new(dns.Msg)
+					r.SetReply(q)
+					if err := c.WriteMsg(r); err != nil {
+						return
+					}
+				}
+			}(&dns.Conn{Conn: c}, i == 0)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func Test_reconnectUpstream(t *testing.T) {
+	addr := "tcp://" + startDroppingServer(t)
+	u, err := newUpstream(addr, &upstreamOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	cu := &countingUpstream{Upstream: u}
+	ru := &reconnectUpstream{Upstream: cu, address: addr, logger: zap.NewNop()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := ru.ExchangeContext(ctx, newTestQuery("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if cu.queries != 2 {
+		t.Fatalf("upstream queried %d times, want 2", cu.queries)
+	}
+}
+
+func Test_reconnectUpstream_noRetry(t *testing.T) {
+	// A port that nobody listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := "tcp://" + l.Addr().String()
+	l.Close()
+	dialFailed, err := newUpstream(closedAddr, &upstreamOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialFailed.Close()
+
+	tests := []struct {
+		name string
+		u    upstream.Upstream
+	}{
+		{name: "dial failure", u: dialFailed},
+		{name: "timeout", u: &errUpstream{err: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}}},
+		{name: "other error", u: &errUpstream{err: errors.New("bad response")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cu := &countingUpstream{Upstream: tt.u}
+			ru := &reconnectUpstream{Upstream: cu, address: "tcp://127.0.0.1", logger: zap.NewNop()}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			if _, err := ru.ExchangeContext(ctx, newTestQuery("example.com", dns.TypeA)); err == nil {
+				t.Fatal("query succeeded")
+			}
+			if cu.queries != 1 {
+				t.Fatalf("upstream queried %d times, want 1", cu.queries)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"net"
+	"sync"
+)
+
+type reloadable interface {
+	reload() error
+	sourceFiles() []string
+}
+
+var (
+	reloadMu        sync.Mutex
+	reloadableLists = make(map[string]reloadable)
+)
+
+// registerReloadable registers l, so it will be reloaded by reloadLists.
+func registerReloadable(name string, l reloadable) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadableLists[name] = l
+}
+
+// reloadLists reloads all registered lists from their files.
+// If a list failed to reload, the old one will still be in use.
+func reloadLists() {
+	reloadMu.Lock()
+	lists := make(map[string]reloadable, len(reloadableLists))
+	for name, l := range reloadableLists {
+		lists[name] = l
+	}
+	reloadMu.Unlock()
+	for name, l := range lists {
+		reloadList(name, l)
+	}
+}
+
+// reloadList reloads l. If it failed, the old one will still be in use.
+func reloadList(name string, l reloadable) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if err := l.reload(); err != nil {
+		mlog.S().Warnf("failed to reload %s, the old one is still in use: %v", name, err)
+		return
+	}
+	mlog.S().Infof("%s reloaded", name)
+}
+
+var errReadOnlyList = errors.New("list is read-only")
+
+// domainList is a domain.Matcher that is loaded from files
+// and can be reloaded.
+type domainList struct {
+	files []string
+
+	// rules is the --rules file. Its domain rules of action are
+	// loaded as well. Empty means no rules file.
+	rules     string
+	action    string
+	ruleFiles []string
+
+	mu sync.RWMutex
+	m  domain.Matcher[struct{}]
+}
+
+func newDomainList(files []string) (*domainList, error) {
+	return newDomainListWithRules(files, "", "")
+}
+
+func newDomainListWithRules(files []string, rules, action string) (*domainList, error) {
+	l := &domainList{files: files, rules: rules, action: action}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *domainList) reload() error {
+	m, err := loadDomainMatcher(l.files)
+	if err != nil {
+		return err
+	}
+	var ruleFiles []string
+	if len(l.rules) > 0 {
+		rs, err := loadRules(l.rules)
+		if err != nil {
+			return err
+		}
+		if err := rs.addDomains(m, l.action); err != nil {
+			return err
+		}
+		ruleFiles = rs.files
+	}
+	l.mu.Lock()
+	l.m = m
+	l.ruleFiles = ruleFiles
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *domainList) sourceFiles() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append(l.files[:len(l.files):len(l.files)], l.ruleFiles...)
+}
+
+func (l *domainList) Match(s string) (v struct{}, ok bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	v, ok = l.m.Match(s)
+	if ok && dryRun != nil {
+		dryRun.add("%s is in %s", s, l.source(s))
+	}
+	return v, ok
+}
+
+func (l *domainList) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.m.Len()
+}
+
+func (l *domainList) Add(_ string, _ struct{}) error {
+	return errReadOnlyList
+}
+
+// ipList is a netlist.Matcher that is loaded from files
+// and can be reloaded.
+type ipList struct {
+	files []string
+
+	// rules is the --rules file. Its ip rules of action are loaded
+	// as well. Empty means no rules file.
+	rules     string
+	action    string
+	ruleFiles []string
+
+	mu sync.RWMutex
+	l  *netlist.List
+}
+
+func newIPList(files []string) (*ipList, error) {
+	return newIPListWithRules(files, "", "")
+}
+
+func newIPListWithRules(files []string, rules, action string) (*ipList, error) {
+	l := &ipList{files: files, rules: rules, action: action}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *ipList) reload() error {
+	files, err := downloadEntries(l.files)
+	if err != nil {
+		return err
+	}
+	nl := netlist.NewList()
+	for _, f := range files {
+		var err error
+		if _, _, ok := splitDATEntry(f); ok {
+			if err = netlist.LoadFromFile(nl, f); err != nil {
+				err = geoIPTagError(f, err)
+			}
+		} else {
+			err = loadListFile(f, func(v string) error { return netlist.LoadFromText(nl, v) })
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load ip file %s: %w", f, err)
+		}
+	}
+	var ruleFiles []string
+	if len(l.rules) > 0 {
+		rs, err := loadRules(l.rules)
+		if err != nil {
+			return err
+		}
+		if err := rs.addIPs(nl, l.action); err != nil {
+			return err
+		}
+		ruleFiles = rs.files
+	}
+	nl.Sort()
+	l.mu.Lock()
+	l.l = nl
+	l.ruleFiles = ruleFiles
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *ipList) sourceFiles() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append(l.files[:len(l.files):len(l.files)], l.ruleFiles...)
+}
+
+func (l *ipList) Match(ip net.IP) (bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.l.Match(ip)
+}
+
+func (l *ipList) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.l.Len()
+}
@@ -0,0 +1,78 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"time"
+)
+
+// retryUpstream retries queries that failed or got a SERVFAIL response.
+// Other rcodes (e.g. NXDOMAIN) are definitive and are never retried.
+// If the query has a deadline, every attempt gets an equal share of
+// the remaining time, so a lost packet won't use up the whole query
+// timeout and retries never exceed it.
+type retryUpstream struct {
+	bundled_upstream.Upstream
+	retries int
+	backoff time.Duration // doubled after every retry
+	logger  *zap.Logger
+}
+
+func (u *retryUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	backoff := u.backoff
+	for attempt := 0; ; attempt++ {
+		r, err := u.exchange(ctx, q, u.retries-attempt+1)
+		if ctx.Err() != nil || attempt == u.retries || !shouldRetry(r, err) {
+			return r, err
+		}
+
+		if err != nil {
+			u.logger.Debug("retrying upstream", zap.String("upstream", u.Address()), zap.Int("attempt", attempt+1), zap.Error(err))
+		} else {
+			u.logger.Debug("retrying upstream", zap.String("upstream", u.Address()), zap.Int("attempt", attempt+1), zap.String("rcode", dns.RcodeToString[r.Rcode]))
+		}
+		if backoff > 0 {
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return r, err
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// exchange sends q with a timeout of 1/attemptsLeft of the remaining time.
+func (u *retryUpstream) exchange(ctx context.Context, q *dns.Msg, attemptsLeft int) (*dns.Msg, error) {
+	if deadline, ok := ctx.Deadline(); ok && attemptsLeft > 1 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(attemptsLeft))
+		defer cancel()
+	}
+	return u.Upstream.Exchange(ctx, q)
+}
+
+func shouldRetry(r *dns.Msg, err error) bool {
+	return err != nil || r.Rcode == dns.RcodeServerFailure
+}
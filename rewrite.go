@@ -0,0 +1,280 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+)
+
+const (
+	// TTL of the records that are added by rewrites.
+	rewriteReplyTTL = 300
+
+	// rewriteMaxDepth limits how many times the target of a cname
+	// rewrite can be rewritten again, so rewrites can't loop.
+	rewriteMaxDepth = 8
+)
+
+// rewriteRule is the rewrite of a domain pattern. It either has ips or
+// a cname.
+type rewriteRule struct {
+	pattern    string
+	ipv4, ipv6 []net.IP
+	cname      string // fqdn
+}
+
+// rewriter overrides the answers of some domains, no matter what the
+// upstreams replied. Rules match the qname as well as the cname
+// targets in responses, so names behind cnames (e.g. cdn domains) can
+// be rewritten too.
+//
+//   - ip rules answer A/AAAA queries with their ips. A query that
+//     matched the rule is answered without the upstreams.
+//   - cname rules make the name an alias of another name, which is
+//     resolved instead.
+//
+// It runs after the cache, so the cached responses are rewritten ones.
+type rewriter struct {
+	m      domain.Matcher[*rewriteRule]
+	logger *zap.Logger
+}
+
+// newRewriter parses "domain=ip" ip rules and "from=to" cname rules.
+// Domains are matched fully, "*.example.com" matches example.com and
+// all its subdomains.
+func newRewriter(ips, cnames []string, logger *zap.Logger) (*rewriter, error) {
+	rules := make(map[string]*rewriteRule)
+	var patterns []string
+	ruleOf := func(s, flag string) (*rewriteRule, string, error) {
+		d, v, ok := strings.Cut(s, "=")
+		if !ok || len(d) == 0 || len(v) == 0 {
+			return nil, "", fmt.Errorf("invalid %s %s, want domain=value", flag, s)
+		}
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if _, ok := dns.IsDomainName(strings.TrimPrefix(d, "*.")); !ok {
+			return nil, "", fmt.Errorf("invalid %s %s, %s is not a valid domain", flag, s, d)
+		}
+		r := rules[d]
+		if r == nil {
+			r = &rewriteRule{pattern: d}
+			rules[d] = r
+			patterns = append(patterns, d)
+		}
+		return r, v, nil
+	}
+
+	for _, s := range ips {
+		r, v, err := ruleOf(s, "rewrite")
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid rewrite %s, invalid ip %s", s, v)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			r.ipv4 = append(r.ipv4, ip4)
+		} else {
+			r.ipv6 = append(r.ipv6, ip)
+		}
+	}
+	for _, s := range cnames {
+		r, v, err := ruleOf(s, "rewrite cname")
+		if err != nil {
+			return nil, err
+		}
+		if len(r.ipv4)+len(r.ipv6) > 0 {
+			return nil, fmt.Errorf("invalid rewrite cname %s, %s already has ip rewrites", s, r.pattern)
+		}
+		if len(r.cname) > 0 {
+			return nil, fmt.Errorf("invalid rewrite cname %s, %s already has a cname rewrite", s, r.pattern)
+		}
+		target, err := ruleToASCII(strings.ToLower(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite cname %s, %w", s, err)
+		}
+		target = dns.Fqdn(target)
+		if _, ok := dns.IsDomainName(target); !ok {
+			return nil, fmt.Errorf("invalid rewrite cname %s, %s is not a valid domain", s, v)
+		}
+		r.cname = target
+	}
+
+	mixMatcher := domain.NewMixMatcher[*rewriteRule]()
+	mixMatcher.SetDefaultMatcher(domain.MatcherFull)
+	m := idnaMatcher[*rewriteRule]{wildcardMatcher[*rewriteRule]{mixMatcher}}
+	for _, p := range patterns {
+		if err := m.Add(p, rules[p]); err != nil {
+			return nil, fmt.Errorf("invalid rewrite domain %s, %w", p, err)
+		}
+	}
+	return &rewriter{m: m, logger: logger}, nil
+}
+
+func (w *rewriter) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	return w.exec(ctx, qCtx, next, 0)
+}
+
+func (w *rewriter) exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode, depth int) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	if depth >= rewriteMaxDepth {
+		w.logger.Warn("too many cname rewrites, rewrites may loop", qCtx.InfoField())
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeServerFailure)
+		qCtx.SetResponse(r, handler.ContextStatusServerFailed)
+		return nil
+	}
+	name, qt := q.Question[0].Name, q.Question[0].Qtype
+
+	if rule, ok := w.m.Match(name); ok {
+		switch {
+		case len(rule.cname) > 0 && qt == dns.TypeCNAME:
+			w.logger.Debug("query rewritten", qCtx.InfoField(), zap.String("rule", rule.pattern))
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.RecursionAvailable = true
+			r.Answer = []dns.RR{rewrittenCNAME(name, rule)}
+			qCtx.SetResponse(r, handler.ContextStatusResponded)
+			return nil
+		case len(rule.cname) > 0:
+			return w.resolveAlias(ctx, qCtx, next, nil, name, rule, depth)
+		case len(rule.cname) == 0 && (qt == dns.TypeA || qt == dns.TypeAAAA):
+			w.logger.Debug("query rewritten", qCtx.InfoField(), zap.String("rule", rule.pattern))
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.RecursionAvailable = true
+			setRewrittenAddrs(r, name, qt, rule)
+			qCtx.SetResponse(r, handler.ContextStatusResponded)
+			return nil
+		}
+	}
+
+	if err := handler.ExecChainNode(ctx, qCtx, next); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return nil
+	}
+
+	// Follow the cname chain from the qname, the first target that
+	// matches a rule is rewritten.
+	owner := name
+	var chain []dns.RR
+	for len(chain) < len(r.Answer) {
+		cname := findCNAME(r.Answer, owner)
+		if cname == nil {
+			break
+		}
+		chain = append(chain, cname)
+		owner = cname.Target
+		rule, ok := w.m.Match(owner)
+		if !ok {
+			continue
+		}
+		if len(rule.cname) > 0 {
+			return w.resolveAlias(ctx, qCtx, next, chain, owner, rule, depth)
+		}
+		if qt == dns.TypeA || qt == dns.TypeAAAA {
+			w.logger.Debug("cname target rewritten", qCtx.InfoField(), zap.String("target", owner), zap.String("rule", rule.pattern))
+			r.Rcode = dns.RcodeSuccess
+			r.AuthenticatedData = false
+			r.Answer = chain
+			r.Ns = nil
+			setRewrittenAddrs(r, owner, qt, rule)
+		}
+		return nil
+	}
+	return nil
+}
+
+// findCNAME returns the cname record of owner in rrs, or nil.
+func findCNAME(rrs []dns.RR, owner string) *dns.CNAME {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, owner) {
+			return cname
+		}
+	}
+	return nil
+}
+
+// resolveAlias answers qCtx with "from CNAME rule.cname" and the
+// response of rule.cname, after the records of prefix.
+func (w *rewriter) resolveAlias(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode, prefix []dns.RR, from string, rule *rewriteRule, depth int) error {
+	q := qCtx.Q()
+	w.logger.Debug("cname rewritten", qCtx.InfoField(), zap.String("name", from), zap.String("cname", rule.cname), zap.String("rule", rule.pattern))
+	aq := q.Copy()
+	aq.Question[0].Name = rule.cname
+	aCtx := handler.NewContext(aq, qCtx.ReqMeta())
+	if err := w.exec(ctx, aCtx, next, depth+1); err != nil {
+		return err
+	}
+	ar := aCtx.R()
+	if ar == nil {
+		qCtx.SetResponse(nil, aCtx.Status())
+		return nil
+	}
+
+	r := ar.Copy()
+	r.Id = q.Id
+	r.Question = q.Question
+	r.AuthenticatedData = false
+	answer := make([]dns.RR, 0, len(prefix)+1+len(ar.Answer))
+	answer = append(answer, prefix...)
+	answer = append(answer, rewrittenCNAME(from, rule))
+	r.Answer = append(answer, ar.Answer...)
+	qCtx.SetResponse(r, aCtx.Status())
+	return nil
+}
+
+func rewrittenCNAME(name string, rule *rewriteRule) *dns.CNAME {
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rewriteReplyTTL},
+		Target: rule.cname,
+	}
+}
+
+// setRewrittenAddrs appends the ips of rule of qtype qt as the records
+// of owner to r. If rule has no such ips, r is a NODATA response.
+func setRewrittenAddrs(r *dns.Msg, owner string, qt uint16, rule *rewriteRule) {
+	hdr := dns.RR_Header{Name: owner, Rrtype: qt, Class: dns.ClassINET, Ttl: rewriteReplyTTL}
+	n := len(r.Answer)
+	if qt == dns.TypeA {
+		for _, ip := range rule.ipv4 {
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip})
+		}
+	} else {
+		for _, ip := range rule.ipv6 {
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(r.Answer) == n {
+		r.Ns = []dns.RR{dnsutils.FakeSOA(owner)}
+	}
+}
@@ -0,0 +1,167 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+)
+
+// RouteKind is the kind of a routing decision of a Router.
+type RouteKind int
+
+const (
+	// RouteDefault leaves the query to the built-in routing rules.
+	RouteDefault RouteKind = iota
+	// RouteLocal forwards the query to the local upstream.
+	RouteLocal
+	// RouteRemote forwards the query to the remote upstream.
+	RouteRemote
+	// RouteBlock blocks the query like the blacklist (--block-mode).
+	RouteBlock
+	// RouteGroup forwards the query to the upstream group Route.Group.
+	RouteGroup
+)
+
+func (k RouteKind) String() string {
+	switch k {
+	case RouteDefault:
+		return "default"
+	case RouteLocal:
+		return "local"
+	case RouteRemote:
+		return "remote"
+	case RouteBlock:
+		return "block"
+	case RouteGroup:
+		return "group"
+	default:
+		return fmt.Sprintf("RouteKind(%d)", int(k))
+	}
+}
+
+// Route is a routing decision of a Router.
+type Route struct {
+	Kind  RouteKind
+	Group string // name of the --group, only used by RouteGroup
+}
+
+// Router makes custom routing decisions, e.g. from a policy engine.
+// It is consulted after the domains of --domain-upstream and forced
+// clients, and before all other routing rules. Returning an error fails
+// the query with SERVFAIL. It must be safe for concurrent use. clientIP
+// is nil for the queries of the cache warm-up.
+//
+// With only --upstream, RouteLocal and RouteRemote both forward the
+// query to the upstream.
+type Router interface {
+	Route(ctx context.Context, q *dns.Msg, clientIP net.IP) (Route, error)
+}
+
+// defaultRouter leaves all queries to the built-in routing rules, which
+// is the behavior when no custom router is registered.
+type defaultRouter struct{}
+
+func (defaultRouter) Route(context.Context, *dns.Msg, net.IP) (Route, error) {
+	return Route{Kind: RouteDefault}, nil
+}
+
+var customRouter Router = defaultRouter{}
+
+// RegisterRouter sets the custom router. It must be called before the
+// server is initialized, e.g. from an init function of a file that is
+// added to this package.
+func RegisterRouter(r Router) {
+	if r == nil {
+		r = defaultRouter{}
+	}
+	customRouter = r
+}
+
+// hasCustomRouter reports whether a custom router is registered.
+func hasCustomRouter() bool {
+	_, ok := customRouter.(defaultRouter)
+	return !ok
+}
+
+// routerNode executes the decisions of a Router.
+type routerNode struct {
+	r      Router
+	local  handler.ExecutableChainNode
+	remote handler.ExecutableChainNode
+	groups map[string]handler.ExecutableChainNode
+	block  *blackList
+	logger *zap.Logger
+}
+
+func (n *routerNode) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	route, err := n.r.Route(ctx, qCtx.Q(), qCtx.ReqMeta().ClientIP)
+	if err != nil {
+		return fmt.Errorf("custom router err, %w", err)
+	}
+	var node handler.ExecutableChainNode
+	switch route.Kind {
+	case RouteDefault:
+		return handler.ExecChainNode(ctx, qCtx, next)
+	case RouteLocal:
+		node = n.local
+	case RouteRemote:
+		node = n.remote
+	case RouteBlock:
+		metrics.observeBlocked()
+		n.logger.Debug("query blocked by custom router", qCtx.InfoField())
+		queryInfoFrom(ctx).addEDE(dns.ExtendedErrorCodeBlocked, "custom router")
+		qCtx.SetResponse(n.block.blockedReply(qCtx.Q()), handler.ContextStatusRejected)
+		return nil
+	case RouteGroup:
+		node = n.groups[route.Group]
+		if node == nil {
+			return fmt.Errorf("custom router returned unknown group %s", route.Group)
+		}
+	default:
+		return fmt.Errorf("custom router returned unknown route kind %d", route.Kind)
+	}
+	n.logger.Debug("custom route", qCtx.InfoField(), zap.Stringer("route", route.Kind), zap.String("group", route.Group))
+	return handler.ExecChainNode(ctx, qCtx, node)
+}
+
+// newRouterNode returns the node of the custom router. local and
+// remote are the same with only --upstream.
+func newRouterNode(local, remote handler.Executable, groups map[string]handler.Executable, opt *Opt) (*routerNode, error) {
+	ipv4, ipv6, err := parseBlockMode(opt)
+	if err != nil {
+		return nil, err
+	}
+	n := &routerNode{
+		r:      customRouter,
+		local:  handler.WrapExecutable(local),
+		remote: handler.WrapExecutable(remote),
+		groups: make(map[string]handler.ExecutableChainNode, len(groups)),
+		block:  &blackList{ipv4: ipv4, ipv6: ipv6},
+		logger: mlog.L().Named("custom_router"),
+	}
+	for name, f := range groups {
+		n.groups[name] = handler.WrapExecutable(f)
+	}
+	return n, nil
+}
@@ -0,0 +1,290 @@
+// Copyright (C) 2020-2021, IrineSistiana
+//
+// This file is part of mosdns.
+//
+// mosdns is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// mosdns is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dryRun records what happens to the query of --test-domain. It is nil
+// if this is not a dry run.
+var dryRun *routeTrace
+
+// routeTrace records the steps of a query in a dry run. Steps may be
+// added concurrently, e.g. by the local and remote upstreams of a
+// fallback node.
+type routeTrace struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+// add records a step. It is a no-op if t is nil.
+func (t *routeTrace) add(format string, a ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, fmt.Sprintf(format, a...))
+}
+
+// len returns the number of recorded steps.
+func (t *routeTrace) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.steps)
+}
+
+// insert records a step before the i-th step.
+func (t *routeTrace) insert(i int, format string, a ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps[:i], append([]string{fmt.Sprintf(format, a...)}, t.steps[i:]...)...)
+}
+
+// testRoute prints how a query of name and qtype from client would be
+// routed and why. It builds the entry with initEntry and runs the query
+// through it, so the result comes from the same nodes as a live query.
+// Upstreams are not queried, forwarders reply an empty test response.
+func testRoute(name, qtype, client string) error {
+	types, err := parseQTypes([]string{qtype})
+	if err != nil {
+		return err
+	}
+	clientIP := net.ParseIP(client)
+	if clientIP == nil {
+		return fmt.Errorf("invalid test client %s", client)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), uint16(types[0]))
+	q.RecursionDesired = true
+
+	// These nodes don't route queries. The cache may hold responses
+	// of live queries, and the others write files or probe addresses.
+	opt.CacheSize, opt.RedisCache = 0, ""
+	opt.QueryLog, opt.AnswerDump = "", ""
+	opt.HealthCheckInterval = 0
+	opt.SortByLatency = false
+
+	dryRun = new(routeTrace)
+	entry, err := initEntry()
+	if err != nil {
+		return err
+	}
+	qCtx := handler.NewContext(q, &handler.RequestMeta{ClientIP: clientIP})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = handler.ExecChainNode(ctx, qCtx, entry)
+
+	fmt.Printf("query:  %s %s\n", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype])
+	fmt.Printf("client: %s\n", clientIP)
+	fmt.Println("steps:")
+	if len(dryRun.steps) == 0 {
+		fmt.Println("  (none)")
+	}
+	for i, s := range dryRun.steps {
+		fmt.Printf("  %d. %s\n", i+1, s)
+	}
+	switch r := qCtx.R(); {
+	case err != nil:
+		fmt.Printf("result: error, %v\n", err)
+	case r == nil:
+		fmt.Printf("result: no response (%s)\n", qCtx.Status())
+	default:
+		fmt.Printf("result: %s, answers: %d\n", dns.RcodeToString[r.Rcode], len(r.Answer))
+		for _, rr := range r.Answer {
+			fmt.Printf("  %s\n", rr)
+		}
+	}
+	return nil
+}
+
+// execDryRun records that the query reached f and replies an empty
+// response instead of querying the upstreams.
+func (f *forwarder) execDryRun(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	addrs := make([]string, 0, len(f.us))
+	for _, u := range f.us {
+		addrs = append(addrs, u.Address())
+	}
+	dryRun.add("forwarded to %s (%s)", strings.Join(addrs, ", "), f.name)
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.RecursionAvailable = true
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+// source returns the file (or the rules) of l that has the domain s.
+func (l *domainList) source(s string) string {
+	for _, f := range l.files {
+		m, err := loadDomainMatcher([]string{f})
+		if err != nil {
+			continue
+		}
+		if _, ok := m.Match(s); ok {
+			return f
+		}
+	}
+	if len(l.rules) > 0 {
+		return fmt.Sprintf("%s rules in %s", l.action, l.rules)
+	}
+	return strings.Join(l.files, ", ")
+}
+
+// describe returns when a local response is accepted by m.
+func (m *localIPVerifier) describe() string {
+	cond := "contains a local ip"
+	switch m.mode {
+	case "all":
+		cond = "only contains local ips"
+	case "off":
+		cond = "is not empty"
+	}
+	switch m.noIP {
+	case "local":
+		cond += " or has no ip"
+	case "local-nxdomain":
+		cond += " or is a NXDOMAIN"
+	}
+	return cond
+}
+
+// traceStep appends a node that records desc to route in a dry run.
+func traceStep(route []handler.Executable, desc string) []handler.Executable {
+	if dryRun == nil {
+		return route
+	}
+	return append(route, &tracedStep{desc: desc})
+}
+
+type tracedStep struct {
+	desc string
+}
+
+func (t *tracedStep) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	dryRun.add("%s", t.desc)
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+// tracedMatcher is a handler.Matcher that records desc when it matched.
+type tracedMatcher struct {
+	desc string
+	m    handler.Matcher
+}
+
+// traceMatcher returns m. In a dry run, the returned matcher records
+// desc when m matched.
+func traceMatcher(desc string, m handler.Matcher) handler.Matcher {
+	if dryRun == nil {
+		return m
+	}
+	return &tracedMatcher{desc: desc, m: m}
+}
+
+func (t *tracedMatcher) Match(ctx context.Context, qCtx *handler.Context) (bool, error) {
+	ok, err := t.m.Match(ctx, qCtx)
+	if ok {
+		dryRun.add("%s", t.desc)
+	}
+	return ok, err
+}
+
+// tracedNode records the name of its node if the node ended the chain,
+// e.g. it answered the query, or forwarded it and skipped all later
+// routing rules.
+type tracedNode struct {
+	name string
+	e    handler.Executable
+}
+
+// traceNode returns e. In a dry run, the returned node records its
+// name if e ended the chain. Only nodes that can end the chain are
+// traced.
+func traceNode(e handler.Executable) handler.Executable {
+	if dryRun == nil {
+		return e
+	}
+	var name string
+	switch e := e.(type) {
+	case *clientFilter:
+		name = "--allow-client"
+	case *queryValidator:
+		name = "invalid query check"
+	case *querySizeLimiter:
+		name = "--max-query-size"
+	case *rateLimiter:
+		name = "--client-qps"
+	case *anyQuery:
+		name = "--any-mode"
+	case *hostsExec:
+		name = "hosts"
+	case *blackList:
+		name = "blacklist"
+	case *noIPv6:
+		name = "--no-ipv6"
+	case *preferFamily:
+		name = "--prefer"
+	case *fakeIPExec:
+		name = "fake ip"
+	case *localPTR:
+		name = "--local-ptr"
+	case *rewriter:
+		name = "rewrite"
+	case *forcedClientRoute:
+		name = "forced client route"
+	case *routerNode:
+		name = "custom router"
+	case *scheduleRoute:
+		name = fmt.Sprintf("schedule rule, hours %s", e.rule.hours)
+	case *adaptiveRoute:
+		name = "adaptive dispatch mode"
+	default:
+		return e
+	}
+	return &tracedNode{name: name, e: e}
+}
+
+func (t *tracedNode) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	i := dryRun.len()
+	passed := false
+	if next != nil {
+		next = &passNode{ExecutableChainNode: next, passed: &passed}
+	}
+	err := t.e.Exec(ctx, qCtx, next)
+	if !passed {
+		dryRun.insert(i, "handled by %s", t.name)
+	}
+	return err
+}
+
+// passNode records whether the chain went on to its node.
+type passNode struct {
+	handler.ExecutableChainNode
+	passed *bool
+}
+
+func (p *passNode) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	*p.passed = true
+	return p.ExecutableChainNode.Exec(ctx, qCtx, next)
+}
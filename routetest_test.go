@@ -0,0 +1,63 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/elem"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func Test_routeTrace(t *testing.T) {
+	dryRun = new(routeTrace)
+	defer func() { dryRun = nil }()
+
+	tests := []struct {
+		qtype     uint16
+		wantSteps []string
+	}{
+		{dns.TypeAAAA, []string{"handled by --no-ipv6"}},
+		{dns.TypeTXT, []string{"matched TXT", "upstream"}},
+		{dns.TypeA, []string{"no routing rule matched", "upstream"}},
+	}
+	for _, tt := range tests {
+		t.Run(dns.TypeToString[tt.qtype], func(t *testing.T) {
+			dryRun.steps = nil
+			upstream := &testResponder{ip: net.IPv4(1, 2, 3, 4), ttl: 300}
+			innerNode := handler.WrapExecutable(&tracedStep{desc: "upstream"})
+			innerNode.LinkNext(handler.WrapExecutable(&end{}))
+			txt := &executable_seq.IfNode{
+				ConditionMatcher: traceMatcher("matched TXT", msg_matcher.NewQTypeMatcher(elem.NewIntMatcher([]int{int(dns.TypeTXT)}))),
+				ExecutableNode:   innerNode,
+			}
+			route := []handler.Executable{traceNode(&noIPv6{}), traceNode(txt)}
+			route = traceStep(route, "no routing rule matched")
+			route = append(route, &tracedStep{desc: "upstream"}, upstream)
+
+			execChain(t, handler.NewContext(newTestQuery("example.com", tt.qtype), nil), route...)
+			if !reflect.DeepEqual(dryRun.steps, tt.wantSteps) {
+				t.Fatalf("steps = %q, want %q", dryRun.steps, tt.wantSteps)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Percentiles of windows with up to rttExactSamples queries are
+// computed from the samples, P² is inaccurate with few samples.
+const rttExactSamples = 128
+
+// rttStats is nil if --rtt-report-interval is not set.
+var rttStats *upstreamRTTStats
+
+// upstreamRTTStats collects the round-trip times of real queries to
+// each upstream, and logs their percentiles every interval. Health
+// check queries are not counted. Only the first rttExactSamples samples
+// of a window are stored, the percentiles of busier windows are
+// estimated by p2Quantile.
+type upstreamRTTStats struct {
+	logger *zap.Logger
+
+	mu sync.Mutex
+	m  map[string]*rttWindow // upstream address -> stats of current window
+}
+
+type rttWindow struct {
+	queries  int
+	errors   int
+	samples  []float64 // the first rttExactSamples samples
+	p50      *p2Quantile
+	p90      *p2Quantile
+	p99      *p2Quantile
+	min, max time.Duration
+}
+
+func newRTTWindow() *rttWindow {
+	return &rttWindow{
+		p50: newP2Quantile(0.5),
+		p90: newP2Quantile(0.9),
+		p99: newP2Quantile(0.99),
+	}
+}
+
+func newUpstreamRTTStats(logger *zap.Logger) *upstreamRTTStats {
+	return &upstreamRTTStats{logger: logger, m: make(map[string]*rttWindow)}
+}
+
+// observe records a query to upstream addr. Failed queries are also
+// counted as errors, their durations are not used.
+func (s *upstreamRTTStats) observe(addr string, d time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.m[addr]
+	if w == nil {
+		w = newRTTWindow()
+		s.m[addr] = w
+	}
+	w.queries++
+	if err != nil {
+		w.errors++
+		return
+	}
+	if w.responses() == 1 || d < w.min {
+		w.min = d
+	}
+	if d > w.max {
+		w.max = d
+	}
+	v := float64(d)
+	if len(w.samples) < rttExactSamples {
+		w.samples = append(w.samples, v)
+	}
+	w.p50.add(v)
+	w.p90.add(v)
+	w.p99.add(v)
+}
+
+// start logs and resets the stats every interval.
+func (s *upstreamRTTStats) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.report()
+		}
+	}()
+}
+
+// report logs the stats of the current window and starts a new one.
+// Upstreams that were not queried in the window are not logged.
+func (s *upstreamRTTStats) report() {
+	s.mu.Lock()
+	m := s.m
+	s.m = make(map[string]*rttWindow, len(m))
+	s.mu.Unlock()
+
+	addrs := make([]string, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		w := m[addr]
+		fields := []zap.Field{
+			zap.String("upstream", addr),
+			zap.Int("queries", w.queries),
+			zap.Int("errors", w.errors),
+		}
+		if w.responses() > 0 {
+			fields = append(fields,
+				zap.Duration("min", w.min),
+				zap.Duration("p50", w.percentile(w.p50)),
+				zap.Duration("p90", w.percentile(w.p90)),
+				zap.Duration("p99", w.percentile(w.p99)),
+				zap.Duration("max", w.max),
+			)
+		}
+		s.logger.Info("upstream rtt", fields...)
+	}
+}
+
+// responses returns the number of successful queries.
+func (w *rttWindow) responses() int {
+	return w.queries - w.errors
+}
+
+func (w *rttWindow) percentile(e *p2Quantile) time.Duration {
+	if w.responses() > len(w.samples) {
+		return time.Duration(e.value())
+	}
+	return time.Duration(exactQuantile(w.samples, e.p))
+}
+
+// exactQuantile returns the p quantile of s. s will be sorted.
+func exactQuantile(s []float64, p float64) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	sort.Float64s(s)
+	i := int(p * float64(len(s)))
+	if i >= len(s) {
+		i = len(s) - 1
+	}
+	return s[i]
+}
+
+// p2Quantile estimates a quantile of a stream with the P² algorithm
+// (Jain and Chlamtac, 1985). It keeps 5 markers instead of the samples.
+type p2Quantile struct {
+	p  float64
+	n  int        // number of samples
+	q  [5]float64 // marker heights, the first n samples if n < 5
+	ns [5]float64 // marker positions
+	np [5]float64 // desired marker positions
+	dn [5]float64 // increments of desired marker positions
+}
+
+func newP2Quantile(p float64) *p2Quantile {
+	return &p2Quantile{
+		p:  p,
+		np: [5]float64{0, 2 * p, 4 * p, 2 + 2*p, 4},
+		dn: [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+func (e *p2Quantile) add(x float64) {
+	if e.n < 5 {
+		e.q[e.n] = x
+		e.n++
+		if e.n == 5 {
+			sort.Float64s(e.q[:])
+			e.ns = [5]float64{0, 1, 2, 3, 4}
+		}
+		return
+	}
+	e.n++
+
+	// find the cell k that x falls in, and update the extreme markers.
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+		k = 0
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3; k++ {
+			if x < e.q[k+1] {
+				break
+			}
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.ns[i]++
+	}
+	for i := range e.np {
+		e.np[i] += e.dn[i]
+	}
+
+	// adjust the middle markers if they are off their desired positions.
+	for i := 1; i < 4; i++ {
+		d := e.np[i] - e.ns[i]
+		if (d >= 1 && e.ns[i+1]-e.ns[i] > 1) || (d <= -1 && e.ns[i-1]-e.ns[i] < -1) {
+			s := 1.0
+			if d < 0 {
+				s = -1
+			}
+			qp := e.parabolic(i, s)
+			if e.q[i-1] < qp && qp < e.q[i+1] {
+				e.q[i] = qp
+			} else {
+				e.q[i] = e.linear(i, s)
+			}
+			e.ns[i] += s
+		}
+	}
+}
+
+func (e *p2Quantile) parabolic(i int, d float64) float64 {
+	return e.q[i] + d/(e.ns[i+1]-e.ns[i-1])*
+		((e.ns[i]-e.ns[i-1]+d)*(e.q[i+1]-e.q[i])/(e.ns[i+1]-e.ns[i])+
+			(e.ns[i+1]-e.ns[i]-d)*(e.q[i]-e.q[i-1])/(e.ns[i]-e.ns[i-1]))
+}
+
+func (e *p2Quantile) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.q[i] + d*(e.q[j]-e.q[i])/(e.ns[j]-e.ns[i])
+}
+
+// value returns the estimated quantile. It is exact with less than
+// 5 samples. It returns 0 if there is no sample.
+func (e *p2Quantile) value() float64 {
+	if e.n == 0 {
+		return 0
+	}
+	if e.n < 5 {
+		s := make([]float64, e.n)
+		copy(s, e.q[:e.n])
+		return exactQuantile(s, e.p)
+	}
+	return e.q[2]
+}
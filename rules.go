@@ -0,0 +1,202 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Actions of the rules file. Domain rules can be local, remote or block.
+// Ip rules can be local or bogus.
+const (
+	ruleLocal  = "local"
+	ruleRemote = "remote"
+	ruleBlock  = "block"
+	ruleBogus  = "bogus"
+)
+
+// maxRulesIncludeDepth limits nested includes of rules files.
+const maxRulesIncludeDepth = 8
+
+// rule is a domain or ip rule of a rules file.
+type rule struct {
+	value string
+	file  string
+	line  int
+	text  string // the directive, for error messages
+}
+
+func (r *rule) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s:%d: invalid directive %q, %s", r.file, r.line, r.text, fmt.Sprintf(format, a...))
+}
+
+// ruleSet is a parsed rules file given by --rules. A rules file has one
+// directive per line:
+//
+//	include other.rules        # relative to the directory of this file
+//	domain:example.com local   # domain rules, see README for the types
+//	example.org remote         # "domain" match type is used if omitted
+//	block:ads.example          # same as "ads.example block"
+//	ip:1.2.3.0/24 local        # ip rules, local or bogus
+//
+// "#" starts a comment.
+type ruleSet struct {
+	files   []string // the rules file and all included files
+	domains map[string][]*rule
+	ips     map[string][]*rule
+}
+
+// loadRules parses the rules file and the files it includes. Any
+// malformed directive fails the whole file.
+func loadRules(file string) (*ruleSet, error) {
+	rs := &ruleSet{
+		domains: make(map[string][]*rule),
+		ips:     make(map[string][]*rule),
+	}
+	if err := rs.load(file, nil); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *ruleSet) load(file string, including []string) error {
+	for _, f := range including {
+		if f == file {
+			return fmt.Errorf("include loop, %s", strings.Join(append(including, file), " -> "))
+		}
+	}
+	if len(including) >= maxRulesIncludeDepth {
+		return fmt.Errorf("too many nested includes, %s", strings.Join(append(including, file), " -> "))
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	rs.files = append(rs.files, file)
+
+	lineNum := 0
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		lineNum++
+		s, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		r := &rule{file: file, line: lineNum, text: strings.TrimSpace(s)}
+
+		if fields[0] == "include" {
+			if len(fields) != 2 {
+				return r.errorf("want include <file>")
+			}
+			inc := fields[1]
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(file), inc)
+			}
+			if err := rs.load(inc, append(including, file)); err != nil {
+				return fmt.Errorf("%s:%d: failed to include %s, %w", file, lineNum, fields[1], err)
+			}
+			continue
+		}
+
+		if v, ok := cutPrefix(fields[0], "block:"); ok {
+			if len(fields) != 1 {
+				return r.errorf("unexpected %q", fields[1])
+			}
+			fields = []string{v, ruleBlock}
+		}
+		if len(fields) != 2 {
+			return r.errorf("want <rule> <action>")
+		}
+		action := fields[1]
+		if v, ok := cutPrefix(fields[0], "ip:"); ok {
+			switch action {
+			case ruleLocal, ruleBogus:
+			default:
+				return r.errorf("unknown ip action %s, must be one of local and bogus", action)
+			}
+			if err := netlist.LoadFromText(netlist.NewList(), v); err != nil {
+				return r.errorf("%v", err)
+			}
+			r.value = v
+			rs.ips[action] = append(rs.ips[action], r)
+			continue
+		}
+		switch action {
+		case ruleLocal, ruleRemote, ruleBlock:
+		default:
+			return r.errorf("unknown domain action %s, must be one of local, remote and block", action)
+		}
+		if err := newRulesMatcher().Add(fields[0], struct{}{}); err != nil {
+			return r.errorf("%v", err)
+		}
+		r.value = fields[0]
+		rs.domains[action] = append(rs.domains[action], r)
+	}
+	return scanner.Err()
+}
+
+// hasDomains reports whether rs has domain rules of action.
+// rs can be nil.
+func (rs *ruleSet) hasDomains(action string) bool {
+	return rs != nil && len(rs.domains[action]) > 0
+}
+
+// hasIPs reports whether rs has ip rules of action. rs can be nil.
+func (rs *ruleSet) hasIPs(action string) bool {
+	return rs != nil && len(rs.ips[action]) > 0
+}
+
+func (rs *ruleSet) addDomains(m domain.Matcher[struct{}], action string) error {
+	for _, r := range rs.domains[action] {
+		if err := m.Add(r.value, struct{}{}); err != nil {
+			return r.errorf("%v", err)
+		}
+	}
+	return nil
+}
+
+func (rs *ruleSet) addIPs(l *netlist.List, action string) error {
+	for _, r := range rs.ips[action] {
+		if err := netlist.LoadFromText(l, r.value); err != nil {
+			return r.errorf("%v", err)
+		}
+	}
+	return nil
+}
+
+func newRulesMatcher() domain.Matcher[struct{}] {
+	m := domain.NewMixMatcher[struct{}]()
+	m.SetDefaultMatcher(domain.MatcherDomain)
+	return idnaMatcher[struct{}]{m}
+}
+
+// cutPrefix is strings.CutPrefix, which is not available in go1.18.
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
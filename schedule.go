@@ -0,0 +1,221 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const minutesPerDay = 24 * 60
+
+// minuteSet is a set of the minutes of a day.
+type minuteSet [(minutesPerDay + 63) / 64]uint64
+
+// add adds the minutes in [from, from+n), wrapping around midnight.
+func (s *minuteSet) add(from, n int) {
+	for i := 0; i < n; i++ {
+		m := (from + i) % minutesPerDay
+		s[m/64] |= 1 << (m % 64)
+	}
+}
+
+func (s *minuteSet) has(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	return s[m/64]&(1<<(m%64)) != 0
+}
+
+// parseHours parses comma separated time ranges of a day. A range is
+// either whole hours, e.g. "18-23" is from 18:00 to 23:59, or clock
+// times, e.g. "18:30-23:15" is from 18:30 to 23:14. A range ends on the
+// next day if its end is before its start, e.g. "22-6".
+func parseHours(s string) (*minuteSet, error) {
+	set := new(minuteSet)
+	for _, r := range strings.Split(s, ",") {
+		a, b, isRange := strings.Cut(r, "-")
+		if !isRange {
+			b = a
+		}
+		wholeHours := !strings.Contains(a, ":")
+		if strings.Contains(b, ":") == wholeHours {
+			return nil, fmt.Errorf("invalid time range %s", r)
+		}
+		from, err := parseClock(a, wholeHours)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time range %s, %w", r, err)
+		}
+		to, err := parseClock(b, wholeHours)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time range %s, %w", r, err)
+		}
+		if wholeHours {
+			to += 60
+		} else if from == to {
+			return nil, fmt.Errorf("invalid time range %s, it is empty", r)
+		}
+		n := to - from
+		if n <= 0 {
+			n += minutesPerDay
+		}
+		set.add(from, n)
+	}
+	return set, nil
+}
+
+// parseClock returns the minute of the day of s, an hour "H" or a clock
+// time "HH:MM". "24:00" is allowed as the end of a day.
+func parseClock(s string, wholeHours bool) (int, error) {
+	if wholeHours {
+		h, err := strconv.Atoi(s)
+		if err != nil || h < 0 || h > 23 {
+			return 0, fmt.Errorf("invalid hour %s", s)
+		}
+		return h * 60, nil
+	}
+	hs, ms, _ := strings.Cut(s, ":")
+	h, err := strconv.Atoi(hs)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+	m, err := strconv.Atoi(ms)
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > minutesPerDay {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+	return h*60 + m, nil
+}
+
+// scheduleRule routes the queries of its domains to a route during its
+// hours, in local time.
+type scheduleRule struct {
+	domains []string
+	route   string
+	hours   string
+	minutes *minuteSet
+}
+
+// parseScheduleRule parses a "domain=file route=local|remote hours=18-23"
+// arg of --schedule-rule. domain can be set more than once.
+func parseScheduleRule(s string) (*scheduleRule, error) {
+	r := new(scheduleRule)
+	for _, f := range strings.Fields(s) {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || len(v) == 0 {
+			return nil, fmt.Errorf("invalid schedule rule %s, want key=value, got %s", s, f)
+		}
+		switch k {
+		case "domain":
+			r.domains = append(r.domains, v)
+		case "route":
+			if v != "local" && v != "remote" {
+				return nil, fmt.Errorf("invalid schedule rule %s, route must be local or remote", s)
+			}
+			r.route = v
+		case "hours":
+			m, err := parseHours(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule rule %s, %w", s, err)
+			}
+			r.hours = v
+			r.minutes = m
+		default:
+			return nil, fmt.Errorf("invalid schedule rule %s, unknown key %s", s, k)
+		}
+	}
+	if len(r.domains) == 0 || len(r.route) == 0 || r.minutes == nil {
+		return nil, fmt.Errorf("invalid schedule rule %s, domain, route and hours are required", s)
+	}
+	return r, nil
+}
+
+func parseScheduleRules(ss []string) ([]*scheduleRule, error) {
+	rules := make([]*scheduleRule, 0, len(ss))
+	for _, s := range ss {
+		r, err := parseScheduleRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// scheduleRoute forwards the queries of a scheduleRule to its route
+// during its hours. Other queries go on to the next routing rules. The
+// domains are not matched at other times.
+type scheduleRoute struct {
+	rule    *scheduleRule
+	matcher handler.Matcher
+	node    handler.ExecutableChainNode
+	logger  *zap.Logger
+}
+
+func (s *scheduleRoute) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if s.rule.minutes.has(time.Now()) {
+		ok, err := s.matcher.Match(ctx, qCtx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.logger.Debug("scheduled route", qCtx.InfoField(), zap.String("route", s.rule.route), zap.String("hours", s.rule.hours))
+			return handler.ExecChainNode(ctx, qCtx, s.node)
+		}
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+// initScheduleRules returns the routing nodes of the --schedule-rule args.
+func initScheduleRules(ss []string, local, remote handler.Executable) ([]handler.Executable, error) {
+	rules, err := parseScheduleRules(ss)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]handler.Executable, 0, len(rules))
+	for i, r := range rules {
+		l, err := newDomainList(r.domains)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain file of schedule rule %d, %w", i+1, err)
+		}
+		registerReloadable(fmt.Sprintf("schedule rule %d domain", i+1), l)
+		mlog.S().Infof("schedule rule %d domain files loaded, total length: %d", i+1, l.Len())
+
+		var e handler.Executable
+		switch r.route {
+		case "local":
+			e = local
+		case "remote":
+			e = remote
+		default:
+			return nil, errors.New("inner err, invalid schedule route")
+		}
+		nodes = append(nodes, &scheduleRoute{
+			rule:    r,
+			matcher: msg_matcher.NewQNameMatcher(l),
+			node:    handler.WrapExecutable(e),
+			logger:  mlog.L().Named("schedule"),
+		})
+	}
+	return nodes, nil
+}
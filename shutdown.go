@@ -0,0 +1,130 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"io"
+	"sync"
+	"time"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// gracefulHandler is a dns_handler.Handler that tracks in-flight
+// queries, so they can be drained before exiting.
+type gracefulHandler struct {
+	dns_handler.Handler
+
+	mu      sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func (g *gracefulHandler) ServeDNS(ctx context.Context, req *dns.Msg, w dns_handler.ResponseWriter, meta *handler.RequestMeta) error {
+	g.mu.Lock()
+	if g.closing {
+		g.mu.Unlock()
+		return errShuttingDown
+	}
+	g.wg.Add(1)
+	g.mu.Unlock()
+	defer g.wg.Done()
+	return g.Handler.ServeDNS(ctx, req, w, meta)
+}
+
+func (g *gracefulHandler) isClosing() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closing
+}
+
+// drain stops accepting new queries and waits for in-flight queries
+// to complete. It returns false if timeout is reached.
+func (g *gracefulHandler) drain(timeout time.Duration) bool {
+	g.mu.Lock()
+	g.closing = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+var (
+	shutdownMu   sync.Mutex
+	shutdownDone bool
+	gracefulH    *gracefulHandler // nil if the server is not started yet
+	dnsServer    io.Closer
+	closers      []io.Closer
+)
+
+// setServer sets the server and its handler, so they will be closed
+// by shutdown.
+func setServer(h *gracefulHandler, s io.Closer) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	gracefulH = h
+	dnsServer = s
+}
+
+// registerCloser registers c, so it will be closed after all
+// in-flight queries are completed.
+func registerCloser(c io.Closer) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	closers = append(closers, c)
+}
+
+// shutdown stops accepting new queries, waits up to timeout for
+// in-flight queries, then closes servers, upstreams, caches etc.
+func shutdown(timeout time.Duration) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if shutdownDone {
+		return
+	}
+	shutdownDone = true
+
+	if gracefulH != nil {
+		if !gracefulH.drain(timeout) {
+			mlog.S().Warn("shutdown timeout, in-flight queries are dropped")
+		}
+	}
+	if dnsServer != nil {
+		dnsServer.Close()
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			mlog.S().Warnf("failed to close: %v", err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCloser struct {
+	closed int32 // atomic
+}
+
+func (c *testCloser) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func Test_shutdown_closedStream(t *testing.T) {
+	// shutdown uses package level states, restore them after the test.
+	defer func() {
+		shutdownDone, gracefulH, dnsServer, closers = false, nil, nil, nil
+	}()
+
+	h := &testDNSHandler{delay: 200 * time.Millisecond}
+	gh := &gracefulHandler{Handler: h}
+	s := newTCPServer(gh, 8, zap.NewNop())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(l)
+	setServer(gh, s)
+	c := new(testCloser)
+	registerCloser(c)
+
+	// Close the stream while its query is in flight.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dnsutils.WriteMsgToTCP(conn, newTestQuery("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		inflight := h.inflight
+		h.mu.Unlock()
+		if inflight > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("query is not received")
+		}
+	}
+	conn.Close()
+
+	start := time.Now()
+	shutdown(5 * time.Second)
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Fatal("drain timed out")
+	}
+	h.mu.Lock()
+	inflight := h.inflight
+	h.mu.Unlock()
+	if inflight != 0 {
+		t.Fatalf("%d queries are still in flight after the drain", inflight)
+	}
+	if atomic.LoadInt32(&c.closed) == 0 {
+		t.Fatal("closer is not called")
+	}
+	if !s.isClosed() {
+		t.Fatal("server is not closed")
+	}
+	if err := gh.ServeDNS(context.Background(), newTestQuery("example.com", dns.TypeA), nil, nil); err != errShuttingDown {
+		t.Fatalf("query after shutdown, got error %v, want %v", err, errShuttingDown)
+	}
+}
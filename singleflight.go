@@ -0,0 +1,199 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queryDeduplicator merges identical in-flight queries. Only the first
+// query will be sent to the upstreams, and the others will wait for
+// its response.
+// If window > 0, the response is also shared with identical queries that
+// arrive within the window after it is received, and udp retransmissions
+// of a query that is still in flight are dropped.
+type queryDeduplicator struct {
+	sf     singleflight.Group
+	forced *forcedClients // nil if there is no forced client
+	window time.Duration
+
+	mu        sync.Mutex
+	recent    map[string]*coalescedResult
+	inflight  map[string]struct{} // client ip + msg id + query key of udp queries
+	lastSweep time.Time
+}
+
+type coalescedResult struct {
+	sr     *sharedResult
+	expire time.Time
+}
+
+func newQueryDeduplicator(forced *forcedClients, window time.Duration) *queryDeduplicator {
+	return &queryDeduplicator{
+		forced:   forced,
+		window:   window,
+		recent:   make(map[string]*coalescedResult),
+		inflight: make(map[string]struct{}),
+	}
+}
+
+type sharedResult struct {
+	r      *dns.Msg
+	status handler.ContextStatus
+}
+
+func (d *queryDeduplicator) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	key, err := utils.GetMsgKey(q, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get msg key, %w", err)
+	}
+	clientPrefix, err := d.forced.keyPrefix(qCtx)
+	if err != nil {
+		return err
+	}
+	key = clientPrefix + key
+
+	if d.window > 0 {
+		if meta := qCtx.ReqMeta(); meta.FromUDP && meta.ClientIP != nil {
+			// The client will get the response of the original query.
+			rk := meta.ClientIP.String() + "/" + strconv.Itoa(int(q.Id)) + "/" + key
+			if !d.enter(rk) {
+				qCtx.SetResponse(nil, handler.ContextStatusDropped)
+				return nil
+			}
+			defer d.leave(rk)
+		}
+		if sr := d.lookup(key); sr != nil {
+			qCtx.SetResponse(shareMsg(sr.r, q.Id), sr.status)
+			return nil
+		}
+	}
+
+	// The shared query must not be canceled by any of the waiters,
+	// but it still has the deadline of the first one.
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		ddl = time.Now().Add(defaultLazyUpdateTimeout)
+	}
+	sharedQCtx := qCtx.Copy()
+	ch := d.sf.DoChan(key, func() (interface{}, error) {
+		sharedCtx, cancel := context.WithDeadline(detachedContext{ctx}, ddl)
+		defer cancel()
+		err := handler.ExecChainNode(sharedCtx, sharedQCtx, next)
+		sr := &sharedResult{r: sharedQCtx.R(), status: sharedQCtx.Status()}
+		if err == nil && sr.r != nil && d.window > 0 {
+			// The first query keeps its own response, which may be
+			// modified by the following nodes.
+			d.store(key, &sharedResult{r: sr.r.Copy(), status: sr.status})
+		}
+		return sr, err
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			qCtx.SetResponse(nil, handler.ContextStatusServerFailed)
+			return res.Err
+		}
+		sr := res.Val.(*sharedResult)
+		r := sr.r
+		if res.Shared { // every waiter needs its own copy.
+			r = shareMsg(r, q.Id)
+		}
+		qCtx.SetResponse(r, sr.status)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func shareMsg(r *dns.Msg, id uint16) *dns.Msg {
+	if r == nil {
+		return nil
+	}
+	r = r.Copy()
+	r.Id = id
+	return r
+}
+
+// enter reports false if the query rk is already in flight.
+func (d *queryDeduplicator) enter(rk string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.inflight[rk]; ok {
+		return false
+	}
+	d.inflight[rk] = struct{}{}
+	return true
+}
+
+func (d *queryDeduplicator) leave(rk string) {
+	d.mu.Lock()
+	delete(d.inflight, rk)
+	d.mu.Unlock()
+}
+
+func (d *queryDeduplicator) lookup(key string) *sharedResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := d.recent[key]
+	if e == nil {
+		return nil
+	}
+	if time.Now().After(e.expire) {
+		delete(d.recent, key)
+		return nil
+	}
+	return e.sr
+}
+
+func (d *queryDeduplicator) store(key string, sr *sharedResult) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recent[key] = &coalescedResult{sr: sr, expire: now.Add(d.window)}
+
+	// Remove the expired results once a second.
+	if now.Sub(d.lastSweep) > time.Second {
+		d.lastSweep = now
+		for k, e := range d.recent {
+			if now.After(e.expire) {
+				delete(d.recent, k)
+			}
+		}
+	}
+}
+
+// detachedContext keeps the values of its parent but is never canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,105 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// socks5Proxy is a socks5 proxy with optional username/password
+// authentication (RFC 1929).
+type socks5Proxy struct {
+	addr      string
+	auth      *proxy.Auth
+	remoteDNS bool        // socks5h, let the proxy resolve the server hostname.
+	bind      *bindConfig // nil if not bound
+}
+
+// isSocks5URL reports whether s is a socks5:// or socks5h:// url.
+// Plain "host:port" addresses are handled by the upstream package.
+func isSocks5URL(s string) bool {
+	return strings.HasPrefix(s, "socks5://") || strings.HasPrefix(s, "socks5h://")
+}
+
+// parseSocks5 parses "socks5://[user:pass@]host:port" or
+// "socks5h://[user:pass@]host:port".
+func parseSocks5(s string) (*socks5Proxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &socks5Proxy{addr: u.Host, remoteDNS: u.Scheme == "socks5h"}
+	if _, _, err := net.SplitHostPort(p.addr); err != nil {
+		return nil, fmt.Errorf("invalid socks5 proxy address %s, %w", p.addr, err)
+	}
+	if u.User != nil {
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		// RFC 1929: both are 1 to 255 bytes.
+		if len(user) == 0 || len(user) > 255 || len(pass) == 0 || len(pass) > 255 {
+			return nil, errors.New("invalid socks5 username or password, both must be 1 to 255 bytes")
+		}
+		p.auth = &proxy.Auth{User: user, Password: pass}
+	}
+	return p, nil
+}
+
+func (p *socks5Proxy) dialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if !p.remoteDNS {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			addr = net.JoinHostPort(ips[0].IP.String(), port)
+		}
+	}
+
+	d, err := proxy.SOCKS5("tcp", p.addr, p.auth, p.bind.dialer("tcp", nil))
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect via socks5 proxy %s, %w", p.addr, err)
+	}
+	return c, nil
+}
+
+// newSocks5Upstream creates a TCP, DoT or DoH upstream that connects
+// through the socks5 proxy in opt.Socks5. Connections to the proxy
+// are bound to bind if it is not nil.
+func newSocks5Upstream(addr string, opt *upstream.Opt, bind *bindConfig) (upstream.Upstream, error) {
+	p, err := parseSocks5(opt.Socks5)
+	if err != nil {
+		return nil, err
+	}
+	p.bind = bind
+	return newStreamUpstream(addr, opt, p.dialContext)
+}
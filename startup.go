@@ -0,0 +1,87 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// startupHandler answers queries that arrive before the entry is
+// initialized, depending on mode:
+//   - queue: the query waits until the entry is ready, at most timeout.
+//     It gets a SERVFAIL if the entry is still not ready.
+//   - servfail, refused: the query gets this rcode at once.
+//
+// In the default "wait" mode servers are started after the entry is
+// ready, so startupHandler never sees a query before it's ready.
+type startupHandler struct {
+	mode    string
+	timeout time.Duration
+
+	readyOnce sync.Once
+	ready     chan struct{}
+	h         dns_handler.Handler // set before ready is closed
+}
+
+func newStartupHandler(mode string, timeout time.Duration) *startupHandler {
+	return &startupHandler{mode: mode, timeout: timeout, ready: make(chan struct{})}
+}
+
+// setReady makes s forward all queries to h.
+func (s *startupHandler) setReady(h dns_handler.Handler) {
+	s.readyOnce.Do(func() {
+		s.h = h
+		close(s.ready)
+	})
+}
+
+func (s *startupHandler) ServeDNS(ctx context.Context, req *dns.Msg, w dns_handler.ResponseWriter, meta *handler.RequestMeta) error {
+	select {
+	case <-s.ready:
+		return s.h.ServeDNS(ctx, req, w, meta)
+	default:
+	}
+
+	switch s.mode {
+	case "queue":
+		// The waiting time counts towards the query timeout.
+		ctx, cancel := context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+		select {
+		case <-s.ready:
+			return s.h.ServeDNS(ctx, req, w, meta)
+		case <-ctx.Done():
+			return writeRcode(w, req, dns.RcodeServerFailure)
+		}
+	case "refused":
+		return writeRcode(w, req, dns.RcodeRefused)
+	default:
+		return writeRcode(w, req, dns.RcodeServerFailure)
+	}
+}
+
+func writeRcode(w dns_handler.ResponseWriter, req *dns.Msg, rcode int) error {
+	r := new(dns.Msg)
+	r.SetRcode(req, rcode)
+	return w.Write(r)
+}
@@ -0,0 +1,141 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream/doh"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/upstream/transport"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	tlsHandshakeTimeout   = time.Second * 5
+	defaultDoHIdleTimeout = time.Second * 30
+)
+
+// dialFunc dials a tcp connection to addr.
+type dialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// newStreamUpstream creates a TCP, DoT or DoH upstream that dials
+// its connections by dial.
+func newStreamUpstream(addr string, opt *upstream.Opt, dial dialFunc) (upstream.Upstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialAddr := u.Host
+	if len(opt.DialAddr) > 0 {
+		dialAddr = opt.DialAddr
+	}
+	if _, _, err := net.SplitHostPort(dialAddr); err != nil {
+		dialAddr = net.JoinHostPort(strings.Trim(dialAddr, "[]"), defaultPort(u.Scheme))
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		return &transport.Transport{
+			Logger: opt.Logger,
+			DialFunc: func(ctx context.Context) (net.Conn, error) {
+				return dial(ctx, dialAddr)
+			},
+			WriteFunc:      dnsutils.WriteMsgToTCP,
+			ReadFunc:       dnsutils.ReadMsgFromTCP,
+			IdleTimeout:    opt.IdleTimeout,
+			EnablePipeline: opt.EnablePipeline,
+			MaxConns:       opt.MaxConns,
+		}, nil
+	case "tls":
+		tlsConfig := new(tls.Config)
+		if opt.TLSConfig != nil {
+			tlsConfig = opt.TLSConfig.Clone()
+		}
+		if len(tlsConfig.ServerName) == 0 {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		return &transport.Transport{
+			Logger: opt.Logger,
+			DialFunc: func(ctx context.Context) (net.Conn, error) {
+				conn, err := dial(ctx, dialAddr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, tlsConfig)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					tlsConn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+			WriteFunc:      dnsutils.WriteMsgToTCP,
+			ReadFunc:       dnsutils.ReadMsgFromTCP,
+			IdleTimeout:    opt.IdleTimeout,
+			EnablePipeline: opt.EnablePipeline,
+			MaxConns:       opt.MaxConns,
+		}, nil
+	case "https":
+		if opt.EnableHTTP3 {
+			return nil, errors.New("http3 is not supported")
+		}
+		idleTimeout := defaultDoHIdleTimeout
+		if opt.IdleTimeout > 0 {
+			idleTimeout = opt.IdleTimeout
+		}
+		maxConns := 2
+		if opt.MaxConns > 0 {
+			maxConns = opt.MaxConns
+		}
+		t := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dial(ctx, dialAddr)
+			},
+			TLSClientConfig:     opt.TLSConfig,
+			TLSHandshakeTimeout: tlsHandshakeTimeout,
+			IdleConnTimeout:     idleTimeout,
+			MaxConnsPerHost:     maxConns,
+			MaxIdleConnsPerHost: maxConns,
+		}
+		if _, err := http2.ConfigureTransports(t); err != nil {
+			return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
+		}
+		return &doh.Upstream{EndPoint: addr, Client: &http.Client{Transport: t}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", u.Scheme)
+	}
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "tls", "quic", "doq":
+		return "853"
+	case "https":
+		return "443"
+	default:
+		return "53"
+	}
+}
@@ -0,0 +1,199 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpServerWriteTimeout = time.Second
+	tcpServerIdleTimeout  = time.Second * 10
+	tcpServerFirstRead    = time.Millisecond * 500
+)
+
+// tcpServer serves queries from tcp, dot and unix socket connections.
+// Queries on one connection are handled concurrently and responses are
+// written as soon as they are ready, so they may be out of order (RFC
+// 7766 6.2.1.1). At most maxConcurrent queries of a connection are in
+// flight, further queries are not read until one of them completes.
+type tcpServer struct {
+	handler       dns_handler.Handler
+	maxConcurrent int
+	logger        *zap.Logger
+
+	// replyMalformed makes the server answer FORMERR to malformed
+	// queries. Otherwise they are ignored.
+	replyMalformed bool
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+}
+
+var errTCPServerClosed = errors.New("tcp server closed")
+
+func newTCPServer(h dns_handler.Handler, maxConcurrent int, logger *zap.Logger) *tcpServer {
+	return &tcpServer{
+		handler:       h,
+		maxConcurrent: maxConcurrent,
+		logger:        logger,
+		listeners:     make(map[net.Listener]struct{}),
+	}
+}
+
+// serve accepts connections from l until l or s is closed.
+func (s *tcpServer) serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return errTCPServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return errTCPServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *tcpServer) serveConn(c net.Conn) {
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	meta := new(handler.RequestMeta)
+	if clientIP := utils.GetIPFromAddr(c.RemoteAddr()); clientIP != nil {
+		meta.ClientIP = clientIP
+	} else {
+		s.logger.Warn("failed to acquire client ip addr", zap.Stringer("addr", c.RemoteAddr()))
+	}
+
+	w := &tcpResponseWriter{c: c}
+	sem := make(chan struct{}, s.maxConcurrent)
+	var wg sync.WaitGroup
+	// Responses of in-flight queries are still written after the
+	// client stopped sending queries or the connection is idle.
+	defer wg.Wait()
+
+	c.SetReadDeadline(time.Now().Add(tcpServerFirstRead))
+	for {
+		b, _, err := dnsutils.ReadRawMsgFromTCP(c)
+		if err != nil {
+			return
+		}
+		q := new(dns.Msg)
+		err = q.Unpack(b.Bytes())
+		if err != nil {
+			s.logger.Debug("malformed query", zap.Stringer("from", c.RemoteAddr()), zap.Error(err))
+			if r := malformedQueryReply(b.Bytes()); r != nil && s.replyMalformed {
+				w.writeRaw(r)
+			}
+			b.Release()
+			c.SetReadDeadline(time.Now().Add(tcpServerIdleTimeout))
+			continue
+		}
+		b.Release()
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := s.handler.ServeDNS(ctx, q, w, meta); err != nil {
+				s.logger.Warn("handler err", zap.Error(err))
+				cancel()
+				c.Close()
+			}
+		}()
+		c.SetReadDeadline(time.Now().Add(tcpServerIdleTimeout))
+	}
+}
+
+func (s *tcpServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close closes all listeners. Established connections are closed
+// after their in-flight queries are completed.
+func (s *tcpServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	return nil
+}
+
+// tcpResponseWriter writes responses to a tcp connection. It is safe
+// for concurrent use.
+type tcpResponseWriter struct {
+	mu sync.Mutex
+	c  net.Conn
+}
+
+func (t *tcpResponseWriter) Write(m *dns.Msg) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.c.SetWriteDeadline(time.Now().Add(tcpServerWriteTimeout))
+	_, err := dnsutils.WriteMsgToTCP(t.c, m)
+	return err
+}
+
+func (t *tcpResponseWriter) writeRaw(b []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.c.SetWriteDeadline(time.Now().Add(tcpServerWriteTimeout))
+	_, err := dnsutils.WriteRawMsgToTCP(t.c, b)
+	return err
+}
@@ -0,0 +1,114 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDNSHandler is a dns_handler.Handler that replies every query with
+// an empty response after delay.
+type testDNSHandler struct {
+	delay time.Duration
+
+	mu          sync.Mutex
+	inflight    int
+	maxInflight int
+}
+
+func (h *testDNSHandler) ServeDNS(_ context.Context, q *dns.Msg, w dns_handler.ResponseWriter, _ *handler.RequestMeta) error {
+	h.mu.Lock()
+	h.inflight++
+	if h.inflight > h.maxInflight {
+		h.maxInflight = h.inflight
+	}
+	h.mu.Unlock()
+
+	time.Sleep(h.delay)
+
+	h.mu.Lock()
+	h.inflight--
+	h.mu.Unlock()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	return w.Write(r)
+}
+
+func Test_tcpServer_pipeline(t *testing.T) {
+	const (
+		maxConcurrent = 3
+		n             = 10
+	)
+	h := &testDNSHandler{delay: 50 * time.Millisecond}
+	s := newTCPServer(h, maxConcurrent, zap.NewNop())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Send all queries at once without waiting for responses.
+	buf := new(bytes.Buffer)
+	ids := make(map[uint16]bool, n)
+	for i := 0; i < n; i++ {
+		q := newTestQuery("example.com", dns.TypeA)
+		q.Id = uint16(i + 1)
+		ids[q.Id] = true
+		if _, err := dnsutils.WriteMsgToTCP(buf, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < n; i++ {
+		r, _, err := dnsutils.ReadMsgFromTCP(c)
+		if err != nil {
+			t.Fatalf("failed to read response %d: %v", i, err)
+		}
+		if !ids[r.Id] {
+			t.Fatalf("unexpected or duplicate response id %d", r.Id)
+		}
+		delete(ids, r.Id)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.maxInflight != maxConcurrent {
+		t.Fatalf("max in-flight queries = %d, want %d", h.maxInflight, maxConcurrent)
+	}
+}
@@ -0,0 +1,82 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// ttlOverride sets the ttl of records in upstream responses by their
+// types. Records of other types (including NS and SOA unless they are
+// listed) are not changed. It is placed after the cache and before the
+// routing nodes, so the cache stores the changed response and every route
+// is covered.
+type ttlOverride struct {
+	ttl map[uint16]uint32
+}
+
+// parseTTLOverride parses "TYPE=seconds" pairs. Each string can have
+// multiple pairs separated by commas. e.g. "A=300,AAAA=300".
+func parseTTLOverride(ss []string) (*ttlOverride, error) {
+	m := make(map[uint16]uint32)
+	for _, s := range ss {
+		for _, pair := range strings.Split(s, ",") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) == 0 {
+				continue
+			}
+			typ, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid ttl override %s, want TYPE=seconds", pair)
+			}
+			t, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(typ))]
+			if !ok || t == dns.TypeOPT {
+				return nil, fmt.Errorf("invalid ttl override %s, unknown type %s", pair, typ)
+			}
+			ttl, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ttl override %s, %w", pair, err)
+			}
+			m[t] = uint32(ttl)
+		}
+	}
+	return &ttlOverride{ttl: m}, nil
+}
+
+func (o *ttlOverride) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	err := handler.ExecChainNode(ctx, qCtx, next)
+	if r := qCtx.R(); r != nil {
+		o.apply(r)
+	}
+	return err
+}
+
+func (o *ttlOverride) apply(r *dns.Msg) {
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if ttl, ok := o.ttl[rr.Header().Rrtype]; ok {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// A socket serves one query at a time. It is closed after it has
+	// served randomPortMaxQueries queries or is older than
+	// randomPortMaxAge, so a source port is only open for a short time.
+	randomPortMaxQueries = 16
+	randomPortMaxAge     = time.Second * 5
+
+	// randomPortMaxIdle is the maximum number of idle sockets that
+	// are kept for reuse by an upstream.
+	randomPortMaxIdle = 16
+
+	// randomPortDialTries is the number of random ports to try before
+	// giving up. A port may be in use by other sockets.
+	randomPortDialTries = 8
+
+	randomPortMin = 1024
+)
+
+// randomPortUpstream is a udp upstream that sends queries from sockets
+// with random source ports and random query ids, so an off-path
+// attacker has to guess both to spoof a response.
+// Responses are only accepted from the socket that sent the query.
+// Packets with a wrong id or question are ignored.
+type randomPortUpstream struct {
+	dialAddr string
+	bind     *bindConfig
+
+	mu     sync.Mutex
+	idle   []*randomPortConn
+	closed bool
+}
+
+type randomPortConn struct {
+	net.Conn
+	created time.Time
+	queries int
+}
+
+// newRandomPortUpstream returns a udp upstream that uses
+// randomPortUpstream and retries truncated responses over tcp.
+func newRandomPortUpstream(addr string, opt *upstreamOpt) (*udpFallbackUpstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialAddr := udpDialAddr(u, opt)
+	return &udpFallbackUpstream{
+		u: &randomPortUpstream{dialAddr: dialAddr, bind: opt.Bind},
+		t: newTCPFallback(dialAddr, opt),
+	}, nil
+}
+
+func (u *randomPortUpstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	c, err := u.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := exchangeRandomPort(ctx, c, q)
+	u.putConn(c, err == nil)
+	return r, err
+}
+
+// getConn returns an idle socket or dials a new one.
+func (u *randomPortUpstream) getConn(ctx context.Context) (*randomPortConn, error) {
+	u.mu.Lock()
+	for len(u.idle) > 0 {
+		c := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(c.created) < randomPortMaxAge {
+			u.mu.Unlock()
+			return c, nil
+		}
+		c.Close()
+	}
+	closed := u.closed
+	u.mu.Unlock()
+	if closed {
+		return nil, net.ErrClosed
+	}
+
+	c, err := dialRandomPort(ctx, u.bind, u.dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &randomPortConn{Conn: c, created: time.Now()}, nil
+}
+
+// putConn puts c back to the idle sockets if it can be reused.
+// Sockets that failed a query are closed, a late response may still
+// arrive on them.
+func (u *randomPortUpstream) putConn(c *randomPortConn, ok bool) {
+	c.queries++
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !ok || u.closed || c.queries >= randomPortMaxQueries ||
+		time.Since(c.created) >= randomPortMaxAge || len(u.idle) >= randomPortMaxIdle {
+		c.Close()
+		return
+	}
+	u.idle = append(u.idle, c)
+}
+
+func (u *randomPortUpstream) CloseIdleConnections() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, c := range u.idle {
+		c.Close()
+	}
+	u.idle = nil
+}
+
+func (u *randomPortUpstream) Close() error {
+	u.mu.Lock()
+	u.closed = true
+	u.mu.Unlock()
+	u.CloseIdleConnections()
+	return nil
+}
+
+// dialRandomPort dials a connected udp socket to addr from a random
+// source port that is not below randomPortMin.
+func dialRandomPort(ctx context.Context, bind *bindConfig, addr string) (net.Conn, error) {
+	d := bind.dialer("udp", nil)
+	var localIP net.IP
+	if bind != nil {
+		localIP = bind.Addr
+	}
+	var err error
+	for i := 0; i < randomPortDialTries; i++ {
+		var port int
+		port, err = randomPort()
+		if err != nil {
+			return nil, err
+		}
+		d.LocalAddr = &net.UDPAddr{IP: localIP, Port: port}
+		var c net.Conn
+		c, err = d.DialContext(ctx, "udp", addr)
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free source port after %d tries, %w", randomPortDialTries, err)
+}
+
+func randomPort() (int, error) {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return randomPortMin + int(binary.BigEndian.Uint16(b))%(65536-randomPortMin), nil
+}
+
+// exchangeRandomPort sends q over c with a random id and waits for its
+// response. Packets that are not the response of q are ignored.
+func exchangeRandomPort(ctx context.Context, c net.Conn, q *dns.Msg) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second * 5)
+	}
+	c.SetDeadline(deadline)
+
+	// Unblock the read if ctx is canceled before the deadline. Wait for
+	// the goroutine to exit before returning, c may be put back into the
+	// pool and used by another query then.
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	defer func() {
+		close(done)
+		<-exited
+	}()
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	qCopy := q.Copy()
+	qCopy.Id = dns.Id()
+	if _, err := dnsutils.WriteMsgToUDP(c, qCopy); err != nil {
+		return nil, err
+	}
+	for {
+		r, _, err := dnsutils.ReadMsgFromUDP(c, maxUDPSize)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) || errors.Is(err, net.ErrClosed) {
+				return nil, err
+			}
+			continue // not a dns msg
+		}
+		if r.Id != qCopy.Id || !r.Response || !sameQuestion(r, qCopy) {
+			continue
+		}
+		r.Id = q.Id
+		return r, nil
+	}
+}
+
+func sameQuestion(r, q *dns.Msg) bool {
+	if len(r.Question) != len(q.Question) {
+		return false
+	}
+	for i := range q.Question {
+		a, b := r.Question[i], q.Question[i]
+		if a.Qtype != b.Qtype || a.Qclass != b.Qclass || !strings.EqualFold(a.Name, b.Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// maxUDPSize is the read buffer size of udp upstreams.
+const maxUDPSize = 4096
+
+// udpSizeUpstream advertises its udp payload size to udp upstreams.
+// The OPT record will be removed from the response if the query
+// didn't have one.
+type udpSizeUpstream struct {
+	bundled_upstream.Upstream
+	size uint16
+}
+
+// isUDPSizeApplicable reports whether addr is a udp upstream.
+func isUDPSizeApplicable(addr string) bool {
+	scheme, _, _ := strings.Cut(addr, "://")
+	switch scheme {
+	case "udp", "udpme":
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *udpSizeUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	clientOpt := q.IsEdns0()
+
+	qCopy := q.Copy()
+	opt := qCopy.IsEdns0()
+	if opt == nil {
+		opt = dnsutils.UpgradeEDNS0(qCopy)
+	}
+	opt.SetUDPSize(u.size)
+	r, err := u.Upstream.Exchange(ctx, qCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	if clientOpt == nil {
+		dnsutils.RemoveEDNS0(r)
+	}
+	return r, nil
+}
@@ -0,0 +1,85 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenUnix listens on a unix socket at path and sets its permission
+// to mode, an octal string like "0660". A stale socket file left by a
+// previous run will be removed.
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %s, %w", mode, err)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket, %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set socket mode, %w", err)
+	}
+	return &unixListener{Listener: l}, nil
+}
+
+// unixListener reports its clients as 127.0.0.1, because the server
+// needs a client ip for logging, --allow-client and --client-qps.
+type unixListener struct {
+	net.Listener
+}
+
+var unixClientAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixConn{Conn: c}, nil
+}
+
+type unixConn struct {
+	net.Conn
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return unixClientAddr
+}
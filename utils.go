@@ -19,26 +19,371 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/hosts"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"sync/atomic"
 )
 
+// clientFilter refuses queries from clients that are not in the allowed list.
+// Queries without client ip, e.g. warm-up queries, are not filtered.
+type clientFilter struct {
+	allowed *netlist.List
+	logger  *zap.Logger
+}
+
+func (f *clientFilter) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	ip := qCtx.ReqMeta().ClientIP
+	if ip == nil {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	ok, err := f.allowed.Match(ip)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		f.logger.Debug("client is not allowed, query refused", qCtx.InfoField(), zap.Stringer("client", ip))
+		queryInfoFrom(ctx).addEDE(dns.ExtendedErrorCodeProhibited, "client not allowed")
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeRefused)
+		qCtx.SetResponse(r, handler.ContextStatusRejected)
+		return nil
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+// TTL of the responses to blocked queries.
+const blockedReplyTTL = 300
+
+// blackList blocks queries by their names. If ipv4 or ipv6 is set, it
+// replies A/AAAA queries with these addresses (sinkhole). Otherwise,
+// it replies NXDOMAIN.
 type blackList struct {
-	m *msg_matcher.QNameMatcher
+	m      *msg_matcher.QNameMatcher
+	ipv4   []net.IP
+	ipv6   []net.IP
+	logger *zap.Logger
 }
 
 func (b *blackList) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
 	q := qCtx.Q()
 	if b.m.MatchMsg(q) {
+		metrics.observeBlocked()
+		b.logger.Debug("query blocked", qCtx.InfoField())
+		queryInfoFrom(ctx).addEDE(dns.ExtendedErrorCodeBlocked, "blacklist")
+		qCtx.SetResponse(b.blockedReply(q), handler.ContextStatusRejected)
+		return nil
+	}
+
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+func (b *blackList) blockedReply(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if len(b.ipv4) == 0 && len(b.ipv6) == 0 {
+		r.Rcode = dns.RcodeNameError
+		return r
+	}
+
+	for _, question := range q.Question {
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: blockedReplyTTL}
+		switch question.Qtype {
+		case dns.TypeA:
+			for _, ip := range b.ipv4 {
+				r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip})
+			}
+		case dns.TypeAAAA:
+			for _, ip := range b.ipv6 {
+				r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+	return r
+}
+
+// parseBlockMode returns the ips of the blocked replies of
+// --block-mode. Both are empty if blocked queries get NXDOMAIN.
+func parseBlockMode(opt *Opt) (ipv4, ipv6 []net.IP, err error) {
+	switch opt.BlockMode {
+	case "", "nxdomain":
+	case "zero-ip":
+		ipv4 = []net.IP{net.IPv4zero}
+		ipv6 = []net.IP{net.IPv6zero}
+	case "sinkhole":
+		if len(opt.BlockIP) == 0 {
+			return nil, nil, errors.New("sinkhole block mode requires block ip")
+		}
+		for _, s := range opt.BlockIP {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, nil, fmt.Errorf("invalid block ip %s", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ipv4 = append(ipv4, ip4)
+			} else {
+				ipv6 = append(ipv6, ip)
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown block mode %s", opt.BlockMode)
+	}
+	return ipv4, ipv6, nil
+}
+
+type hostsExec struct {
+	h   *hosts.Hosts
+	ttl uint32
+}
+
+func (e *hostsExec) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if r := e.h.LookupMsg(qCtx.Q()); r != nil {
+		dnsutils.SetTTL(r, e.ttl)
+		qCtx.SetResponse(r, handler.ContextStatusResponded)
+		return nil
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+// TTL of the synthesized HINFO record of minimal ANY responses.
+const anyReplyTTL = 3600
+
+// anyQuery handles ANY queries (RFC 8482), so mosdns-cn can't be used
+// to amplify attacks with them. In the refuse mode, ANY queries are
+// replied with REFUSED. In the minimal mode, they are replied with a
+// synthesized HINFO record. Other queries are not affected.
+type anyQuery struct {
+	refuse bool
+	logger *zap.Logger
+}
+
+// newAnyQuery returns the handler of ANY queries for mode, or nil if
+// ANY queries are passed through to upstreams.
+func newAnyQuery(mode string, logger *zap.Logger) (handler.Executable, error) {
+	switch mode {
+	case "", "minimal":
+		return &anyQuery{logger: logger}, nil
+	case "refuse":
+		return &anyQuery{refuse: true, logger: logger}, nil
+	case "passthrough":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid any mode %s", mode)
+	}
+}
+
+func (a *anyQuery) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeANY {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+
+	a.logger.Debug("any query", qCtx.InfoField(), zap.Bool("refused", a.refuse))
+	r := new(dns.Msg)
+	if a.refuse {
+		r.SetRcode(q, dns.RcodeRefused)
+	} else {
+		r.SetReply(q)
+		r.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyReplyTTL},
+			Cpu: "RFC8482",
+		}}
+	}
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	return nil
+}
+
+// noIPv6 answers AAAA queries with empty responses and removes AAAA
+// records from other responses.
+type noIPv6 struct{}
+
+func (n *noIPv6) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) == 1 && q.Question[0].Qtype == dns.TypeAAAA {
 		r := new(dns.Msg)
 		r.SetReply(q)
-		r.Rcode = dns.RcodeNameError
-		qCtx.SetResponse(r, handler.ContextStatusRejected)
+		queryInfoFrom(ctx).addEDE(dns.ExtendedErrorCodeFiltered, "no-ipv6")
+		qCtx.SetResponse(r, handler.ContextStatusResponded)
 		return nil
 	}
 
-	return handler.ExecChainNode(ctx, qCtx, next)
+	err := handler.ExecChainNode(ctx, qCtx, next)
+	if r := qCtx.R(); r != nil {
+		r.Answer = removeAAAA(r.Answer)
+		r.Ns = removeAAAA(r.Ns)
+		r.Extra = removeAAAA(r.Extra)
+	}
+	return err
+}
+
+// removeAAAA removes AAAA records and their signatures from rrs.
+func removeAAAA(rrs []dns.RR) []dns.RR {
+	o := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeAAAA {
+			continue
+		}
+		o = append(o, rr)
+	}
+	return o
+}
+
+// rrRotator rotates the A and AAAA records in responses, so clients
+// that always use the first address are spread over all of them.
+// Other records (e.g. CNAME) keep their positions. Responses are
+// rotated after the cache, so the cached entry is never changed.
+type rrRotator struct {
+	n uint32 // atomic
+}
+
+func (r *rrRotator) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	err := handler.ExecChainNode(ctx, qCtx, next)
+	if resp := qCtx.R(); resp != nil {
+		n := int(atomic.AddUint32(&r.n, 1))
+		rotateRRs(resp.Answer, dns.TypeA, n)
+		rotateRRs(resp.Answer, dns.TypeAAAA, n)
+	}
+	return err
+}
+
+// rotateRRs rotates the records of type t in rrs by n positions.
+// Records of other types are not moved.
+func rotateRRs(rrs []dns.RR, t uint16, n int) {
+	var idx []int
+	for i, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < 2 {
+		return
+	}
+	rotated := make([]dns.RR, len(idx))
+	for i := range idx {
+		rotated[i] = rrs[idx[(i+n)%len(idx)]]
+	}
+	for i, j := range idx {
+		rrs[j] = rotated[i]
+	}
+}
+
+// minimalResponses removes the authority and additional records that
+// are not needed by clients. Like rrRotator, it runs after the cache, so
+// the cached entry is complete.
+//   - The OPT record is always kept.
+//   - The authority section of negative responses (e.g. the SOA, which
+//     clients use as the negative TTL) and of responses to DO queries
+//     (e.g. NSEC records that prove a wildcard expansion) is kept.
+type minimalResponses struct{}
+
+func (m *minimalResponses) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	err := handler.ExecChainNode(ctx, qCtx, next)
+	if r := qCtx.R(); r != nil {
+		minimizeMsg(r, dnssecOK(qCtx.Q()))
+	}
+	return err
+}
+
+func minimizeMsg(r *dns.Msg, do bool) {
+	if len(r.Answer) > 0 && !do {
+		r.Ns = nil
+	}
+	extra := r.Extra[:0]
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	for i := len(extra); i < len(r.Extra); i++ {
+		r.Extra[i] = nil
+	}
+	r.Extra = extra
+}
+
+// dnssecOK reports whether m has the DNSSEC OK (DO) bit set.
+func dnssecOK(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// localIPVerifier matches the local responses that can be trusted by
+// their addresses. CNAME records are ignored, so only the final
+// addresses of a CNAME chain matter. mode is one of
+//   - any: at least one address is in the list.
+//   - all: all addresses are in the list.
+//   - off: all responses are trusted.
+//
+// Responses without any A/AAAA record (e.g. NXDOMAIN) are matched by
+// noIP, one of
+//   - remote: not trusted.
+//   - local: trusted.
+//   - local-nxdomain: only NXDOMAIN responses are trusted.
+type localIPVerifier struct {
+	l    netlist.Matcher
+	mode string
+	noIP string
+}
+
+func (m *localIPVerifier) Match(_ context.Context, qCtx *handler.Context) (bool, error) {
+	if dryRun != nil {
+		dryRun.add("the local response is used if it %s, otherwise the remote response", m.describe())
+	}
+	r := qCtx.R()
+	if r == nil {
+		return false, nil
+	}
+	n, local := 0, 0
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		n++
+		if m.mode == "off" {
+			continue
+		}
+		matched, err := m.l.Match(ip)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			local++
+		}
+	}
+
+	if n == 0 {
+		switch m.noIP {
+		case "local":
+			return true, nil
+		case "local-nxdomain":
+			return r.Rcode == dns.RcodeNameError, nil
+		default:
+			return false, nil
+		}
+	}
+	switch m.mode {
+	case "off":
+		return true, nil
+	case "all":
+		return local == n, nil
+	default:
+		return local > 0, nil
+	}
 }
 
 type end struct{}
@@ -53,3 +398,40 @@ func (d *dropResponse) Exec(ctx context.Context, qCtx *handler.Context, next han
 	qCtx.SetResponse(nil, handler.ContextStatusDropped)
 	return handler.ExecChainNode(ctx, qCtx, next)
 }
+
+// subChain runs its executables as an inner chain, then continues
+// with the outer chain. It can be used wherever a single
+// handler.Executable is expected.
+type subChain struct {
+	head handler.ExecutableChainNode
+}
+
+func newSubChain(es ...handler.Executable) *subChain {
+	var head, prev handler.ExecutableChainNode
+	for _, e := range es {
+		n := &handler.ExecutableNodeWrapper{Executable: e}
+		if prev == nil {
+			head = n
+		} else {
+			prev.LinkNext(n)
+			n.LinkPrevious(prev)
+		}
+		prev = n
+	}
+	return &subChain{head: head}
+}
+
+func (s *subChain) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if err := handler.ExecChainNode(ctx, qCtx, s.head); err != nil {
+		return err
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+// stripECS removes the edns0 client subnet from the query.
+type stripECS struct{}
+
+func (s *stripECS) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	dnsutils.RemoveMsgECS(qCtx.Q())
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
@@ -0,0 +1,249 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+)
+
+// testResponder is a handler.Executable that acts as an upstream. It
+// answers every query with an A record of ip and ttl.
+type testResponder struct {
+	ip      net.IP
+	ttl     uint32
+	queries int
+}
+
+func (r *testResponder) Exec(_ context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	r.queries++
+	q := qCtx.Q()
+	m := new(dns.Msg)
+	m.SetReply(q)
+	m.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: r.ttl},
+		A:   r.ip,
+	}}
+	qCtx.SetResponse(m, handler.ContextStatusResponded)
+	return nil
+}
+
+// linkChain links es into a chain and returns its head.
+func linkChain(es ...handler.Executable) handler.ExecutableChainNode {
+	var head, tail handler.ExecutableChainNode
+	for _, e := range es {
+		n := handler.WrapExecutable(e)
+		if head == nil {
+			head = n
+		} else {
+			tail.LinkNext(n)
+		}
+		tail = n
+	}
+	return head
+}
+
+// execChain links es into a chain and executes qCtx with it.
+func execChain(t *testing.T, qCtx *handler.Context, es ...handler.Executable) {
+	t.Helper()
+	if err := handler.ExecChainNode(context.Background(), qCtx, linkChain(es...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestQuery(name string, qtype uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	return q
+}
+
+func Test_anyQuery(t *testing.T) {
+	tests := []struct {
+		mode          string
+		qtype         uint16
+		wantRcode     int
+		wantType      uint16 // type of the only answer, 0 if no answer
+		wantForwarded bool
+	}{
+		{mode: "refuse", qtype: dns.TypeANY, wantRcode: dns.RcodeRefused},
+		{mode: "refuse", qtype: dns.TypeA, wantType: dns.TypeA, wantForwarded: true},
+		{mode: "minimal", qtype: dns.TypeANY, wantType: dns.TypeHINFO},
+		{mode: "", qtype: dns.TypeANY, wantType: dns.TypeHINFO},
+		{mode: "minimal", qtype: dns.TypeA, wantType: dns.TypeA, wantForwarded: true},
+		{mode: "passthrough", qtype: dns.TypeANY, wantType: dns.TypeA, wantForwarded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			aq, err := newAnyQuery(tt.mode, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			upstream := &testResponder{ip: net.IPv4(1, 2, 3, 4)}
+			es := []handler.Executable{upstream}
+			if aq != nil {
+				es = append([]handler.Executable{aq}, es...)
+			}
+
+			qCtx := handler.NewContext(newTestQuery("example.com", tt.qtype), nil)
+			execChain(t, qCtx, es...)
+			r := qCtx.R()
+			if r == nil {
+				t.Fatal("no response")
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			switch {
+			case tt.wantType == 0 && len(r.Answer) != 0:
+				t.Fatalf("unexpected answers %v", r.Answer)
+			case tt.wantType != 0 && (len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != tt.wantType):
+				t.Fatalf("answers = %v, want one %s record", r.Answer, dns.TypeToString[tt.wantType])
+			}
+			if forwarded := upstream.queries > 0; forwarded != tt.wantForwarded {
+				t.Fatalf("forwarded = %v, want %v", forwarded, tt.wantForwarded)
+			}
+		})
+	}
+
+	if _, err := newAnyQuery("invalid", zap.NewNop()); err == nil {
+		t.Fatal("invalid mode should be rejected")
+	}
+}
+
+// newTestAnswer returns a response with an A or AAAA record for each ip.
+func newTestAnswer(ips ...string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(newTestQuery("example.com", dns.TypeA))
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		hdr := dns.RR_Header{Name: "example.com.", Class: dns.ClassINET, Ttl: 300}
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return r
+}
+
+func Test_localIPVerifier_mixed(t *testing.T) {
+	l := netlist.NewList()
+	if err := netlist.BatchLoad(l, []string{"1.2.3.0/24", "2001:db8::/32"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Sort()
+
+	tests := []struct {
+		name      string
+		match     string
+		ips       []string
+		wantLocal bool
+	}{
+		{"strict all local", "strict", []string{"1.2.3.4", "1.2.3.5"}, true},
+		{"strict mixed", "strict", []string{"1.2.3.4", "8.8.8.8"}, false},
+		{"strict mixed v6", "strict", []string{"2001:db8::1", "2606:4700::1"}, false},
+		{"strict all remote", "strict", []string{"8.8.8.8"}, false},
+		{"any all local", "any", []string{"1.2.3.4", "2001:db8::1"}, true},
+		{"any mixed", "any", []string{"8.8.8.8", "1.2.3.4"}, true},
+		{"any mixed v6", "any", []string{"2606:4700::1", "2001:db8::1"}, true},
+		{"any all remote", "any", []string{"8.8.8.8", "2606:4700::1"}, false},
+		{"default mixed", "", []string{"1.2.3.4", "8.8.8.8"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode, err := localIPVerifyMode(&Opt{LocalIPMatch: tt.match})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &localIPVerifier{l: l, mode: mode}
+			qCtx := handler.NewContext(newTestQuery("example.com", dns.TypeA), nil)
+			qCtx.SetResponse(newTestAnswer(tt.ips...), handler.ContextStatusResponded)
+			local, err := m.Match(context.Background(), qCtx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if local != tt.wantLocal {
+				t.Fatalf("local = %v, want %v", local, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func Test_localIPVerifyMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     Opt
+		want    string
+		wantErr bool
+	}{
+		{"default", Opt{}, "any", false},
+		{"match strict", Opt{LocalIPMatch: "strict"}, "all", false},
+		{"match any", Opt{LocalIPMatch: "any"}, "any", false},
+		{"match strict and verify all", Opt{LocalIPMatch: "strict", VerifyLocalIP: "all"}, "all", false},
+		{"match strict and verify any", Opt{LocalIPMatch: "strict", VerifyLocalIP: "any"}, "", true},
+		{"match any and verify off", Opt{LocalIPMatch: "any", VerifyLocalIP: "off"}, "", true},
+		{"match strict and trust local ip only", Opt{LocalIPMatch: "strict", TrustLocalIPOnly: true}, "all", false},
+		{"match any and trust local ip only", Opt{LocalIPMatch: "any", TrustLocalIPOnly: true}, "", true},
+		{"invalid match", Opt{LocalIPMatch: "all"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode, err := localIPVerifyMode(&tt.opt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mode != tt.want {
+				t.Fatalf("mode = %s, want %s", mode, tt.want)
+			}
+		})
+	}
+}
+
+func Test_clientFilter(t *testing.T) {
+	l := netlist.NewList()
+	if err := netlist.BatchLoad(l, []string{"192.168.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Sort()
+	f := &clientFilter{allowed: l, logger: zap.NewNop()}
+	tests := []struct {
+		name      string
+		client    net.IP
+		wantRcode int
+	}{
+		{name: "allowed", client: net.IPv4(192, 168, 1, 2), wantRcode: dns.RcodeSuccess},
+		{name: "not allowed", client: net.IPv4(10, 0, 0, 1), wantRcode: dns.RcodeRefused},
+		{name: "no client ip", wantRcode: dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qCtx := handler.NewContext(newTestQuery("example.com", dns.TypeA), &handler.RequestMeta{ClientIP: tt.client})
+			execChain(t, qCtx, f, &testResponder{ip: net.IPv4(1, 2, 3, 4), ttl: 300})
+			if r := qCtx.R(); r == nil || r.Rcode != tt.wantRcode {
+				t.Fatalf("got response %v, want rcode %s", r, dns.RcodeToString[tt.wantRcode])
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadWarmupDomains reads the domains to resolve at startup from files.
+// Duplicated domains are only queried once.
+func loadWarmupDomains(files []string) ([]string, error) {
+	var domains []string
+	seen := make(map[string]struct{})
+	for _, file := range files {
+		err := loadListFile(file, func(s string) error {
+			if !isASCII(s) {
+				a, err := idna.Lookup.ToASCII(s)
+				if err != nil {
+					return fmt.Errorf("invalid domain %s, %w", s, err)
+				}
+				s = a
+			}
+			s = dns.Fqdn(s)
+			if _, ok := dns.IsDomainName(s); !ok {
+				return fmt.Errorf("invalid domain %s", s)
+			}
+			if _, dup := seen[s]; !dup {
+				seen[s] = struct{}{}
+				domains = append(domains, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load warm-up domain file, %w", err)
+		}
+	}
+	return domains, nil
+}
+
+// warmUp resolves the A and AAAA records of domains through entry, so
+// their responses are cached and the upstream connections are opened
+// before the servers accept queries. At most concurrent queries are in
+// flight. Failed queries are logged and ignored.
+//
+// The queries go through the whole entry without client ip, so they are
+// not affected by the client rules, e.g. --allow-client.
+func warmUp(entry handler.ExecutableChainNode, domains []string, concurrent int, timeout time.Duration) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	if opt.NoIPv6 {
+		qtypes = qtypes[:1]
+	}
+
+	start := time.Now()
+	var failed uint32
+	sem := make(chan struct{}, concurrent)
+	wg := new(sync.WaitGroup)
+	for _, d := range domains {
+		for _, qt := range qtypes {
+			q := new(dns.Msg)
+			q.SetQuestion(d, qt)
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := warmUpQuery(entry, q, timeout); err != nil {
+					atomic.AddUint32(&failed, 1)
+					mlog.S().Warnf("warm-up query %s %s failed, %v", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype], err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	mlog.S().Infof("cache warm-up finished, %d domains, %d failed queries, took %s", len(domains), failed, time.Since(start).Round(time.Millisecond))
+}
+
+func warmUpQuery(entry handler.ExecutableChainNode, q *dns.Msg, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	qCtx := handler.NewContext(q, new(handler.RequestMeta))
+	if err := handler.ExecChainNode(ctx, qCtx, entry); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return fmt.Errorf("no response")
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return fmt.Errorf("got %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"os"
+	"strings"
+	"time"
+)
+
+const watchPollInterval = time.Second
+
+// watchLists polls the modification time of the files of all registered
+// lists and reloads the lists whose files have changed. A reload happens
+// after no more changes are seen for debounce, so rapid successive writes
+// only trigger one reload.
+func watchLists(debounce time.Duration) {
+	reloadMu.Lock()
+	lists := make(map[string]reloadable, len(reloadableLists))
+	for name, l := range reloadableLists {
+		lists[name] = l
+	}
+	reloadMu.Unlock()
+
+	lastState := make(map[string]string, len(lists))
+	for name, l := range lists {
+		lastState[name] = filesState(l.sourceFiles())
+	}
+	changedAt := make(map[string]time.Time)
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for name, l := range lists {
+			if s := filesState(l.sourceFiles()); s != lastState[name] {
+				lastState[name] = s
+				changedAt[name] = now
+				continue
+			}
+			t, ok := changedAt[name]
+			if !ok || now.Sub(t) < debounce {
+				continue
+			}
+			delete(changedAt, name)
+			mlog.S().Infof("files of %s changed, reloading", name)
+			reloadList(name, l)
+		}
+	}
+}
+
+// filesState returns a string that changes if any of the files are
+// modified, created or removed.
+func filesState(files []string) string {
+	sb := new(strings.Builder)
+	for _, s := range files {
+		if isURLEntry(s) { // reloaded by SIGHUP only.
+			continue
+		}
+		if file, _, ok := splitDATEntry(s); ok {
+			s = file
+		}
+		fi, err := os.Stat(s)
+		if err != nil {
+			sb.WriteString("-;")
+			continue
+		}
+		fmt.Fprintf(sb, "%d/%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	return sb.String()
+}